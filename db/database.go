@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/juliotorresmoreno/tana-api/logger"
@@ -34,10 +35,25 @@ func Setup() {
 	}
 
 	reportError(DefaultClient.AutoMigrate(&models.User{}))
+	reportError(indexUserPhone(DefaultClient))
+	reportError(DefaultClient.AutoMigrate(&models.Workspace{}))
+	reportError(DefaultClient.AutoMigrate(&models.WorkspaceMember{}))
+	reportError(DefaultClient.AutoMigrate(&models.WorkspaceInvitation{}))
 	reportError(DefaultClient.AutoMigrate(&models.Credential{}))
+	reportError(renameCredentialScopes(DefaultClient))
 	reportError(DefaultClient.AutoMigrate(&models.Mmlu{}))
+	reportError(DefaultClient.AutoMigrate(&models.MmluVersion{}))
 	reportError(DefaultClient.AutoMigrate(&models.Connection{}))
+	reportError(DefaultClient.AutoMigrate(&models.ConversationMessage{}))
 	reportError(DefaultClient.AutoMigrate(&models.Message{}))
+	reportError(indexMessageSearch(DefaultClient))
+	reportError(DefaultClient.AutoMigrate(&models.KnowledgeChunk{}))
+	reportError(DefaultClient.AutoMigrate(&models.RecoveryCode{}))
+	reportError(DefaultClient.AutoMigrate(&models.SignInAttempt{}))
+	reportError(DefaultClient.AutoMigrate(&models.UserIdentity{}))
+	reportError(DefaultClient.AutoMigrate(&models.AuditLog{}))
+	reportError(DefaultClient.AutoMigrate(&models.DataExport{}))
+	reportError(protectAuditLog(DefaultClient))
 
 	DefaultCache, err = NewRedisClient()
 	if err == nil {
@@ -47,6 +63,76 @@ func Setup() {
 	}
 }
 
+// protectAuditLog makes the audit log append only, even for code that tries
+// to update or delete its entries.
+func protectAuditLog(conn *gorm.DB) error {
+	table := models.AuditLog{}.TableName()
+	for _, event := range []string{"UPDATE", "DELETE"} {
+		tx := conn.Exec(
+			"CREATE OR REPLACE RULE " + table + "_no_" + strings.ToLower(event) +
+				" AS ON " + event + " TO " + table + " DO INSTEAD NOTHING",
+		)
+		if tx.Error != nil {
+			return tx.Error
+		}
+	}
+	return nil
+}
+
+// indexUserPhone keeps the phones unique while letting any number of users,
+// like those signed up through a provider, go without one.
+func indexUserPhone(conn *gorm.DB) error {
+	statements := []string{
+		"ALTER TABLE users DROP CONSTRAINT IF EXISTS users_phone_key",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_phone ON users (phone) WHERE phone <> ''",
+	}
+	for _, statement := range statements {
+		if err := conn.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameCredentialScopes moves the scopes of existing credentials to the
+// names of the permissions, singular like connection:read, and grants the
+// message scopes along with the mmlu ones that used to cover the messages.
+func renameCredentialScopes(conn *gorm.DB) error {
+	table := models.Credential{}.TableName()
+	statements := []string{
+		"UPDATE " + table + ` SET scopes = regexp_replace(scopes, '(^|,)(connection|credential|event|user|workspace|upload|job)s:', '\1\2:', 'g')` +
+			` WHERE scopes ~ '(^|,)(connection|credential|event|user|workspace|upload|job)s:'`,
+		"UPDATE " + table + ` SET scopes = regexp_replace(scopes, '(^|,)mmlu:(read|write|\*)', '\1mmlu:\2,message:\2', 'g')` +
+			` WHERE scopes ~ '(^|,)mmlu:' AND scopes !~ '(^|,)message:'`,
+	}
+	for _, statement := range statements {
+		if err := conn.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexMessageSearch adds the full-text search vector of the messages, kept
+// by Postgres as a generated column, along with its index.
+func indexMessageSearch(conn *gorm.DB) error {
+	vectors := make([]string, 0, len(models.SearchLanguages))
+	for _, language := range models.SearchLanguages {
+		vectors = append(vectors, "to_tsvector('"+language+"', coalesce(content, ''))")
+	}
+	statements := []string{
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector " +
+			"GENERATED ALWAYS AS (" + strings.Join(vectors, " || ") + ") STORED",
+		"CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector)",
+	}
+	for _, statement := range statements {
+		if err := conn.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func NewClient() (*gorm.DB, error) {
 	driver := os.Getenv("DATABASE_DRIVER")
 	url := os.Getenv("DATABASE_URL")
@@ -0,0 +1,174 @@
+// Package docextract pulls the text out of documents, page by page so it can
+// be cited. Everything happens in memory.
+package docextract
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/unidoc/unipdf/v3/common/license"
+)
+
+var log = logger.SetupLogger()
+
+var ErrUnsupported = errors.New("unsupported document type")
+
+// ErrTooLarge is returned for archives that expand beyond what an attachment
+// may hold.
+var ErrTooLarge = errors.New("document expands beyond the size limit")
+
+// Page is the text of a page. Formats without pages have a single page.
+type Page struct {
+	Number int    `json:"number"`
+	Text   string `json:"text"`
+}
+
+// PageStart is where a page starts in the text of a document, in bytes.
+type PageStart struct {
+	Number int `json:"number"`
+	Offset int `json:"offset"`
+}
+
+type Document struct {
+	MimeType string
+	Pages    []Page
+}
+
+// Text joins the pages and returns where each one starts.
+func (d *Document) Text() (string, []PageStart) {
+	var text strings.Builder
+	starts := make([]PageStart, 0, len(d.Pages))
+	for _, page := range d.Pages {
+		if text.Len() > 0 {
+			text.WriteString("\n\n")
+		}
+		starts = append(starts, PageStart{Number: page.Number, Offset: text.Len()})
+		text.WriteString(page.Text)
+	}
+	return text.String(), starts
+}
+
+// Pages cuts the text of a document back into its pages. Text without page
+// starts is a single page.
+func Pages(text string, starts []PageStart) []Page {
+	if len(starts) == 0 {
+		return []Page{{Number: 1, Text: text}}
+	}
+	pages := make([]Page, 0, len(starts))
+	for i, start := range starts {
+		end := len(text)
+		if i+1 < len(starts) && starts[i+1].Offset < end {
+			end = starts[i+1].Offset
+		}
+		if start.Offset > end {
+			continue
+		}
+		pages = append(pages, Page{
+			Number: start.Number,
+			Text:   strings.TrimSpace(text[start.Offset:end]),
+		})
+	}
+	return pages
+}
+
+// Extractor pulls the text out of one format.
+type Extractor interface {
+	Extract(data []byte) ([]Page, error)
+}
+
+const (
+	MimePDF      = "application/pdf"
+	MimeDOCX     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	MimeHTML     = "text/html"
+	MimeCSV      = "text/csv"
+	MimeMarkdown = "text/markdown"
+	MimeText     = "text/plain"
+)
+
+var extractors = map[string]Extractor{
+	MimePDF:      pdfExtractor{},
+	MimeDOCX:     docxExtractor{},
+	MimeHTML:     htmlExtractor{},
+	MimeCSV:      csvExtractor{},
+	MimeMarkdown: markdownExtractor{},
+	MimeText:     textExtractor{},
+}
+
+// Setup licenses unipdf with UNIDOC_LICENSE_API_KEY.
+func Setup() {
+	key := os.Getenv("UNIDOC_LICENSE_API_KEY")
+	if key == "" {
+		log.Warn("UNIDOC_LICENSE_API_KEY is not set, PDF extraction may fail")
+		return
+	}
+	if err := license.SetMeteredKey(key); err != nil {
+		log.Error("Error setting the unidoc license", err)
+	}
+}
+
+// Detect returns the supported type of data, sniffed from its content. Text
+// formats that can't be told apart by content, like Markdown, are recognized
+// from the hints, file names or declared media types. Unsupported data comes
+// back with its sniffed type along with ErrUnsupported.
+func Detect(data []byte, hints ...string) (string, error) {
+	detected := mimetype.Detect(data)
+	for mime := detected; mime != nil; mime = mime.Parent() {
+		for supported := range extractors {
+			if supported != MimeMarkdown && mime.Is(supported) {
+				if supported == MimeText && isMarkdown(hints) {
+					return MimeMarkdown, nil
+				}
+				return supported, nil
+			}
+		}
+	}
+	return detected.String(), ErrUnsupported
+}
+
+// Supported lists the types that can be extracted.
+func Supported() []string {
+	supported := make([]string, 0, len(extractors))
+	for mime := range extractors {
+		supported = append(supported, mime)
+	}
+	sort.Strings(supported)
+	return supported
+}
+
+func isMarkdown(hints []string) bool {
+	for _, hint := range hints {
+		hint = strings.ToLower(hint)
+		extension := filepath.Ext(hint)
+		if strings.HasPrefix(hint, MimeMarkdown) || extension == ".md" || extension == ".markdown" {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract detects the type of data and extracts its text.
+func Extract(data []byte, hints ...string) (*Document, error) {
+	mime, err := Detect(data, hints...)
+	if err != nil {
+		return nil, err
+	}
+	return ExtractAs(data, mime)
+}
+
+// ExtractAs extracts the text of data as mime, a type returned by Detect.
+func ExtractAs(data []byte, mime string) (*Document, error) {
+	extractor, ok := extractors[mime]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	pages, err := extractor.Extract(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Document{MimeType: mime, Pages: pages}, nil
+}
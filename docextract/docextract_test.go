@@ -0,0 +1,220 @@
+package docextract
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// docx builds a DOCX holding body as the content of word/document.xml.
+func docx(t *testing.T, body string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	file, err := archive.Create("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+		body + `</w:body></w:document>`
+	if _, err := file.Write([]byte(document)); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func paragraph(text string) string {
+	return `<w:p><w:r><w:t>` + text + `</w:t></w:r></w:p>`
+}
+
+func TestExtractors(t *testing.T) {
+	cases := []struct {
+		name      string
+		extractor Extractor
+		data      string
+		want      []Page
+	}{
+		{
+			name:      "text",
+			extractor: textExtractor{},
+			data:      "\xef\xbb\xbf first line\r\nsecond line\n",
+			want:      []Page{{Number: 1, Text: "first line\nsecond line"}},
+		},
+		{
+			name:      "markdown",
+			extractor: markdownExtractor{},
+			data:      "# Title\n\nSee [the docs](https://example.com) and **this** `code`.\n\n> quoted",
+			want:      []Page{{Number: 1, Text: "Title\n\nSee the docs and this code.\n\nquoted"}},
+		},
+		{
+			name:      "csv headers",
+			extractor: csvExtractor{},
+			data:      "name,age\nAna,30\nLuis,41,extra\n",
+			want:      []Page{{Number: 1, Text: "name: Ana; age: 30\nname: Luis; age: 41; extra"}},
+		},
+		{
+			name:      "empty csv",
+			extractor: csvExtractor{},
+			data:      "",
+			want:      []Page{{Number: 1}},
+		},
+		{
+			name:      "html",
+			extractor: htmlExtractor{},
+			data:      "<html><head><title>skip</title></head><body><h1>Title</h1><p>Some   <b>bold</b> text</p><script>skip()</script></body></html>",
+			want:      []Page{{Number: 1, Text: "Title\nSome bold text"}},
+		},
+		{
+			name:      "docx paragraphs",
+			extractor: docxExtractor{},
+			data:      string(docx(t, paragraph("first")+`<w:p><w:r><w:t>a</w:t><w:tab/><w:t>b</w:t></w:r></w:p>`)),
+			want:      []Page{{Number: 1, Text: "first\na\tb"}},
+		},
+		{
+			name:      "docx page breaks",
+			extractor: docxExtractor{},
+			data: string(docx(t, paragraph("one")+
+				`<w:p><w:r><w:br w:type="page"/></w:r></w:p>`+
+				`<w:p><w:r><w:lastRenderedPageBreak/><w:t>two</w:t></w:r></w:p>`+
+				`<w:p><w:r><w:lastRenderedPageBreak/><w:t>three</w:t></w:r></w:p>`)),
+			want: []Page{{Number: 1, Text: "one"}, {Number: 2, Text: "two"}, {Number: 3, Text: "three"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pages, err := c.extractor.Extract([]byte(c.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pages, c.want) {
+				t.Errorf("pages = %#v, want %#v", pages, c.want)
+			}
+		})
+	}
+}
+
+func TestDocxWithoutDocument(t *testing.T) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	if _, err := archive.Create("other.xml"); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+	if _, err := (docxExtractor{}).Extract(buffer.Bytes()); err != ErrUnsupported {
+		t.Errorf("err = %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestDocxExpansionLimit(t *testing.T) {
+	t.Setenv("ATTACHMENT_MAX_SIZE", "1024")
+	// Compresses to a few hundred bytes but expands beyond five times the limit.
+	data := docx(t, paragraph(strings.Repeat("a", 10<<10)))
+	if len(data) > 1024 {
+		t.Fatalf("fixture is %v bytes", len(data))
+	}
+	_, err := (docxExtractor{}).Extract(data)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("err = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestTextAndPages(t *testing.T) {
+	cases := []struct {
+		name   string
+		pages  []Page
+		text   string
+		starts []PageStart
+	}{
+		{
+			name:   "single page",
+			pages:  []Page{{Number: 1, Text: "only"}},
+			text:   "only",
+			starts: []PageStart{{Number: 1, Offset: 0}},
+		},
+		{
+			name:   "several pages",
+			pages:  []Page{{Number: 1, Text: "one"}, {Number: 2, Text: "two"}, {Number: 5, Text: "five"}},
+			text:   "one\n\ntwo\n\nfive",
+			starts: []PageStart{{Number: 1, Offset: 0}, {Number: 2, Offset: 5}, {Number: 5, Offset: 10}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			document := &Document{Pages: c.pages}
+			text, starts := document.Text()
+			if text != c.text {
+				t.Errorf("text = %q, want %q", text, c.text)
+			}
+			if !reflect.DeepEqual(starts, c.starts) {
+				t.Errorf("starts = %v, want %v", starts, c.starts)
+			}
+			if pages := Pages(text, starts); !reflect.DeepEqual(pages, c.pages) {
+				t.Errorf("Pages = %v, want %v", pages, c.pages)
+			}
+		})
+	}
+}
+
+func TestPages(t *testing.T) {
+	cases := []struct {
+		name   string
+		text   string
+		starts []PageStart
+		want   []Page
+	}{
+		{
+			name: "no starts",
+			text: "all of it",
+			want: []Page{{Number: 1, Text: "all of it"}},
+		},
+		{
+			name:   "out of range start",
+			text:   "one\n\ntwo",
+			starts: []PageStart{{Number: 1, Offset: 0}, {Number: 2, Offset: 50}},
+			want:   []Page{{Number: 1, Text: "one\n\ntwo"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if pages := Pages(c.text, c.starts); !reflect.DeepEqual(pages, c.want) {
+				t.Errorf("Pages = %v, want %v", pages, c.want)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  []byte
+		hints []string
+		want  string
+		err   error
+	}{
+		{name: "text", data: []byte("plain words"), want: MimeText},
+		{name: "markdown by name", data: []byte("# Title"), hints: []string{"notes.md"}, want: MimeMarkdown},
+		{name: "markdown by type", data: []byte("# Title"), hints: []string{"text/markdown; charset=utf-8"}, want: MimeMarkdown},
+		{name: "html", data: []byte("<!DOCTYPE html><html><body>hi</body></html>"), want: MimeHTML},
+		{name: "pdf", data: []byte("%PDF-1.4\n"), want: MimePDF},
+		{name: "docx", data: docx(t, paragraph("hi")), want: MimeDOCX},
+		{name: "unsupported", data: []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}, want: "image/png", err: ErrUnsupported},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mime, err := Detect(c.data, c.hints...)
+			if err != c.err {
+				t.Errorf("err = %v, want %v", err, c.err)
+			}
+			if mime != c.want {
+				t.Errorf("mime = %v, want %v", mime, c.want)
+			}
+		})
+	}
+}
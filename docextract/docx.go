@@ -0,0 +1,131 @@
+package docextract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+// docxExtractor reads word/document.xml. DOCX files don't store pages, so
+// they are split at the page breaks Word rendered or the user inserted.
+type docxExtractor struct{}
+
+func (docxExtractor) Extract(data []byte) ([]Page, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var document *zip.File
+	for _, file := range archive.File {
+		if file.Name == "word/document.xml" {
+			document = file
+			break
+		}
+	}
+	if document == nil {
+		return nil, ErrUnsupported
+	}
+	file, err := document.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// The size the archive declares can't be trusted, the reader stops the
+	// decompression itself.
+	content := &limitedReader{reader: file, remaining: maxExpandedSize()}
+
+	pages := make([]Page, 0)
+	var text strings.Builder
+	newPage := func() {
+		pages = append(pages, Page{Number: len(pages) + 1, Text: strings.TrimSpace(text.String())})
+		text.Reset()
+	}
+
+	decoder := xml.NewDecoder(content)
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br":
+				if attr(element, "type") == "page" {
+					if strings.TrimSpace(text.String()) != "" {
+						newPage()
+					}
+				} else {
+					text.WriteString("\n")
+				}
+			case "lastRenderedPageBreak":
+				// Also follows explicit breaks, so empty pages are skipped.
+				if strings.TrimSpace(text.String()) != "" {
+					newPage()
+				}
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(element)
+			}
+		}
+	}
+	newPage()
+	return pages, nil
+}
+
+// maxExpandedSize bounds what the XML of a document can decompress to: five
+// times the largest attachment, from ATTACHMENT_MAX_SIZE, as text compresses
+// well but not endlessly.
+func maxExpandedSize() int64 {
+	return 5 * int64(utils.IntFromEnv("ATTACHMENT_MAX_SIZE", 20<<20))
+}
+
+// limitedReader fails with ErrTooLarge instead of ending quietly like
+// io.LimitReader, so a cut document isn't taken for a whole one.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func attr(element xml.StartElement, name string) string {
+	for _, a := range element.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package docextract
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+type htmlExtractor struct{}
+
+// blockElements end a line of text.
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"section": true, "article": true, "blockquote": true, "pre": true,
+}
+
+// skippedElements have no readable text.
+var skippedElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "head": true,
+}
+
+func (htmlExtractor) Extract(data []byte) ([]Page, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	var text strings.Builder
+	skipping := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return nil, err
+			}
+			return []Page{{Number: 1, Text: collapseLines(text.String())}}, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			if skippedElements[string(name)] {
+				skipping++
+			} else if blockElements[string(name)] {
+				text.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if skippedElements[string(name)] && skipping > 0 {
+				skipping--
+			} else if blockElements[string(name)] {
+				text.WriteString("\n")
+			}
+		case html.TextToken:
+			if skipping == 0 {
+				text.Write(tokenizer.Text())
+			}
+		}
+	}
+}
+
+// collapseLines trims every line and drops the empty ones.
+func collapseLines(text string) string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
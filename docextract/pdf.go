@@ -0,0 +1,51 @@
+package docextract
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/extractor"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+type pdfExtractor struct{}
+
+func (pdfExtractor) Extract(data []byte) ([]Page, error) {
+	reader, err := model.NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Documents only protected against editing open with an empty password.
+	encrypted, err := reader.IsEncrypted()
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		if ok, err := reader.Decrypt([]byte("")); err != nil || !ok {
+			return nil, ErrUnsupported
+		}
+	}
+
+	count, err := reader.GetNumPages()
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]Page, 0, count)
+	for number := 1; number <= count; number++ {
+		page, err := reader.GetPage(number)
+		if err != nil {
+			return nil, err
+		}
+		ex, err := extractor.New(page)
+		if err != nil {
+			return nil, err
+		}
+		text, err := ex.ExtractText()
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, Page{Number: number, Text: strings.TrimSpace(text)})
+	}
+	return pages, nil
+}
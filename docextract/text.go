@@ -0,0 +1,89 @@
+package docextract
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type textExtractor struct{}
+
+func (textExtractor) Extract(data []byte) ([]Page, error) {
+	return []Page{{Number: 1, Text: plainText(data)}}, nil
+}
+
+func plainText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := strings.ToValidUTF8(string(data), "")
+	return strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+}
+
+// markdownExtractor drops the markup that would only add noise, keeping the
+// text of headings, links and emphasis.
+type markdownExtractor struct{}
+
+var markdownRules = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile("(?m)^```.*$"), ""},
+	{regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`), "$1"},
+	{regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`), "$1"},
+	{regexp.MustCompile(`(?m)^[ \t]{0,3}#{1,6}[ \t]+`), ""},
+	{regexp.MustCompile(`(?m)^[ \t]{0,3}>[ \t]?`), ""},
+	{regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`), "$2"},
+	{regexp.MustCompile("`([^`]*)`"), "$1"},
+}
+
+func (markdownExtractor) Extract(data []byte) ([]Page, error) {
+	text := plainText(data)
+	for _, rule := range markdownRules {
+		text = rule.pattern.ReplaceAllString(text, rule.replacement)
+	}
+	return []Page{{Number: 1, Text: strings.TrimSpace(text)}}, nil
+}
+
+// csvExtractor writes every row as "column: value" pairs, so a chunk of the
+// table still says what its values are.
+type csvExtractor struct{}
+
+func (csvExtractor) Extract(data []byte) ([]Page, error) {
+	reader := csv.NewReader(strings.NewReader(plainText(data)))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []Page{{Number: 1}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]string, 0, len(record))
+		for i, value := range record {
+			column := ""
+			if i < len(header) {
+				column = header[i]
+			}
+			if column == "" {
+				fields = append(fields, value)
+			} else {
+				fields = append(fields, column+": "+value)
+			}
+		}
+		lines = append(lines, strings.Join(fields, "; "))
+	}
+	return []Page{{Number: 1, Text: strings.Join(lines, "\n")}}, nil
+}
@@ -0,0 +1,48 @@
+package knowledge
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Split cuts text into chunks of about size characters, breaking between
+// words. Consecutive chunks share about overlap characters so a sentence cut
+// in two is still whole in one of them.
+func Split(text string, size, overlap int) []string {
+	words := strings.Fields(text)
+	chunks := make([]string, 0)
+
+	start := 0
+	for start < len(words) {
+		end, length := start, 0
+		for end < len(words) {
+			wordLength := utf8.RuneCountInString(words[end])
+			if end > start && length+1+wordLength > size {
+				break
+			}
+			if end > start {
+				length++
+			}
+			length += wordLength
+			end++
+		}
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			break
+		}
+
+		// Step back over the last words to start the next chunk with the
+		// overlap, always moving forward.
+		next, shared := end, 0
+		for next > start+1 {
+			wordLength := utf8.RuneCountInString(words[next-1])
+			if shared+wordLength > overlap {
+				break
+			}
+			shared += wordLength + 1
+			next--
+		}
+		start = next
+	}
+	return chunks
+}
@@ -0,0 +1,84 @@
+package knowledge
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/juliotorresmoreno/tana-api/models"
+)
+
+func TestSplitShortText(t *testing.T) {
+	chunks := Split("  una   frase corta ", 100, 20)
+	if len(chunks) != 1 || chunks[0] != "una frase corta" {
+		t.Errorf("chunks = %q", chunks)
+	}
+	if chunks := Split(" \n ", 100, 20); len(chunks) != 0 {
+		t.Errorf("chunks of blank text = %q", chunks)
+	}
+}
+
+func TestSplitSizeAndOverlap(t *testing.T) {
+	words := make([]string, 0)
+	for i := 0; i < 200; i++ {
+		words = append(words, "palabra"+strings.Repeat("x", i%5))
+	}
+	text := strings.Join(words, " ")
+
+	chunks := Split(text, 100, 30)
+	if len(chunks) < 2 {
+		t.Fatalf("chunks = %q", chunks)
+	}
+	for i, chunk := range chunks {
+		if utf8.RuneCountInString(chunk) > 100 {
+			t.Errorf("chunk %v is %v characters long", i, utf8.RuneCountInString(chunk))
+		}
+		if i == 0 {
+			continue
+		}
+		// Every chunk starts with words the previous one ended with.
+		first := strings.Fields(chunk)[0]
+		if !strings.Contains(chunks[i-1], first) {
+			t.Errorf("chunk %v doesn't overlap with the previous one", i)
+		}
+	}
+	if !strings.HasPrefix(text, chunks[0]) || !strings.HasSuffix(text, chunks[len(chunks)-1]) {
+		t.Error("chunks don't cover the whole text")
+	}
+}
+
+func TestSplitLongWord(t *testing.T) {
+	long := strings.Repeat("a", 50)
+	chunks := Split("corta "+long+" fin", 10, 5)
+	found := false
+	for _, chunk := range chunks {
+		if chunk == long {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("a word longer than the size should be its own chunk, got %q", chunks)
+	}
+}
+
+func TestSplitMessagePages(t *testing.T) {
+	message := &models.Message{
+		Content: "primera página segunda página",
+		Pages:   models.JSON(`[{"number":1,"offset":0},{"number":2,"offset":16}]`),
+	}
+	pieces, pageNumbers := split(message)
+	if len(pieces) != 2 || len(pageNumbers) != 2 {
+		t.Fatalf("pieces = %q, pages = %v", pieces, pageNumbers)
+	}
+	if pieces[0] != "primera página" || pageNumbers[0] != 1 {
+		t.Errorf("first piece = %q on page %v", pieces[0], pageNumbers[0])
+	}
+	if pieces[1] != "segunda página" || pageNumbers[1] != 2 {
+		t.Errorf("second piece = %q on page %v", pieces[1], pageNumbers[1])
+	}
+
+	pieces, pageNumbers = split(&models.Message{Content: "sin páginas"})
+	if len(pieces) != 1 || pageNumbers[0] != 0 {
+		t.Errorf("pieces = %q, pages = %v", pieces, pageNumbers)
+	}
+}
@@ -0,0 +1,71 @@
+package knowledge
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"gorm.io/gorm"
+)
+
+// cosineStore ranks the embeddings saved with the chunks in process. It
+// needs nothing from the database but loads every chunk of the sources on
+// each search.
+type cosineStore struct{}
+
+func (s *cosineStore) Index(tx *gorm.DB, chunks []*models.KnowledgeChunk) error {
+	return nil
+}
+
+func (s *cosineStore) Search(ctx context.Context, mmluID uint, sources []Source, model string, query []float64, k int) ([]*Match, error) {
+	chunks := make([]*models.KnowledgeChunk, 0)
+	tx := db.DefaultClient.WithContext(ctx).
+		Where("mmlu_id = ? AND model = ?", mmluID, model).
+		Where("(message_id, content_hash) IN ?", sourceKeys(sources)).
+		Find(&chunks)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return rank(chunks, query, k), nil
+}
+
+func rank(chunks []*models.KnowledgeChunk, query []float64, k int) []*Match {
+	matches := make([]*Match, 0, len(chunks))
+	for _, chunk := range chunks {
+		matches = append(matches, &Match{
+			ChunkID:   chunk.ID,
+			MessageID: chunk.MessageId,
+			Position:  chunk.Position,
+			Page:      chunk.Page,
+			Content:   chunk.Content,
+			Score:     cosine(chunk.Embedding, query),
+		})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches
+}
+
+// cosine is the cosine similarity of a and b, zero when their dimensions
+// differ.
+func cosine(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
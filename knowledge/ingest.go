@@ -0,0 +1,223 @@
+package knowledge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/docextract"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"gorm.io/gorm"
+)
+
+// embedBatch is how many chunks are embedded per request.
+const embedBatch = 32
+
+// ContentHash identifies a content of a message. Chunks are kept per content
+// for as long as the message or a version of its mmlu has it.
+func ContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Ingest chunks the current content of the message, unless it already was,
+// and drops the chunks of the contents neither the message nor any version
+// has anymore. Deleted messages keep the chunks their versions need.
+func Ingest(ctx context.Context, messageID uint) error {
+	conn := db.DefaultClient.WithContext(ctx)
+	message := &models.Message{}
+	if err := conn.Unscoped().Limit(1).Find(message, messageID).Error; err != nil {
+		return err
+	}
+	if message.ID == 0 {
+		return nil
+	}
+
+	if !message.DeletedAt.Valid {
+		mmlu := &models.Mmlu{}
+		if err := conn.Select("id", "provider").First(mmlu, message.MmluId).Error; err != nil {
+			return err
+		}
+		if err := ingest(ctx, mmlu.Provider, message); err != nil {
+			return err
+		}
+	}
+	return prune(ctx, message)
+}
+
+func ingest(ctx context.Context, providerName string, message *models.Message) error {
+	conn := db.DefaultClient.WithContext(ctx)
+	model := EmbeddingModel(providerName)
+	hash := ContentHash(message.Content)
+
+	existing := int64(0)
+	tx := conn.Model(&models.KnowledgeChunk{}).
+		Where("message_id = ? AND content_hash = ? AND model = ?", message.ID, hash, model).
+		Count(&existing)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	provider, err := providers.Get(providerName)
+	if err != nil {
+		return err
+	}
+
+	// Embedding is the slow part, so it happens before the transaction.
+	pieces, pageNumbers := split(message)
+	chunks := make([]*models.KnowledgeChunk, 0, len(pieces))
+	for start := 0; start < len(pieces); start += embedBatch {
+		end := start + embedBatch
+		if end > len(pieces) {
+			end = len(pieces)
+		}
+		embeddings, err := provider.Embed(ctx, model, pieces[start:end])
+		if err != nil {
+			return err
+		}
+		if len(embeddings) != end-start {
+			return fmt.Errorf("expected %v embeddings, got %v", end-start, len(embeddings))
+		}
+		for i, embedding := range embeddings {
+			chunks = append(chunks, &models.KnowledgeChunk{
+				MmluId:      message.MmluId,
+				MessageId:   message.ID,
+				ContentHash: hash,
+				Position:    start + i,
+				Page:        pageNumbers[start+i],
+				Content:     pieces[start+i],
+				Model:       model,
+				Embedding:   embedding,
+			})
+		}
+	}
+
+	return conn.Transaction(func(tx *gorm.DB) error {
+		// A concurrent ingest of the same content may have won the race.
+		err := tx.Where("message_id = ? AND content_hash = ? AND model = ?", message.ID, hash, model).
+			Delete(&models.KnowledgeChunk{}).Error
+		if err != nil {
+			return err
+		}
+		if len(chunks) == 0 {
+			return nil
+		}
+		if err := tx.Create(&chunks).Error; err != nil {
+			return err
+		}
+		return store.Index(tx, chunks)
+	})
+}
+
+// prune deletes the chunks of the contents of the message that are neither
+// its current content nor in a version of its mmlu.
+func prune(ctx context.Context, message *models.Message) error {
+	conn := db.DefaultClient.WithContext(ctx)
+	contents := make([]string, 0)
+	tx := conn.Raw(`
+		SELECT DISTINCT m->>'content'
+		FROM mmlu_versions v, jsonb_array_elements(v.messages) m
+		WHERE v.mmlu_id = ? AND (m->>'id')::bigint = ?`,
+		message.MmluId, message.ID,
+	).Scan(&contents)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if !message.DeletedAt.Valid {
+		contents = append(contents, message.Content)
+	}
+
+	stale := conn.Where("message_id = ?", message.ID)
+	if len(contents) > 0 {
+		keep := make([]string, 0, len(contents))
+		for _, content := range contents {
+			keep = append(keep, ContentHash(content))
+		}
+		stale = stale.Where("content_hash NOT IN ?", keep)
+	}
+	return stale.Delete(&models.KnowledgeChunk{}).Error
+}
+
+// split chunks the message page by page, so every chunk can cite its page.
+// Messages without pages get page zero.
+func split(message *models.Message) ([]string, []int) {
+	pages := []docextract.Page{{Text: message.Content}}
+	if len(message.Pages) > 0 {
+		starts := make([]docextract.PageStart, 0)
+		if err := json.Unmarshal(message.Pages, &starts); err == nil {
+			pages = docextract.Pages(message.Content, starts)
+		}
+	}
+
+	pieces := make([]string, 0)
+	pageNumbers := make([]int, 0)
+	for _, page := range pages {
+		for _, piece := range Split(page.Text, chunkSize(), chunkOverlap()) {
+			pieces = append(pieces, piece)
+			pageNumbers = append(pageNumbers, page.Number)
+		}
+	}
+	return pieces, pageNumbers
+}
+
+// IngestMmlu ingests every message of the mmlu again, like after its
+// provider changes.
+func IngestMmlu(ctx context.Context, mmluID uint) error {
+	ids := make([]uint, 0)
+	tx := db.DefaultClient.WithContext(ctx).Model(&models.Message{}).
+		Where("mmlu_id = ?", mmluID).
+		Pluck("id", &ids)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, id := range ids {
+		if err := Ingest(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfill ingests the messages that have no chunks of their content yet,
+// one instance at a time.
+func backfill() {
+	ctx := context.Background()
+	locked, err := db.DefaultCache.SetNX(ctx, "knowledge-backfill-lock", 1, time.Hour).Result()
+	if err != nil {
+		log.Error("Error locking knowledge backfill", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer db.DefaultCache.Del(ctx, "knowledge-backfill-lock")
+
+	// The hash matches ContentHash, chunks saved before contents were hashed
+	// have none.
+	ids := make([]uint, 0)
+	chunked := db.DefaultClient.Model(&models.KnowledgeChunk{}).
+		Select("1").
+		Where("knowledge_chunks.message_id = messages.id").
+		Where("knowledge_chunks.content_hash = encode(sha256(convert_to(messages.content, 'UTF8')), 'hex')")
+	tx := db.DefaultClient.Model(&models.Message{}).
+		Where("NOT EXISTS (?)", chunked).
+		Where("content <> ''").
+		Pluck("id", &ids)
+	if tx.Error != nil {
+		log.Error("Error getting messages to ingest", tx.Error)
+		return
+	}
+	for _, id := range ids {
+		if err := Ingest(ctx, id); err != nil {
+			log.Error("Error ingesting message ", id, ": ", err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package knowledge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+)
+
+var log = logger.SetupLogger()
+
+// Match is a chunk relevant to a query. Citation is its number in the prompt.
+type Match struct {
+	Citation  int     `json:"citation"`
+	ChunkID   uint    `json:"chunk_id"`
+	MessageID uint    `json:"message_id"`
+	Position  int     `json:"position"`
+	Page      int     `json:"page,omitempty"`
+	Content   string  `json:"content"`
+	Score     float64 `json:"score"`
+}
+
+// Source is a message with the content a version of its mmlu has.
+type Source struct {
+	MessageID uint
+	Content   string
+}
+
+// sourceKeys are the message ids and content hashes of the sources, for a
+// (message_id, content_hash) IN condition.
+func sourceKeys(sources []Source) [][]interface{} {
+	keys := make([][]interface{}, 0, len(sources))
+	for _, source := range sources {
+		keys = append(keys, []interface{}{source.MessageID, ContentHash(source.Content)})
+	}
+	return keys
+}
+
+// Store makes the embeddings of the chunks searchable.
+type Store interface {
+	// Index is called in the transaction that saves the chunks.
+	Index(tx *gorm.DB, chunks []*models.KnowledgeChunk) error
+	// Search returns the k chunks of the sources closest to query, embedded
+	// with model, best first.
+	Search(ctx context.Context, mmluID uint, sources []Source, model string, query []float64, k int) ([]*Match, error)
+}
+
+var store Store = &cosineStore{}
+
+// Setup picks the store from KNOWLEDGE_STORE: "pgvector", the default, or
+// "memory" to rank the chunks in process. pgvector falls back to the latter
+// when the extension isn't available. Messages without chunks, like the ones
+// stored before the knowledge base existed, are ingested in the background.
+func Setup() {
+	if os.Getenv("KNOWLEDGE_STORE") != "memory" {
+		pgvector, err := newPgvectorStore(db.DefaultClient)
+		if err == nil {
+			store = pgvector
+		} else {
+			log.Warn("pgvector isn't available, ranking knowledge in process: ", err)
+		}
+	}
+	go backfill()
+}
+
+func chunkSize() int {
+	return utils.IntFromEnv("KNOWLEDGE_CHUNK_SIZE", 1000)
+}
+
+func chunkOverlap() int {
+	return utils.IntFromEnv("KNOWLEDGE_CHUNK_OVERLAP", 200)
+}
+
+func topK() int {
+	return utils.IntFromEnv("KNOWLEDGE_TOP_K", 5)
+}
+
+var defaultEmbeddingModels = map[string]string{
+	"ollama": "nomic-embed-text",
+	"openai": "text-embedding-3-small",
+}
+
+// EmbeddingModel is the model that embeds the knowledge of the mmlus of a
+// provider, from <PROVIDER>_EMBEDDING_MODEL, like OLLAMA_EMBEDDING_MODEL.
+func EmbeddingModel(provider string) string {
+	if model := os.Getenv(strings.ToUpper(provider) + "_EMBEDDING_MODEL"); model != "" {
+		return model
+	}
+	return defaultEmbeddingModels[provider]
+}
+
+// Retrieve returns the chunks of the sources most relevant to query, ranked
+// with the embedding model of provider.
+func Retrieve(ctx context.Context, provider string, mmluID uint, sources []Source, query string) ([]*Match, error) {
+	if len(sources) == 0 || strings.TrimSpace(query) == "" {
+		return nil, nil
+	}
+	backend, err := providers.Get(provider)
+	if err != nil {
+		return nil, err
+	}
+	model := EmbeddingModel(provider)
+	embeddings, err := backend.Embed(ctx, model, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != 1 {
+		return nil, fmt.Errorf("expected 1 embedding, got %v", len(embeddings))
+	}
+
+	matches, err := store.Search(ctx, mmluID, sources, model, embeddings[0], topK())
+	if err != nil {
+		return nil, err
+	}
+	for i, match := range matches {
+		match.Citation = i + 1
+	}
+	return matches, nil
+}
+
+// Prompt appends the matches to the system prompt, numbered so the answer
+// can cite them.
+func Prompt(systemPrompt string, matches []*Match) string {
+	if len(matches) == 0 {
+		return systemPrompt
+	}
+
+	var prompt strings.Builder
+	if systemPrompt != "" {
+		prompt.WriteString(systemPrompt)
+		prompt.WriteString("\n\n")
+	}
+	prompt.WriteString("Answer using the following sources when they are relevant, ")
+	prompt.WriteString("citing them by number like [1].\n")
+	for _, match := range matches {
+		if match.Page > 0 {
+			fmt.Fprintf(&prompt, "\n[%v] (page %v) %v\n", match.Citation, match.Page, match.Content)
+		} else {
+			fmt.Fprintf(&prompt, "\n[%v] %v\n", match.Citation, match.Content)
+		}
+	}
+	return prompt.String()
+}
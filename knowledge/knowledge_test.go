@@ -0,0 +1,176 @@
+package knowledge
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"gorm.io/gorm"
+)
+
+// fakeProvider embeds every input as the vector of the query it was given.
+type fakeProvider struct {
+	providers.Provider
+	embeddings map[string][]float64
+	model      string
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) Embed(ctx context.Context, model string, input []string) ([][]float64, error) {
+	p.model = model
+	result := make([][]float64, 0, len(input))
+	for _, text := range input {
+		result = append(result, p.embeddings[text])
+	}
+	return result, nil
+}
+
+// fakeStore ranks its chunks in process, like the cosine store does with the
+// chunks it loads.
+type fakeStore struct {
+	chunks  []*models.KnowledgeChunk
+	sources []Source
+}
+
+func (s *fakeStore) Index(tx *gorm.DB, chunks []*models.KnowledgeChunk) error {
+	return nil
+}
+
+func (s *fakeStore) Search(ctx context.Context, mmluID uint, sources []Source, model string, query []float64, k int) ([]*Match, error) {
+	s.sources = sources
+	keys := map[[2]interface{}]bool{}
+	for _, key := range sourceKeys(sources) {
+		keys[[2]interface{}{key[0], key[1]}] = true
+	}
+	chunks := make([]*models.KnowledgeChunk, 0)
+	for _, chunk := range s.chunks {
+		if chunk.MmluId == mmluID && chunk.Model == model && keys[[2]interface{}{chunk.MessageId, chunk.ContentHash}] {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return rank(chunks, query, k), nil
+}
+
+func useFakes(t *testing.T, provider *fakeProvider, fake *fakeStore) {
+	t.Helper()
+	providers.Register(provider)
+	previous := store
+	store = fake
+	t.Cleanup(func() { store = previous })
+	t.Setenv("FAKE_EMBEDDING_MODEL", "fake-embed")
+}
+
+func TestCosine(t *testing.T) {
+	cases := []struct {
+		a, b []float64
+		want float64
+	}{
+		{[]float64{1, 0}, []float64{1, 0}, 1},
+		{[]float64{1, 0}, []float64{0, 1}, 0},
+		{[]float64{1, 1}, []float64{-1, -1}, -1},
+		{[]float64{3, 4}, []float64{6, 8}, 1},
+		{[]float64{1, 0}, []float64{1, 0, 0}, 0},
+		{[]float64{0, 0}, []float64{1, 0}, 0},
+		{nil, nil, 0},
+	}
+	for _, c := range cases {
+		if got := cosine(c.a, c.b); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("cosine(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	chunks := []*models.KnowledgeChunk{
+		{ID: 1, MessageId: 10, Content: "lejos", Embedding: models.Vector{0, 1}},
+		{ID: 2, MessageId: 10, Position: 1, Content: "cerca", Embedding: models.Vector{1, 0.1}},
+		{ID: 3, MessageId: 11, Page: 4, Content: "medio", Embedding: models.Vector{1, 1}},
+	}
+	matches := rank(chunks, []float64{1, 0}, 2)
+	if len(matches) != 2 {
+		t.Fatalf("matches = %+v", matches)
+	}
+	if matches[0].ChunkID != 2 || matches[0].Position != 1 || matches[1].ChunkID != 3 || matches[1].Page != 4 {
+		t.Errorf("unexpected ranking %+v %+v", matches[0], matches[1])
+	}
+	if matches[0].Score < matches[1].Score {
+		t.Error("matches aren't sorted best first")
+	}
+}
+
+func TestRetrieveUsesTheContentOfTheVersion(t *testing.T) {
+	provider := &fakeProvider{embeddings: map[string][]float64{"¿precio?": {1, 0}}}
+	fake := &fakeStore{chunks: []*models.KnowledgeChunk{
+		// The message was edited after the version was taken, and another
+		// message was deleted since.
+		{ID: 1, MmluId: 1, MessageId: 10, ContentHash: ContentHash("cuesta 5"), Model: "fake-embed", Content: "cuesta 5", Embedding: models.Vector{1, 0}},
+		{ID: 2, MmluId: 1, MessageId: 10, ContentHash: ContentHash("cuesta 7"), Model: "fake-embed", Content: "cuesta 7", Embedding: models.Vector{1, 0}},
+		{ID: 3, MmluId: 1, MessageId: 11, ContentHash: ContentHash("borrado"), Model: "fake-embed", Content: "borrado", Embedding: models.Vector{0.9, 0.1}},
+		{ID: 4, MmluId: 1, MessageId: 12, ContentHash: ContentHash("otro modelo"), Model: "other", Content: "otro modelo", Embedding: models.Vector{1, 0}},
+		{ID: 5, MmluId: 2, MessageId: 13, ContentHash: ContentHash("otra mmlu"), Model: "fake-embed", Content: "otra mmlu", Embedding: models.Vector{1, 0}},
+	}}
+	useFakes(t, provider, fake)
+
+	sources := []Source{
+		{MessageID: 10, Content: "cuesta 5"},
+		{MessageID: 11, Content: "borrado"},
+		{MessageID: 12, Content: "otro modelo"},
+		{MessageID: 13, Content: "otra mmlu"},
+	}
+	matches, err := Retrieve(context.Background(), "fake", 1, sources, "¿precio?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.model != "fake-embed" {
+		t.Errorf("query embedded with %q", provider.model)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("matches = %+v", matches)
+	}
+	if matches[0].ChunkID != 1 || matches[0].Citation != 1 {
+		t.Errorf("first match = %+v", matches[0])
+	}
+	if matches[1].ChunkID != 3 || matches[1].Citation != 2 {
+		t.Errorf("second match = %+v", matches[1])
+	}
+}
+
+func TestRetrieveWithoutSources(t *testing.T) {
+	fake := &fakeStore{}
+	useFakes(t, &fakeProvider{}, fake)
+
+	matches, err := Retrieve(context.Background(), "fake", 1, nil, "hola")
+	if err != nil || matches != nil {
+		t.Errorf("matches = %v, err = %v", matches, err)
+	}
+	matches, err = Retrieve(context.Background(), "fake", 1, []Source{{MessageID: 1}}, "  ")
+	if err != nil || matches != nil {
+		t.Errorf("matches = %v, err = %v", matches, err)
+	}
+	if fake.sources != nil {
+		t.Error("the store shouldn't be searched")
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	if prompt := Prompt("Sé breve.", nil); prompt != "Sé breve." {
+		t.Errorf("prompt without matches = %q", prompt)
+	}
+
+	prompt := Prompt("Sé breve.", []*Match{
+		{Citation: 1, Content: "cuesta 5"},
+		{Citation: 2, Page: 3, Content: "envío gratis"},
+	})
+	if !strings.HasPrefix(prompt, "Sé breve.\n\n") {
+		t.Errorf("system prompt lost: %q", prompt)
+	}
+	if !strings.Contains(prompt, "\n[1] cuesta 5\n") || !strings.Contains(prompt, "\n[2] (page 3) envío gratis\n") {
+		t.Errorf("sources missing: %q", prompt)
+	}
+}
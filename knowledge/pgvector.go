@@ -0,0 +1,64 @@
+package knowledge
+
+import (
+	"context"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"gorm.io/gorm"
+)
+
+// pgvectorStore copies the embeddings to a pgvector column so Postgres does
+// the ranking. The vectors are deleted along with their chunks.
+type pgvectorStore struct{}
+
+func newPgvectorStore(conn *gorm.DB) (*pgvectorStore, error) {
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS vector",
+		`CREATE TABLE IF NOT EXISTS knowledge_vectors (
+			chunk_id bigint PRIMARY KEY REFERENCES knowledge_chunks (id) ON DELETE CASCADE,
+			mmlu_id bigint NOT NULL,
+			embedding vector NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS idx_knowledge_vectors_mmlu_id ON knowledge_vectors (mmlu_id)",
+		// Chunks saved while the store ranked in process.
+		`INSERT INTO knowledge_vectors (chunk_id, mmlu_id, embedding)
+			SELECT id, mmlu_id, embedding::text::vector FROM knowledge_chunks
+			WHERE id NOT IN (SELECT chunk_id FROM knowledge_vectors)`,
+	}
+	for _, statement := range statements {
+		if err := conn.Exec(statement).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &pgvectorStore{}, nil
+}
+
+func (s *pgvectorStore) Index(tx *gorm.DB, chunks []*models.KnowledgeChunk) error {
+	for _, chunk := range chunks {
+		err := tx.Exec(
+			"INSERT INTO knowledge_vectors (chunk_id, mmlu_id, embedding) VALUES (?, ?, ?::vector)",
+			chunk.ID, chunk.MmluId, chunk.Embedding,
+		).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *pgvectorStore) Search(ctx context.Context, mmluID uint, sources []Source, model string, query []float64, k int) ([]*Match, error) {
+	matches := make([]*Match, 0)
+	vector := models.Vector(query)
+	tx := db.DefaultClient.WithContext(ctx).Raw(`
+		SELECT c.id AS chunk_id, c.message_id, c.position, c.page, c.content,
+			1 - (v.embedding <=> ?::vector) AS score
+		FROM knowledge_vectors v
+		JOIN knowledge_chunks c ON c.id = v.chunk_id
+		WHERE v.mmlu_id = ? AND c.model = ? AND (c.message_id, c.content_hash) IN ?
+		ORDER BY v.embedding <=> ?::vector
+		LIMIT ?`,
+		vector, mmluID, model, sourceKeys(sources), vector, k,
+	).Scan(&matches)
+	return matches, tx.Error
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juliotorresmoreno/tana-api/logger"
+)
+
+var log = logger.SetupLogger()
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(message *Message) error
+}
+
+var DefaultMailer Mailer = &LogMailer{}
+
+// Setup picks the mailer from MAILER: "smtp" for production, "file" to
+// append messages to MAILER_FILE, or "log" (the default) to only log them.
+func Setup() {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		DefaultMailer = &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+	case "file":
+		DefaultMailer = &FileMailer{Path: os.Getenv("MAILER_FILE")}
+	default:
+		DefaultMailer = &LogMailer{}
+	}
+}
+
+func Send(message *Message) error {
+	return DefaultMailer.Send(message)
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(message *Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	body := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + message.To,
+		"Subject: " + message.Subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"",
+		message.Body,
+	}, "\r\n")
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{message.To}, []byte(body))
+}
+
+type FileMailer struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+func (m *FileMailer) Send(message *Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), message.To, message.Subject, message.Body)
+	return err
+}
+
+type LogMailer struct{}
+
+func (m *LogMailer) Send(message *Message) error {
+	log.WithField("to", message.To).
+		WithField("subject", message.Subject).
+		Info(message.Body)
+	return nil
+}
@@ -8,10 +8,18 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/docextract"
+	"github.com/juliotorresmoreno/tana-api/knowledge"
 	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/mailer"
 	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"github.com/juliotorresmoreno/tana-api/queue"
 	"github.com/juliotorresmoreno/tana-api/server"
+	"github.com/juliotorresmoreno/tana-api/server/uploads"
+	"github.com/juliotorresmoreno/tana-api/server/users"
 	"github.com/juliotorresmoreno/tana-api/subscriptions"
+	"github.com/juliotorresmoreno/tana-api/utils"
 )
 
 func main() {
@@ -21,11 +29,29 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 	logger.SetupLogrus()
+	mailer.Setup()
+	providers.Setup()
+	docextract.Setup()
 	db.Setup()
+	knowledge.Setup()
+	if err := utils.MigrateCredentialSecrets(); err != nil {
+		log.Fatal("Error migrating credential secrets: ", err)
+	}
+	if err := utils.MigrateTOTPSecrets(); err != nil {
+		log.Fatal("Error migrating two factor secrets: ", err)
+	}
 	subscriptions.Setup()
+	if err := uploads.Setup(); err != nil {
+		log.Fatal("Error setting up uploads: ", err)
+	}
+	if err := users.Setup(); err != nil {
+		log.Fatal("Error setting up exports: ", err)
+	}
 
 	r := gin.Default()
 	r.Use(middlewares.AuthMiddleware())
 	server.SetupAPIRoutes(r.Group("api"))
+	// Workers start once the routes registered the job handlers.
+	queue.Setup()
 	r.Run(os.Getenv("ADDR"))
 }
@@ -1,9 +1,140 @@
 package middlewares
 
-import "github.com/gin-gonic/gin"
+import (
+	"os"
 
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+type Policy int
+
+const (
+	PolicyPublic Policy = iota
+	PolicyAuthenticated
+	PolicyAdmin
+)
+
+const (
+	UserKey      = "user"
+	authErrorKey = "auth-error"
+)
+
+// AuthMiddleware resolves the session or api credential attached to the
+// request, if any, and stores its user in the gin context. It never aborts
+// the request; route groups decide what to do with anonymous requests
+// through Authorize.
 func AuthMiddleware() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
+	return func(c *gin.Context) {
+		validate := utils.ValidateSession
+		if utils.HasCredential(c) {
+			validate = utils.ValidateCredential
+		} else if _, err := utils.GetToken(c); err != nil {
+			c.Next()
+			return
+		}
+
+		user, err := validate(c)
+		if err != nil {
+			c.Set(authErrorKey, err)
+			c.Next()
+			return
+		}
+
+		c.Set(UserKey, user)
+		c.Next()
+	}
+}
+
+// Authorize rejects requests that don't satisfy the given policy. PolicyAdmin
+// also rejects API credentials.
+func Authorize(policy Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if policy == PolicyPublic {
+			c.Next()
+			return
+		}
+
+		user := GetUser(c)
+		if user == nil {
+			err, ok := c.Get(authErrorKey)
+			if !ok || (err != utils.StatusInternalServerError && err != utils.StatusRequestEntityTooLarge) {
+				err = utils.StatusUnauthorized
+			}
+			utils.Response(c, err)
+			c.Abort()
+			return
+		}
+
+		// Admin endpoints take sessions only, whatever the scopes of a
+		// credential are.
+		if policy == PolicyAdmin && (user.Scopes != nil || !Allowed(user, AdminPermission)) {
+			Forbidden(c, AdminPermission)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// GetUser returns the user resolved by AuthMiddleware, or nil for anonymous
+// requests.
+func GetUser(c *gin.Context) *utils.User {
+	value, ok := c.Get(UserKey)
+	if !ok {
+		return nil
+	}
+	user, _ := value.(*utils.User)
+	return user
+}
+
+// RequireVerified rejects users that haven't verified their email when
+// REQUIRE_VERIFIED_EMAIL is "true".
+func RequireVerified() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := GetUser(c)
+		if os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true" && user != nil && !user.Verified {
+			utils.Response(c, utils.StatusEmailNotVerified)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSession rejects API credentials, whatever their scopes, on the
+// endpoints that manage how the account signs in.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if user := GetUser(c); user != nil && user.Scopes != nil {
+			utils.Response(c, utils.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Scope requires credential users to hold the read scope of resource for
+// GET requests and its write scope for everything else.
+func Scope(resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requireScope(c, resource+":"+methodAction(c.Request.Method))
+	}
+}
+
+// RequireScope requires credential users to hold scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requireScope(c, scope)
+	}
+}
 
+func requireScope(c *gin.Context, scope string) {
+	user := GetUser(c)
+	if user != nil && !user.HasScope(scope) {
+		Forbidden(c, scope)
+		return
 	}
+	c.Next()
 }
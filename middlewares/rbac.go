@@ -0,0 +1,202 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleViewer = "viewer"
+
+	// DefaultRole applies to users without a role, like the ones created
+	// before roles existed.
+	DefaultRole = RoleMember
+
+	// AdminPermission guards the endpoints behind PolicyAdmin.
+	AdminPermission = "admin:access"
+)
+
+var Roles = []string{RoleAdmin, RoleMember, RoleViewer}
+
+const (
+	WorkspaceRoleOwner  = "owner"
+	WorkspaceRoleAdmin  = "admin"
+	WorkspaceRoleMember = "member"
+	WorkspaceRoleViewer = "viewer"
+)
+
+// workspaceRoles maps each workspace role to the user role whose resource
+// permissions it has inside the workspace. Owners and admins can also manage
+// the workspace itself, see CanManageWorkspace.
+var workspaceRoles = map[string]string{
+	WorkspaceRoleOwner:  RoleMember,
+	WorkspaceRoleAdmin:  RoleMember,
+	WorkspaceRoleMember: RoleMember,
+	WorkspaceRoleViewer: RoleViewer,
+}
+
+// ValidWorkspaceRole reports whether role can be given to a workspace member
+// or invitation. There is only one owner per workspace.
+func ValidWorkspaceRole(role string) bool {
+	_, ok := workspaceRoles[role]
+	return ok && role != WorkspaceRoleOwner
+}
+
+// CanManageWorkspace reports whether the workspace role may manage members,
+// invitations and settings.
+func CanManageWorkspace(role string) bool {
+	return role == WorkspaceRoleOwner || role == WorkspaceRoleAdmin
+}
+
+// Permissions lists every resource:action pair. Roles grant them through
+// rolePermissions and API credentials are scoped to them, so a scope and the
+// permission it maps to always have the same name.
+var Permissions = []string{
+	"mmlu:read",
+	"mmlu:write",
+	"message:read",
+	"message:write",
+	"connection:read",
+	"connection:write",
+	"credential:read",
+	"credential:write",
+	"conversation:read",
+	"conversation:write",
+	"upload:read",
+	"upload:write",
+	"event:read",
+	"event:publish",
+	"user:read",
+	"user:write",
+	"workspace:read",
+	"workspace:write",
+	"audit:read",
+	"job:read",
+}
+
+// rolePermissions is the permission matrix, as entries of Permissions. A
+// resource:* entry grants every action on the resource and * grants
+// everything.
+var rolePermissions = map[string][]string{
+	RoleAdmin: {"*"},
+	RoleMember: {
+		"mmlu:*",
+		"message:*",
+		"connection:*",
+		"credential:*",
+		"conversation:*",
+		"upload:*",
+		"event:read",
+		"event:publish",
+	},
+	RoleViewer: {
+		"mmlu:read",
+		"message:read",
+		"connection:read",
+		"credential:read",
+		"conversation:read",
+		"upload:read",
+		"event:read",
+	},
+}
+
+// ValidScope reports whether scope can be granted to a credential: one of
+// Permissions, a resource:* entry of one of their resources or *.
+func ValidScope(scope string) bool {
+	if scope == "*" {
+		return true
+	}
+	for _, permission := range Permissions {
+		resource, _ := splitPermission(permission)
+		if scope == permission || scope == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can reports whether role grants permission.
+func Can(role, permission string) bool {
+	if role == "" {
+		role = DefaultRole
+	}
+
+	resource, _ := splitPermission(permission)
+	for _, granted := range rolePermissions[role] {
+		if granted == "*" || granted == permission || granted == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the role of the user grants permission. Inside a
+// workspace the workspace role must grant it too, except for AdminPermission.
+func Allowed(user *utils.User, permission string) bool {
+	if user == nil || !Can(user.Rol, permission) {
+		return false
+	}
+	if user.WorkspaceID == 0 || permission == AdminPermission {
+		return true
+	}
+	role, ok := workspaceRoles[user.WorkspaceRole]
+	return ok && Can(role, permission)
+}
+
+// Permission requires the read permission of resource for GET requests and
+// its write permission for everything else. Credential users must also hold
+// the scope of the same name.
+func Permission(resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requirePermission(c, resource+":"+methodAction(c.Request.Method))
+	}
+}
+
+// RequirePermission requires a specific permission, and the scope of the
+// same name from credential users.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requirePermission(c, permission)
+	}
+}
+
+func requirePermission(c *gin.Context, permission string) {
+	user := GetUser(c)
+	if !Allowed(user, permission) || !user.HasScope(permission) {
+		Forbidden(c, permission)
+		return
+	}
+	c.Next()
+}
+
+// Forbidden aborts the request with the same body for every authorization
+// failure.
+func Forbidden(c *gin.Context, permission string) {
+	utils.Response(c, utils.NewForbidden(permission))
+	c.Abort()
+}
+
+func methodAction(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return "read"
+	}
+	return "write"
+}
+
+func splitPermission(permission string) (string, string) {
+	for i := 0; i < len(permission); i++ {
+		if permission[i] == ':' {
+			return permission[:i], permission[i+1:]
+		}
+	}
+	return permission, ""
+}
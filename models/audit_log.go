@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditLog is append only, updates and deletes are discarded by the rules
+// created in db.Setup.
+type AuditLog struct {
+	ID             uint  `gorm:"primaryKey"`
+	ActorId        *uint `gorm:"index"`
+	ImpersonatorId *uint
+	WorkspaceId    *uint     `gorm:"index"`
+	Action         string    `gorm:"type:varchar(50);not null;index"`
+	TargetType     string    `gorm:"type:varchar(50);default:''"`
+	TargetId       uint      `gorm:"default:0"`
+	IP             string    `gorm:"type:varchar(64);default:''"`
+	UserAgent      string    `gorm:"type:varchar(1000);default:''"`
+	Changes        string    `gorm:"type:jsonb;default:'{}'"`
+	CreationAt     time.Time `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP;index"`
+}
+
+func (a AuditLog) TableName() string {
+	return "audit_logs"
+}
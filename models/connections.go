@@ -13,8 +13,11 @@ type Connection struct {
 	PhotoURL    string         `gorm:"type:varchar(1000);default:''"`
 	OwnerId     uint           `gorm:"not null"`
 	Owner       User           `gorm:"foreignKey:OwnerId"`
+	WorkspaceId *uint          `gorm:"index"`
+	Workspace   *Workspace     `gorm:"foreignKey:WorkspaceId"`
 	MmluId      uint           `gorm:"not null"`
 	Mmlu        Mmlu           `gorm:"foreignKey:MmluId"`
+	MmluVersion *int           // pinned MmluVersion, nil follows the latest
 	CreationAt  time.Time      `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
 	UpdatedAt   time.Time      `gorm:"type:timestamptz"`
 	DeletedAt   gorm.DeletedAt `gorm:"type:timestamptz"`
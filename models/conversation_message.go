@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// ConversationMessage is a turn of the conversation of a user with a
+// connection. Attachments are kept as system messages.
+type ConversationMessage struct {
+	ID           uint       `gorm:"primaryKey"`
+	UserId       uint       `gorm:"not null;index:idx_conversation_messages_conversation"`
+	User         User       `gorm:"foreignKey:UserId"`
+	ConnectionId uint       `gorm:"not null;index:idx_conversation_messages_conversation"`
+	Connection   Connection `gorm:"foreignKey:ConnectionId"`
+	Role         string     `gorm:"type:varchar(15);not null"`
+	Content      string     `gorm:"type:text;default:''"`
+	CreationAt   time.Time  `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+}
+
+func (m ConversationMessage) TableName() string {
+	return "conversation_messages"
+}
@@ -7,17 +7,35 @@ import (
 )
 
 type Credential struct {
-	ID         uint           `gorm:"primaryKey"`
-	ApiKey     string         `gorm:"type:varchar(100);default:'';nullable"`
-	ApiSecret  string         `gorm:"type:varchar(100);default:'';nullable"`
-	OwnerId    uint           `gorm:"not null"`
-	Owner      User           `gorm:"foreignKey:OwnerId"`
-	LastUsed   *time.Time     `gorm:"type:timestamptz"`
-	CreationAt time.Time      `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
-	UpdatedAt  time.Time      `gorm:"type:timestamptz"`
-	DeletedAt  gorm.DeletedAt `gorm:"type:timestamptz"`
+	ID                 uint           `gorm:"primaryKey"`
+	ApiKey             string         `gorm:"type:varchar(100);default:'';nullable"`
+	ApiSecret          string         `gorm:"type:varchar(100);default:'';nullable"` // legacy plaintext secret
+	SecretHash         string         `gorm:"type:varchar(200);default:'';nullable"`
+	SecretPrefix       string         `gorm:"type:varchar(10);default:'';nullable"`
+	SigningKey         string         `gorm:"type:varchar(200);default:'';nullable"` // encrypted with CREDENTIAL_ENCRYPTION_KEY
+	Scopes             StringList     `gorm:"type:varchar(1000);default:'*'"`
+	AllowedIPs         StringList     `gorm:"type:varchar(1000);default:''"`
+	ExpiresAt          *time.Time     `gorm:"type:timestamptz"`
+	PreviousSecretHash string         `gorm:"type:varchar(200);default:'';nullable"`
+	PreviousSigningKey string         `gorm:"type:varchar(200);default:'';nullable"`
+	PreviousExpiresAt  *time.Time     `gorm:"type:timestamptz"`
+	OwnerId            uint           `gorm:"not null"`
+	Owner              User           `gorm:"foreignKey:OwnerId"`
+	WorkspaceId        *uint          `gorm:"index"`
+	Workspace          *Workspace     `gorm:"foreignKey:WorkspaceId"`
+	LastUsed           *time.Time     `gorm:"type:timestamptz"`
+	CreationAt         time.Time      `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+	UpdatedAt          time.Time      `gorm:"type:timestamptz"`
+	DeletedAt          gorm.DeletedAt `gorm:"type:timestamptz"`
 }
 
 func (u Credential) TableName() string {
 	return "credentials"
 }
+
+// Previous secrets stay valid until PreviousExpiresAt after a rotation.
+func (u Credential) PreviousValid() bool {
+	return u.PreviousSecretHash != "" &&
+		u.PreviousExpiresAt != nil &&
+		time.Now().Before(*u.PreviousExpiresAt)
+}
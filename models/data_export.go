@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	DataExportPending = "pending"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+)
+
+type DataExport struct {
+	ID          uint       `gorm:"primaryKey"`
+	UserId      uint       `gorm:"not null;index"`
+	User        User       `gorm:"foreignKey:UserId"`
+	Status      string     `gorm:"type:varchar(20);default:'pending'"`
+	FileName    string     `gorm:"type:varchar(255);default:''"`
+	Size        int64      `gorm:"default:0"`
+	Error       string     `gorm:"type:varchar(500);default:''"`
+	ExpiresAt   *time.Time `gorm:"type:timestamptz"`
+	CompletedAt *time.Time `gorm:"type:timestamptz"`
+	CreationAt  time.Time  `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+}
+
+func (d DataExport) TableName() string {
+	return "data_exports"
+}
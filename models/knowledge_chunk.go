@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// KnowledgeChunk is a piece of a message of an mmlu along with its
+// embedding, so generations only get the pieces relevant to the prompt.
+// ContentHash tells the contents the message had apart, so versions of the
+// mmlu find the chunks of their own content.
+type KnowledgeChunk struct {
+	ID          uint      `gorm:"primaryKey;autoIncrement"`
+	MmluId      uint      `gorm:"not null;index"`
+	Mmlu        Mmlu      `gorm:"foreignKey:MmluId;constraint:OnDelete:CASCADE"`
+	MessageId   uint      `gorm:"not null;index"`
+	Message     Message   `gorm:"foreignKey:MessageId;constraint:OnDelete:CASCADE"`
+	ContentHash string    `gorm:"type:varchar(64);not null;default:'';index"`
+	Position    int       `gorm:"not null"`
+	Page        int       `gorm:"default:0"` // zero when the message has no pages
+	Content     string    `gorm:"type:text;not null"`
+	Model       string    `gorm:"type:varchar(100);not null"`
+	Embedding   Vector    `gorm:"type:jsonb;not null"`
+	CreationAt  time.Time `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+}
+
+func (k KnowledgeChunk) TableName() string {
+	return "knowledge_chunks"
+}
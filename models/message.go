@@ -6,17 +6,25 @@ import (
 	"gorm.io/gorm"
 )
 
+// SearchLanguages are the text search configurations messages are indexed
+// with, each word is stemmed for every one of them. The search_vector column
+// is created with them, changing them means rebuilding it.
+var SearchLanguages = []string{"spanish", "english"}
+
 type Message struct {
-	ID         uint           `gorm:"primaryKey"`
-	Content    string         `gorm:"type:text;default:'';nullable"`
-	OwnerId    uint           `gorm:"not null"`
-	Owner      User           `gorm:"foreignKey:OwnerId"`
-	MmluId     uint           `gorm:"not null"`
-	Mmlu       Mmlu           `gorm:"foreignKey:MmluId"`
-	Role       string         `gorm:"type:varchar(255);default:'';not null"`
-	CreationAt time.Time      `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
-	UpdatedAt  time.Time      `gorm:"type:timestamptz"`
-	DeletedAt  gorm.DeletedAt `gorm:"type:timestamptz"`
+	ID          uint           `gorm:"primaryKey"`
+	Content     string         `gorm:"type:text;default:'';nullable"`
+	OwnerId     uint           `gorm:"not null"`
+	Owner       User           `gorm:"foreignKey:OwnerId"`
+	WorkspaceId *uint          `gorm:"index"`
+	Workspace   *Workspace     `gorm:"foreignKey:WorkspaceId"`
+	MmluId      uint           `gorm:"not null"`
+	Mmlu        Mmlu           `gorm:"foreignKey:MmluId"`
+	Role        string         `gorm:"type:varchar(255);default:'';not null"`
+	Pages       JSON           `gorm:"type:jsonb"` // where each page starts in Content, for attachments
+	CreationAt  time.Time      `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time      `gorm:"type:timestamptz"`
+	DeletedAt   gorm.DeletedAt `gorm:"type:timestamptz"`
 }
 
 func (u Message) TableName() string {
@@ -15,15 +15,36 @@ type Mmlu struct {
 	Provider    string          `gorm:"type:varchar(256);default:'';check:provider IN ('ollama', 'openai')"`
 	OwnerId     uint            `gorm:"not null"`
 	Owner       User            `gorm:"foreignKey:OwnerId"`
+	WorkspaceId *uint           `gorm:"index"`
+	Workspace   *Workspace      `gorm:"foreignKey:WorkspaceId"`
 	CreationAt  time.Time       `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
 	UpdatedAt   time.Time       `gorm:"type:timestamptz"`
 	DeletedAt   *gorm.DeletedAt `gorm:"type:timestamptz"`
+
+	// Generation settings, sent with every generation of the connections
+	// using the mmlu. Nil and zero values leave the choice to the model.
+	SystemPrompt   string   `gorm:"type:text;default:''"`
+	Temperature    *float64 `gorm:"type:numeric(3,2)"`
+	TopP           *float64 `gorm:"type:numeric(3,2)"`
+	MaxTokens      int      `gorm:"default:0"`
+	Stop           JSONList `gorm:"type:jsonb;default:'[]'"`
+	ContextWindow  int      `gorm:"default:0"`
+	ResponseFormat string   `gorm:"type:varchar(20);default:'text';check:response_format IN ('text', 'json_schema')"`
+	ResponseSchema JSON     `gorm:"type:jsonb"`
+
+	// Version is the latest MmluVersion, zero until the first one is taken.
+	Version int `gorm:"default:0"`
 }
 
 func (Mmlu) ProviderCheck() string {
 	return "provider IN ('ollama', 'openai')"
 }
 
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
 func (m Mmlu) TableName() string {
 	return "mmlus"
 }
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// MmluVersion is an immutable snapshot of the settings and knowledge messages
+// of an mmlu, taken on every change.
+type MmluVersion struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement"`
+	MmluId     uint      `gorm:"not null;uniqueIndex:idx_mmlu_versions_version"`
+	Mmlu       Mmlu      `gorm:"foreignKey:MmluId"`
+	Version    int       `gorm:"not null;uniqueIndex:idx_mmlu_versions_version"`
+	Change     string    `gorm:"type:varchar(50);default:''"`
+	Settings   JSON      `gorm:"type:jsonb;not null"`
+	Messages   JSON      `gorm:"type:jsonb;not null"`
+	AuthorId   *uint     `gorm:"index"`
+	Author     *User     `gorm:"foreignKey:AuthorId;constraint:OnDelete:SET NULL"`
+	CreationAt time.Time `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+}
+
+func (v MmluVersion) TableName() string {
+	return "mmlu_versions"
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+type RecoveryCode struct {
+	ID         uint       `gorm:"primaryKey"`
+	UserId     uint       `gorm:"not null;index"`
+	User       User       `gorm:"foreignKey:UserId"`
+	CodeHash   string     `gorm:"type:varchar(200);not null"`
+	UsedAt     *time.Time `gorm:"type:timestamptz"`
+	CreationAt time.Time  `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+}
+
+func (u RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+)
+
+type SignInAttempt struct {
+	ID         uint      `gorm:"primaryKey"`
+	UserId     *uint     `gorm:"index"`
+	Email      string    `gorm:"type:varchar(300);default:'';index"`
+	IP         string    `gorm:"type:varchar(64);default:''"`
+	UserAgent  string    `gorm:"type:varchar(1000);default:''"`
+	Success    bool      `gorm:"default:false"`
+	Reason     string    `gorm:"type:varchar(100);default:''"`
+	CreationAt time.Time `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+}
+
+func (u SignInAttempt) TableName() string {
+	return "sign_in_attempts"
+}
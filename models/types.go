@@ -0,0 +1,132 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// StringList is stored as a comma separated varchar column.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		s = ""
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return errors.New("unsupported type for StringList")
+	}
+
+	*l = StringList{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l StringList) Contains(value string) bool {
+	for _, item := range l {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONList is stored as a jsonb array, for values that may contain commas.
+type JSONList []string
+
+func (l JSONList) Value() (driver.Value, error) {
+	if l == nil {
+		l = JSONList{}
+	}
+	data, err := json.Marshal([]string(l))
+	return string(data), err
+}
+
+func (l *JSONList) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*l = JSONList{}
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return errors.New("unsupported type for JSONList")
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// JSON is a raw JSON document stored as jsonb, NULL when empty.
+type JSON json.RawMessage
+
+func (j JSON) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+func (j *JSON) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*j = nil
+	case string:
+		*j = JSON(v)
+	case []byte:
+		*j = append(JSON{}, v...)
+	default:
+		return errors.New("unsupported type for JSON")
+	}
+	return nil
+}
+
+func (j JSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+func (j *JSON) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*j = nil
+		return nil
+	}
+	*j = append(JSON{}, data...)
+	return nil
+}
+
+// Vector is an embedding, stored as a jsonb array. Its text form is also the
+// input format of pgvector.
+type Vector []float64
+
+func (v Vector) Value() (driver.Value, error) {
+	data, err := json.Marshal([]float64(v))
+	return string(data), err
+}
+
+func (v *Vector) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(data), (*[]float64)(v))
+	case []byte:
+		return json.Unmarshal(data, (*[]float64)(v))
+	}
+	return errors.New("unsupported type for Vector")
+}
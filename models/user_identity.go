@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+type UserIdentity struct {
+	ID             uint       `gorm:"primaryKey"`
+	UserId         uint       `gorm:"not null;index"`
+	User           User       `gorm:"foreignKey:UserId"`
+	Provider       string     `gorm:"type:varchar(50);not null;uniqueIndex:idx_user_identities_provider_user"`
+	ProviderUserId string     `gorm:"type:varchar(255);not null;uniqueIndex:idx_user_identities_provider_user"`
+	Email          string     `gorm:"type:varchar(300);default:''"`
+	AccessToken    string     `gorm:"type:text;default:''"`
+	RefreshToken   string     `gorm:"type:text;default:''"`
+	ExpiresAt      *time.Time `gorm:"type:timestamptz"`
+	CreationAt     time.Time  `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+	UpdatedAt      time.Time  `gorm:"type:timestamptz"`
+}
+
+func (u UserIdentity) TableName() string {
+	return "user_identities"
+}
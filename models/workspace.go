@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Workspace struct {
+	ID         uint           `gorm:"primaryKey;autoIncrement"`
+	Name       string         `gorm:"type:varchar(100);default:''"`
+	OwnerId    uint           `gorm:"not null"`
+	Owner      User           `gorm:"foreignKey:OwnerId"`
+	CreationAt time.Time      `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time      `gorm:"type:timestamptz"`
+	DeletedAt  gorm.DeletedAt `gorm:"type:timestamptz"`
+}
+
+func (w Workspace) TableName() string {
+	return "workspaces"
+}
+
+type WorkspaceMember struct {
+	ID          uint      `gorm:"primaryKey;autoIncrement"`
+	WorkspaceId uint      `gorm:"not null;uniqueIndex:idx_workspace_member"`
+	Workspace   Workspace `gorm:"foreignKey:WorkspaceId"`
+	UserId      uint      `gorm:"not null;uniqueIndex:idx_workspace_member;index"`
+	User        User      `gorm:"foreignKey:UserId"`
+	Role        string    `gorm:"type:varchar(15);default:'member'"`
+	CreationAt  time.Time `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time `gorm:"type:timestamptz"`
+}
+
+func (w WorkspaceMember) TableName() string {
+	return "workspace_members"
+}
+
+type WorkspaceInvitation struct {
+	ID          uint       `gorm:"primaryKey;autoIncrement"`
+	WorkspaceId uint       `gorm:"not null;index"`
+	Workspace   Workspace  `gorm:"foreignKey:WorkspaceId"`
+	Email       string     `gorm:"type:varchar(300);not null"`
+	Role        string     `gorm:"type:varchar(15);default:'member'"`
+	TokenHash   string     `gorm:"type:varchar(64);not null;uniqueIndex"`
+	InvitedById uint       `gorm:"not null"`
+	InvitedBy   User       `gorm:"foreignKey:InvitedById"`
+	ExpiresAt   time.Time  `gorm:"type:timestamptz"`
+	AcceptedAt  *time.Time `gorm:"type:timestamptz"`
+	CreationAt  time.Time  `gorm:"type:timestamptz;default:CURRENT_TIMESTAMP"`
+}
+
+func (w WorkspaceInvitation) TableName() string {
+	return "workspace_invitations"
+}
@@ -0,0 +1,163 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	catalogKey     = "model-catalog"
+	catalogLockKey = "model-catalog-lock"
+)
+
+// CatalogEntry is a model of the catalog. Available is false while its
+// provider can't be reached, in which case the entry is the last one seen.
+type CatalogEntry struct {
+	Code          string   `json:"code"`
+	Provider      string   `json:"provider"`
+	Family        string   `json:"family,omitempty"`
+	ContextLength int      `json:"context_length,omitempty"`
+	Modalities    []string `json:"modalities"`
+	Available     bool     `json:"available"`
+}
+
+type catalog struct {
+	RefreshedAt time.Time       `json:"refreshed_at"`
+	Models      []*CatalogEntry `json:"models"`
+}
+
+// catalogRefreshInterval is how long the catalog is served from Redis before
+// asking the providers again, from MODEL_CATALOG_REFRESH (default 5m).
+func catalogRefreshInterval() time.Duration {
+	return utils.DurationFromEnv("MODEL_CATALOG_REFRESH", 5*time.Minute)
+}
+
+// catalogRefreshTimeout bounds how long the providers are asked for their
+// models, from MODEL_CATALOG_TIMEOUT (default 10s). It is kept apart from
+// PROVIDER_TIMEOUT, which has to fit whole generations.
+func catalogRefreshTimeout() time.Duration {
+	return utils.DurationFromEnv("MODEL_CATALOG_TIMEOUT", 10*time.Second)
+}
+
+// Catalog returns the models of every configured provider. A stale catalog
+// is served while it is refreshed in the background, so requests never wait
+// on a slow provider. Without any catalog the first request waits for the
+// refresh, up to catalogRefreshTimeout, and the others get an empty one.
+func Catalog(ctx context.Context) ([]*CatalogEntry, error) {
+	cached, err := cachedCatalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && time.Since(cached.RefreshedAt) < catalogRefreshInterval() {
+		return cached.Models, nil
+	}
+
+	// Only one instance refreshes at a time.
+	timeout := catalogRefreshTimeout()
+	locked, err := db.DefaultCache.SetNX(ctx, catalogLockKey, 1, 2*timeout).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		if cached != nil {
+			return cached.Models, nil
+		}
+		return []*CatalogEntry{}, nil
+	}
+
+	if cached != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			defer db.DefaultCache.Del(context.Background(), catalogLockKey)
+			if _, err := refreshCatalog(ctx, cached); err != nil {
+				log.Error("Error refreshing the model catalog: ", err)
+			}
+		}()
+		return cached.Models, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer db.DefaultCache.Del(context.Background(), catalogLockKey)
+	return refreshCatalog(ctx, nil)
+}
+
+// refreshCatalog asks every provider for its models and caches the result.
+// Models of providers that fail are carried over from previous as
+// unavailable.
+func refreshCatalog(ctx context.Context, previous *catalog) ([]*CatalogEntry, error) {
+	fresh := &catalog{RefreshedAt: time.Now(), Models: make([]*CatalogEntry, 0)}
+	for _, provider := range All() {
+		models, err := provider.ListModels(ctx)
+		if err != nil {
+			log.Error("Error listing models of ", provider.Name(), ": ", err)
+			if previous != nil {
+				for _, entry := range previous.Models {
+					if entry.Provider == provider.Name() {
+						stale := *entry
+						stale.Available = false
+						fresh.Models = append(fresh.Models, &stale)
+					}
+				}
+			}
+			continue
+		}
+
+		for _, model := range models {
+			fresh.Models = append(fresh.Models, &CatalogEntry{
+				Code:          model.ID,
+				Provider:      model.Provider,
+				Family:        model.Family,
+				ContextLength: model.ContextLength,
+				Modalities:    model.Modalities,
+				Available:     true,
+			})
+		}
+	}
+
+	data, err := json.Marshal(fresh)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.DefaultCache.Set(ctx, catalogKey, data, 0).Err(); err != nil {
+		return nil, err
+	}
+	return fresh.Models, nil
+}
+
+func cachedCatalog(ctx context.Context) (*catalog, error) {
+	data, err := db.DefaultCache.Get(ctx, catalogKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cached := &catalog{}
+	if err := json.Unmarshal(data, cached); err != nil {
+		return nil, nil
+	}
+	return cached, nil
+}
+
+// FindModel returns the catalog entry of the model, or nil if the provider
+// doesn't have it or can't be reached.
+func FindModel(ctx context.Context, provider, code string) (*CatalogEntry, error) {
+	models, err := Catalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range models {
+		if entry.Provider == provider && entry.Code == code && entry.Available {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
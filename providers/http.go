@@ -0,0 +1,130 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+// Error is returned when a backend answers with an error status.
+type Error struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// newHTTPClient bounds every request to a provider, streams included, by
+// PROVIDER_TIMEOUT (default 5m) so a hung backend can't hold a request.
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: utils.DurationFromEnv("PROVIDER_TIMEOUT", 5*time.Minute)}
+}
+
+type client struct {
+	provider string
+	baseURL  string
+	headers  map[string]string
+	http     *http.Client
+}
+
+func (c *client) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.baseURL, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, c.readError(res)
+	}
+	return res, nil
+}
+
+// doJSON sends body and decodes the response into out.
+func (c *client) doJSON(ctx context.Context, method, path string, body, out interface{}) error {
+	res, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// streamLines calls onLine for every non empty line of the response, as used by
+// both newline delimited JSON and server sent events.
+func (c *client) streamLines(ctx context.Context, path string, body interface{}, onLine func(string) error) error {
+	res, err := c.do(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := onLine(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readError reads the message of an error response, in either the Ollama
+// {"error": "..."} or the OpenAI {"error": {"message": "..."}} shape.
+func (c *client) readError(res *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	message := strings.TrimSpace(string(data))
+
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && len(body.Error) > 0 {
+		var text string
+		var object struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body.Error, &text) == nil {
+			message = text
+		} else if json.Unmarshal(body.Error, &object) == nil && object.Message != "" {
+			message = object.Message
+		}
+	}
+	if message == "" {
+		message = http.StatusText(res.StatusCode)
+	}
+	return &Error{Provider: c.provider, StatusCode: res.StatusCode, Message: message}
+}
@@ -0,0 +1,175 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Ollama talks to the native Ollama API.
+type Ollama struct {
+	client
+}
+
+func NewOllama(baseURL string) *Ollama {
+	return &Ollama{client{
+		provider: "ollama",
+		baseURL:  baseURL,
+		http:     newHTTPClient(),
+	}}
+}
+
+func (o *Ollama) Name() string {
+	return "ollama"
+}
+
+type ollamaChatRequest struct {
+	Model    string                 `json:"model"`
+	Messages []Message              `json:"messages"`
+	Stream   bool                   `json:"stream"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+	Format   json.RawMessage        `json:"format,omitempty"`
+}
+
+type ollamaChatResponse struct {
+	Message         Message `json:"message"`
+	Done            bool    `json:"done"`
+	DoneReason      string  `json:"done_reason"`
+	PromptEvalCount int     `json:"prompt_eval_count"`
+	EvalCount       int     `json:"eval_count"`
+}
+
+func (r *ollamaChatResponse) usage() Usage {
+	return Usage{PromptTokens: r.PromptEvalCount, CompletionTokens: r.EvalCount}
+}
+
+func (o *Ollama) chatRequest(request *ChatRequest, stream bool) *ollamaChatRequest {
+	options := map[string]interface{}{}
+	if request.Options.Temperature != nil {
+		options["temperature"] = *request.Options.Temperature
+	}
+	if request.Options.TopP != nil {
+		options["top_p"] = *request.Options.TopP
+	}
+	if request.Options.MaxTokens > 0 {
+		options["num_predict"] = request.Options.MaxTokens
+	}
+	if len(request.Options.Stop) > 0 {
+		options["stop"] = request.Options.Stop
+	}
+	if request.Options.ContextWindow > 0 {
+		options["num_ctx"] = request.Options.ContextWindow
+	}
+	return &ollamaChatRequest{
+		Model:    request.Model,
+		Messages: request.Messages,
+		Stream:   stream,
+		Options:  options,
+		Format:   request.Options.Schema,
+	}
+}
+
+func (o *Ollama) Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error) {
+	response := &ollamaChatResponse{}
+	err := o.doJSON(ctx, http.MethodPost, "/api/chat", o.chatRequest(request, false), response)
+	if err != nil {
+		return nil, err
+	}
+	return &ChatResponse{
+		Message:      response.Message,
+		FinishReason: response.DoneReason,
+		Usage:        response.usage(),
+	}, nil
+}
+
+func (o *Ollama) ChatStream(ctx context.Context, request *ChatRequest, onChunk func(*ChatChunk) error) error {
+	return o.streamLines(ctx, "/api/chat", o.chatRequest(request, true), func(line string) error {
+		response := &ollamaChatResponse{}
+		if err := json.Unmarshal([]byte(line), response); err != nil {
+			return err
+		}
+		chunk := &ChatChunk{Content: response.Message.Content, Done: response.Done}
+		if response.Done {
+			usage := response.usage()
+			chunk.FinishReason = response.DoneReason
+			chunk.Usage = &usage
+		}
+		return onChunk(chunk)
+	})
+}
+
+func (o *Ollama) Embed(ctx context.Context, model string, input []string) ([][]float64, error) {
+	response := &struct {
+		Embeddings [][]float64 `json:"embeddings"`
+	}{}
+	err := o.doJSON(ctx, http.MethodPost, "/api/embed", map[string]interface{}{
+		"model": model,
+		"input": input,
+	}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Embeddings, nil
+}
+
+func (o *Ollama) ListModels(ctx context.Context) ([]Model, error) {
+	response := &struct {
+		Models []struct {
+			Name    string `json:"name"`
+			Size    int64  `json:"size"`
+			Details struct {
+				Family string `json:"family"`
+			} `json:"details"`
+		} `json:"models"`
+	}{}
+	if err := o.doJSON(ctx, http.MethodGet, "/api/tags", nil, response); err != nil {
+		return nil, err
+	}
+
+	models := make([]Model, 0, len(response.Models))
+	for _, model := range response.Models {
+		entry := Model{
+			ID:         model.Name,
+			Provider:   o.Name(),
+			Family:     model.Details.Family,
+			Size:       model.Size,
+			Modalities: []string{"text"},
+		}
+		if err := o.show(ctx, &entry); err != nil {
+			log.Warn("Error getting details of ", model.Name, ": ", err)
+		}
+		models = append(models, entry)
+	}
+	return models, nil
+}
+
+// show completes the model with the context length and capabilities reported
+// by /api/show.
+func (o *Ollama) show(ctx context.Context, model *Model) error {
+	response := &struct {
+		ModelInfo    map[string]interface{} `json:"model_info"`
+		Capabilities []string               `json:"capabilities"`
+	}{}
+	err := o.doJSON(ctx, http.MethodPost, "/api/show", map[string]string{"model": model.ID}, response)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range response.ModelInfo {
+		if strings.HasSuffix(key, ".context_length") {
+			if length, ok := value.(float64); ok {
+				model.ContextLength = int(length)
+			}
+		}
+	}
+	for _, capability := range response.Capabilities {
+		switch capability {
+		case "vision":
+			model.Modalities = append(model.Modalities, "image")
+		case "embedding":
+			model.Modalities = []string{"embedding"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newOllamaServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body map[string]interface{})) *Ollama {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("decoding request: %v", err)
+			}
+		}
+		handler(w, r, body)
+	}))
+	t.Cleanup(server.Close)
+	return NewOllama(server.URL)
+}
+
+func TestOllamaChat(t *testing.T) {
+	temperature := 0.2
+	ollama := newOllamaServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		if r.URL.Path != "/api/chat" {
+			t.Errorf("path = %v, want /api/chat", r.URL.Path)
+		}
+		if body["model"] != "llama3" || body["stream"] != false {
+			t.Errorf("unexpected body %v", body)
+		}
+		options, _ := body["options"].(map[string]interface{})
+		if options["temperature"] != 0.2 || options["num_predict"] != float64(64) || options["num_ctx"] != float64(4096) {
+			t.Errorf("unexpected options %v", options)
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"Hola"},"done":true,"done_reason":"stop","prompt_eval_count":7,"eval_count":2}`))
+	})
+
+	response, err := ollama.Chat(context.Background(), &ChatRequest{
+		Model:    "llama3",
+		Messages: []Message{{Role: RoleUser, Content: "Hi"}},
+		Options:  Options{Temperature: &temperature, MaxTokens: 64, ContextWindow: 4096},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Message.Content != "Hola" || response.FinishReason != "stop" {
+		t.Errorf("unexpected response %+v", response)
+	}
+	if response.Usage != (Usage{PromptTokens: 7, CompletionTokens: 2}) {
+		t.Errorf("usage = %+v", response.Usage)
+	}
+}
+
+func TestOllamaChatStream(t *testing.T) {
+	ollama := newOllamaServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		if body["stream"] != true {
+			t.Errorf("stream = %v, want true", body["stream"])
+		}
+		w.Write([]byte(
+			`{"message":{"role":"assistant","content":"Ho"},"done":false}` + "\n" +
+				`{"message":{"role":"assistant","content":"la"},"done":false}` + "\n\n" +
+				`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":2}` + "\n",
+		))
+	})
+
+	chunks := make([]*ChatChunk, 0)
+	err := ollama.ChatStream(context.Background(), &ChatRequest{Model: "llama3"}, func(chunk *ChatChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 || chunks[0].Content+chunks[1].Content != "Hola" {
+		t.Fatalf("unexpected chunks %+v", chunks)
+	}
+	last := chunks[2]
+	if !last.Done || last.FinishReason != "stop" || last.Usage == nil || last.Usage.CompletionTokens != 2 {
+		t.Errorf("unexpected last chunk %+v", last)
+	}
+}
+
+func TestOllamaEmbed(t *testing.T) {
+	ollama := newOllamaServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		if r.URL.Path != "/api/embed" || body["model"] != "nomic-embed-text" {
+			t.Errorf("unexpected request %v %v", r.URL.Path, body)
+		}
+		w.Write([]byte(`{"embeddings":[[0.1,0.2],[0.3,0.4]]}`))
+	})
+
+	embeddings, err := ollama.Embed(context.Background(), "nomic-embed-text", []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embeddings) != 2 || embeddings[1][1] != 0.4 {
+		t.Errorf("unexpected embeddings %v", embeddings)
+	}
+}
+
+func TestOllamaListModels(t *testing.T) {
+	ollama := newOllamaServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models":[{"name":"llava","size":42,"details":{"family":"llama"}}]}`))
+		case "/api/show":
+			if body["model"] != "llava" {
+				t.Errorf("show model = %v", body["model"])
+			}
+			w.Write([]byte(`{"model_info":{"llama.context_length":8192},"capabilities":["completion","vision"]}`))
+		default:
+			t.Errorf("unexpected path %v", r.URL.Path)
+		}
+	})
+
+	models, err := ollama.ListModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 1 {
+		t.Fatalf("models = %+v", models)
+	}
+	model := models[0]
+	if model.ID != "llava" || model.Provider != "ollama" || model.Family != "llama" || model.Size != 42 {
+		t.Errorf("unexpected model %+v", model)
+	}
+	if model.ContextLength != 8192 || len(model.Modalities) != 2 || model.Modalities[1] != "image" {
+		t.Errorf("unexpected details %+v", model)
+	}
+}
+
+func TestOllamaError(t *testing.T) {
+	ollama := newOllamaServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"model 'missing' not found"}`))
+	})
+
+	_, err := ollama.Chat(context.Background(), &ChatRequest{Model: "missing"})
+	providerErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if providerErr.StatusCode != http.StatusNotFound || providerErr.Message != "model 'missing' not found" {
+		t.Errorf("unexpected error %+v", providerErr)
+	}
+}
+
+func TestOllamaTimeout(t *testing.T) {
+	t.Setenv("PROVIDER_TIMEOUT", "20ms")
+	ollama := newOllamaServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	if _, err := ollama.Chat(context.Background(), &ChatRequest{Model: "llama3"}); err == nil {
+		t.Fatal("expected the request to time out")
+	}
+}
@@ -0,0 +1,214 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// OpenAI talks to the OpenAI API or any server implementing its shape.
+type OpenAI struct {
+	client
+}
+
+func NewOpenAI(baseURL, apiKey string) *OpenAI {
+	headers := map[string]string{}
+	if apiKey != "" {
+		headers["Authorization"] = "Bearer " + apiKey
+	}
+	return &OpenAI{client{
+		provider: "openai",
+		baseURL:  baseURL,
+		headers:  headers,
+		http:     newHTTPClient(),
+	}}
+}
+
+func (o *OpenAI) Name() string {
+	return "openai"
+}
+
+type openaiChatRequest struct {
+	Model          string                 `json:"model"`
+	Messages       []Message              `json:"messages"`
+	Temperature    *float64               `json:"temperature,omitempty"`
+	TopP           *float64               `json:"top_p,omitempty"`
+	MaxTokens      int                    `json:"max_tokens,omitempty"`
+	Stop           []string               `json:"stop,omitempty"`
+	Stream         bool                   `json:"stream"`
+	StreamOptions  map[string]interface{} `json:"stream_options,omitempty"`
+	ResponseFormat map[string]interface{} `json:"response_format,omitempty"`
+}
+
+type openaiUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type openaiChatResponse struct {
+	Choices []struct {
+		Message      Message `json:"message"`
+		Delta        Message `json:"delta"`
+		FinishReason string  `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openaiUsage `json:"usage"`
+}
+
+func (o *OpenAI) chatRequest(request *ChatRequest, stream bool) *openaiChatRequest {
+	body := &openaiChatRequest{
+		Model:       request.Model,
+		Messages:    request.Messages,
+		Temperature: request.Options.Temperature,
+		TopP:        request.Options.TopP,
+		MaxTokens:   request.Options.MaxTokens,
+		Stop:        request.Options.Stop,
+		Stream:      stream,
+	}
+	if stream {
+		body.StreamOptions = map[string]interface{}{"include_usage": true}
+	}
+	if len(request.Options.Schema) > 0 {
+		body.ResponseFormat = map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": map[string]interface{}{
+				"name":   "response",
+				"schema": request.Options.Schema,
+			},
+		}
+	}
+	return body
+}
+
+func (o *OpenAI) Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error) {
+	response := &openaiChatResponse{}
+	err := o.doJSON(ctx, http.MethodPost, "/chat/completions", o.chatRequest(request, false), response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Choices) == 0 {
+		return nil, errors.New("openai: empty response")
+	}
+
+	result := &ChatResponse{
+		Message:      response.Choices[0].Message,
+		FinishReason: response.Choices[0].FinishReason,
+	}
+	if response.Usage != nil {
+		result.Usage = Usage(*response.Usage)
+	}
+	return result, nil
+}
+
+// ChatStream reads the server sent events of a streamed completion. The
+// finish reason and the usage can arrive in different events, so the final
+// chunk is only sent once the stream is over.
+func (o *OpenAI) ChatStream(ctx context.Context, request *ChatRequest, onChunk func(*ChatChunk) error) error {
+	last := &ChatChunk{Done: true}
+	err := o.streamLines(ctx, "/chat/completions", o.chatRequest(request, true), func(line string) error {
+		if !strings.HasPrefix(line, "data:") {
+			return nil
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+
+		response := &openaiChatResponse{}
+		if err := json.Unmarshal([]byte(data), response); err != nil {
+			return err
+		}
+		if response.Usage != nil {
+			usage := Usage(*response.Usage)
+			last.Usage = &usage
+		}
+		if len(response.Choices) == 0 {
+			return nil
+		}
+		if reason := response.Choices[0].FinishReason; reason != "" {
+			last.FinishReason = reason
+		}
+		if content := response.Choices[0].Delta.Content; content != "" {
+			return onChunk(&ChatChunk{Content: content})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return onChunk(last)
+}
+
+func (o *OpenAI) Embed(ctx context.Context, model string, input []string) ([][]float64, error) {
+	response := &struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}{}
+	err := o.doJSON(ctx, http.MethodPost, "/embeddings", map[string]interface{}{
+		"model": model,
+		"input": input,
+	}, response)
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings := make([][]float64, len(input))
+	for _, item := range response.Data {
+		if item.Index >= 0 && item.Index < len(embeddings) {
+			embeddings[item.Index] = item.Embedding
+		}
+	}
+	return embeddings, nil
+}
+
+func (o *OpenAI) ListModels(ctx context.Context) ([]Model, error) {
+	// Besides id and owned_by, OpenAI compatible servers often report the
+	// context length and modalities under one of these names.
+	response := &struct {
+		Data []struct {
+			ID            string   `json:"id"`
+			OwnedBy       string   `json:"owned_by"`
+			ContextLength int      `json:"context_length"`
+			ContextWindow int      `json:"context_window"`
+			MaxModelLen   int      `json:"max_model_len"`
+			Modalities    []string `json:"modalities"`
+			Architecture  struct {
+				InputModalities []string `json:"input_modalities"`
+			} `json:"architecture"`
+		} `json:"data"`
+	}{}
+	if err := o.doJSON(ctx, http.MethodGet, "/models", nil, response); err != nil {
+		return nil, err
+	}
+
+	models := make([]Model, 0, len(response.Data))
+	for _, model := range response.Data {
+		entry := Model{
+			ID:            model.ID,
+			Provider:      o.Name(),
+			OwnedBy:       model.OwnedBy,
+			ContextLength: firstPositive(model.ContextLength, model.ContextWindow, model.MaxModelLen),
+			Modalities:    model.Modalities,
+		}
+		if len(entry.Modalities) == 0 {
+			entry.Modalities = model.Architecture.InputModalities
+		}
+		if len(entry.Modalities) == 0 {
+			entry.Modalities = []string{"text"}
+		}
+		models = append(models, entry)
+	}
+	return models, nil
+}
+
+func firstPositive(values ...int) int {
+	for _, value := range values {
+		if value > 0 {
+			return value
+		}
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newOpenAIServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body map[string]interface{})) *OpenAI {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		body := map[string]interface{}{}
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("decoding request: %v", err)
+			}
+		}
+		handler(w, r, body)
+	}))
+	t.Cleanup(server.Close)
+	return NewOpenAI(server.URL+"/v1", "secret")
+}
+
+func TestOpenAIChat(t *testing.T) {
+	openai := newOpenAIServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("path = %v", r.URL.Path)
+		}
+		if body["model"] != "gpt-4o-mini" || body["stream"] != false || body["max_tokens"] != float64(32) {
+			t.Errorf("unexpected body %v", body)
+		}
+		format, _ := body["response_format"].(map[string]interface{})
+		if format["type"] != "json_schema" {
+			t.Errorf("response_format = %v", body["response_format"])
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"{}"},"finish_reason":"stop"}],"usage":{"prompt_tokens":9,"completion_tokens":1}}`))
+	})
+
+	response, err := openai.Chat(context.Background(), &ChatRequest{
+		Model:    "gpt-4o-mini",
+		Messages: []Message{{Role: RoleUser, Content: "Hi"}},
+		Options:  Options{MaxTokens: 32, Schema: json.RawMessage(`{"type":"object"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Message.Content != "{}" || response.FinishReason != "stop" {
+		t.Errorf("unexpected response %+v", response)
+	}
+	if response.Usage != (Usage{PromptTokens: 9, CompletionTokens: 1}) {
+		t.Errorf("usage = %+v", response.Usage)
+	}
+}
+
+func TestOpenAIChatStream(t *testing.T) {
+	openai := newOpenAIServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		if body["stream"] != true || body["stream_options"] == nil {
+			t.Errorf("unexpected body %v", body)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(
+			"data: {\"choices\":[{\"delta\":{\"content\":\"Ho\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\"la\"},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":4,\"completion_tokens\":2}}\n\n" +
+				"data: [DONE]\n\n",
+		))
+	})
+
+	chunks := make([]*ChatChunk, 0)
+	err := openai.ChatStream(context.Background(), &ChatRequest{Model: "gpt-4o-mini"}, func(chunk *ChatChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 || chunks[0].Content+chunks[1].Content != "Hola" {
+		t.Fatalf("unexpected chunks %+v", chunks)
+	}
+	last := chunks[2]
+	if !last.Done || last.FinishReason != "stop" || last.Usage == nil || last.Usage.PromptTokens != 4 {
+		t.Errorf("unexpected last chunk %+v", last)
+	}
+}
+
+func TestOpenAIEmbed(t *testing.T) {
+	openai := newOpenAIServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		if r.URL.Path != "/v1/embeddings" || body["model"] != "text-embedding-3-small" {
+			t.Errorf("unexpected request %v %v", r.URL.Path, body)
+		}
+		// The embeddings come back out of order.
+		w.Write([]byte(`{"data":[{"index":1,"embedding":[0.3,0.4]},{"index":0,"embedding":[0.1,0.2]}]}`))
+	})
+
+	embeddings, err := openai.Embed(context.Background(), "text-embedding-3-small", []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embeddings) != 2 || embeddings[0][0] != 0.1 || embeddings[1][0] != 0.3 {
+		t.Errorf("unexpected embeddings %v", embeddings)
+	}
+}
+
+func TestOpenAIListModels(t *testing.T) {
+	openai := newOpenAIServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		if r.URL.Path != "/v1/models" {
+			t.Errorf("path = %v", r.URL.Path)
+		}
+		w.Write([]byte(`{"data":[` +
+			`{"id":"gpt-4o","owned_by":"openai","context_window":128000,"modalities":["text","image"]},` +
+			`{"id":"local","owned_by":"vllm","max_model_len":4096,"architecture":{"input_modalities":["text"]}},` +
+			`{"id":"bare"}]}`))
+	})
+
+	models, err := openai.ListModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 3 {
+		t.Fatalf("models = %+v", models)
+	}
+	if models[0].ContextLength != 128000 || len(models[0].Modalities) != 2 || models[0].OwnedBy != "openai" {
+		t.Errorf("unexpected model %+v", models[0])
+	}
+	if models[1].ContextLength != 4096 || models[1].Modalities[0] != "text" {
+		t.Errorf("unexpected model %+v", models[1])
+	}
+	if models[2].ContextLength != 0 || models[2].Modalities[0] != "text" || models[2].Provider != "openai" {
+		t.Errorf("unexpected model %+v", models[2])
+	}
+}
+
+func TestOpenAIError(t *testing.T) {
+	openai := newOpenAIServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"Incorrect API key provided"}}`))
+	})
+
+	_, err := openai.ListModels(context.Background())
+	providerErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if providerErr.StatusCode != http.StatusUnauthorized || providerErr.Message != "Incorrect API key provided" {
+		t.Errorf("unexpected error %+v", providerErr)
+	}
+}
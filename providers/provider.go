@@ -0,0 +1,148 @@
+// Package providers calls the model backends directly: conversations are
+// generated with the provider and model of their mmlu, and the providers also
+// serve the model catalog and the embeddings of the knowledge.
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/juliotorresmoreno/tana-api/logger"
+)
+
+var log = logger.SetupLogger()
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Options tune a generation. Zero values leave the choice to the backend.
+type Options struct {
+	Temperature *float64
+	TopP        *float64
+	MaxTokens   int
+	Stop        []string
+	// ContextWindow is the token budget of the prompt, only honored by
+	// backends that let the caller size it.
+	ContextWindow int
+	// Schema asks for a JSON response matching the JSON schema.
+	Schema json.RawMessage
+}
+
+type ChatRequest struct {
+	Model    string
+	Messages []Message
+	Options  Options
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+type ChatResponse struct {
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+	Usage        Usage   `json:"usage"`
+}
+
+// ChatChunk is a piece of a streamed response. The last chunk has Done set,
+// along with the finish reason and usage when the backend reports them.
+type ChatChunk struct {
+	Content      string `json:"content"`
+	Done         bool   `json:"done"`
+	FinishReason string `json:"finish_reason,omitempty"`
+	Usage        *Usage `json:"usage,omitempty"`
+}
+
+// Model describes a model of a provider. ContextLength is zero when the
+// backend doesn't report it.
+type Model struct {
+	ID            string   `json:"id"`
+	Provider      string   `json:"provider"`
+	OwnedBy       string   `json:"owned_by,omitempty"`
+	Family        string   `json:"family,omitempty"`
+	Size          int64    `json:"size,omitempty"`
+	ContextLength int      `json:"context_length,omitempty"`
+	Modalities    []string `json:"modalities"`
+}
+
+// Provider is a backend able to run models.
+type Provider interface {
+	Name() string
+	Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error)
+	// ChatStream calls onChunk for every piece of the response as it is
+	// generated. An error returned by onChunk stops the stream.
+	ChatStream(ctx context.Context, request *ChatRequest, onChunk func(*ChatChunk) error) error
+	Embed(ctx context.Context, model string, input []string) ([][]float64, error)
+	ListModels(ctx context.Context) ([]Model, error)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Provider{}
+)
+
+// Setup registers the providers configured in the environment: Ollama at
+// OLLAMA_URL (default http://localhost:11434), and an OpenAI compatible API
+// at OPENAI_BASE_URL (default https://api.openai.com/v1) when OPENAI_API_KEY
+// or OPENAI_BASE_URL is set.
+func Setup() {
+	ollamaURL := os.Getenv("OLLAMA_URL")
+	if ollamaURL == "" {
+		ollamaURL = "http://localhost:11434"
+	}
+	Register(NewOllama(ollamaURL))
+
+	openaiURL := os.Getenv("OPENAI_BASE_URL")
+	openaiKey := os.Getenv("OPENAI_API_KEY")
+	if openaiURL != "" || openaiKey != "" {
+		if openaiURL == "" {
+			openaiURL = "https://api.openai.com/v1"
+		}
+		Register(NewOpenAI(openaiURL, openaiKey))
+	}
+}
+
+// Register makes provider available under its name, replacing any provider
+// registered with the same name.
+func Register(provider Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[provider.Name()] = provider
+}
+
+func Get(name string) (Provider, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	provider, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("provider %q is not configured", name)
+	}
+	return provider, nil
+}
+
+// All returns the registered providers sorted by name.
+func All() []Provider {
+	mu.RLock()
+	defer mu.RUnlock()
+	result := make([]Provider, 0, len(registry))
+	for _, provider := range registry {
+		result = append(result, provider)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result
+}
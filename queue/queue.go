@@ -0,0 +1,227 @@
+// Package queue runs background jobs out of Redis. Jobs are picked by the
+// workers of any instance, retried with exponential backoff when they fail
+// and moved to a dead-letter list once they run out of attempts. Their owner
+// is told about the outcome through the events stream.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+var log = logger.SetupLogger()
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusRetrying  = "retrying"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+const (
+	queueKey      = "jobs-queue"
+	processingKey = "jobs-processing"
+	delayedKey    = "jobs-delayed"
+	deadKey       = "jobs-dead"
+)
+
+// deadLimit is how many failed jobs the dead-letter list keeps.
+const deadLimit = 1000
+
+// jobTTL is how long a job can be looked up after it was created, from
+// JOB_TTL.
+func jobTTL() time.Duration {
+	return utils.DurationFromEnv("JOB_TTL", 7*24*time.Hour)
+}
+
+// maxAttempts is how many times a job runs before it is given up, from
+// JOB_MAX_ATTEMPTS.
+func maxAttempts() int {
+	return utils.IntFromEnv("JOB_MAX_ATTEMPTS", 5)
+}
+
+// backoff is the wait before the next attempt, doubling from JOB_BACKOFF
+// after every failure up to an hour.
+func backoff(attempts int) time.Duration {
+	wait := utils.DurationFromEnv("JOB_BACKOFF", 5*time.Second)
+	for i := 1; i < attempts && wait < time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+	return wait
+}
+
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	OwnerId     uint            `json:"-"`
+	Status      string          `json:"status"`
+	Progress    int             `json:"progress"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	Error       string          `json:"error,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	RetryAt     *time.Time      `json:"retry_at,omitempty"`
+	CreationAt  time.Time       `json:"creation_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+
+	payload json.RawMessage
+}
+
+// storedJob is a job as kept in the cache, along with what the responses
+// leave out.
+type storedJob struct {
+	*Job
+	OwnerId uint            `json:"owner_id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func jobKey(id string) string {
+	return "job-" + id
+}
+
+// Handler runs a job. What it returns is kept as the result of the job.
+type Handler func(ctx context.Context, job *Job) (interface{}, error)
+
+var handlers = map[string]Handler{}
+
+// Register sets the handler of a job type. Handlers are registered before
+// Setup starts the workers.
+func Register(jobType string, handler Handler) {
+	handlers[jobType] = handler
+}
+
+// FailureHandler runs once a job is given up, to release what it holds.
+type FailureHandler func(ctx context.Context, job *Job)
+
+var failureHandlers = map[string]FailureHandler{}
+
+// OnFailure sets what runs when a job of the type is given up, whether its
+// handler failed for the last time or its last attempt was lost along with
+// the instance running it.
+func OnFailure(jobType string, handler FailureHandler) {
+	failureHandlers[jobType] = handler
+}
+
+// permanentError is a failure that won't go away by retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err so the job fails without further attempts.
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Enqueue creates a job of the owner. The payload is handed to the handler
+// through Decode.
+func Enqueue(ctx context.Context, ownerID uint, jobType string, payload interface{}) (*Job, error) {
+	if _, ok := handlers[jobType]; !ok {
+		return nil, fmt.Errorf("unknown job type %v", jobType)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	id, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:          id,
+		Type:        jobType,
+		OwnerId:     ownerID,
+		Status:      StatusQueued,
+		MaxAttempts: maxAttempts(),
+		CreationAt:  now,
+		UpdatedAt:   now,
+		payload:     data,
+	}
+	if err := job.save(ctx); err != nil {
+		return nil, err
+	}
+	if err := db.DefaultCache.LPush(ctx, queueKey, job.ID).Err(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Find returns the job of the owner, nil when there is none.
+func Find(ctx context.Context, ownerID uint, id string) (*Job, error) {
+	job, err := load(ctx, id)
+	if err != nil || job == nil || job.OwnerId != ownerID {
+		return nil, err
+	}
+	return job, nil
+}
+
+func load(ctx context.Context, id string) (*Job, error) {
+	data, err := db.DefaultCache.Get(ctx, jobKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := &storedJob{Job: &Job{}}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, err
+	}
+	job := stored.Job
+	job.OwnerId = stored.OwnerId
+	job.payload = stored.Payload
+	return job, nil
+}
+
+func (j *Job) save(ctx context.Context) error {
+	j.UpdatedAt = time.Now()
+	data, err := json.Marshal(&storedJob{Job: j, OwnerId: j.OwnerId, Payload: j.payload})
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(j.CreationAt.Add(jobTTL()))
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return db.DefaultCache.Set(ctx, jobKey(j.ID), data, ttl).Err()
+}
+
+// Decode reads the payload the job was enqueued with.
+func (j *Job) Decode(payload interface{}) error {
+	return json.Unmarshal(j.payload, payload)
+}
+
+// SetProgress reports how far along the job is, as a percentage.
+func (j *Job) SetProgress(ctx context.Context, progress int) {
+	j.Progress = progress
+	if err := j.save(ctx); err != nil {
+		log.Error("Error saving job progress", err)
+	}
+}
@@ -0,0 +1,233 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+var scheduleInterval = time.Second
+
+// jobTimeout is how long an attempt may run, from JOB_TIMEOUT. Attempts
+// that haven't reported for that long are taken as lost, like those of an
+// instance that stopped.
+func jobTimeout() time.Duration {
+	return utils.DurationFromEnv("JOB_TIMEOUT", 15*time.Minute)
+}
+
+// Setup starts JOB_WORKERS workers and the scheduler of the retries.
+func Setup() {
+	workers := utils.IntFromEnv("JOB_WORKERS", 4)
+	for i := 0; i < workers; i++ {
+		go work()
+	}
+	go runScheduler()
+}
+
+func work() {
+	ctx := context.Background()
+	for {
+		id, err := db.DefaultCache.BLMove(ctx, queueKey, processingKey, "RIGHT", "LEFT", 5*time.Second).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Error("Error getting job", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		run(ctx, id)
+		db.DefaultCache.LRem(ctx, processingKey, 1, id)
+	}
+}
+
+func run(ctx context.Context, id string) {
+	job, err := load(ctx, id)
+	if err != nil {
+		log.Error("Error getting job ", id, ": ", err)
+		return
+	}
+	if job == nil {
+		return
+	}
+
+	handler, ok := handlers[job.Type]
+	if !ok {
+		job.Attempts++
+		fail(ctx, job, Permanent(fmt.Errorf("unknown job type %v", job.Type)))
+		return
+	}
+
+	job.Status = StatusRunning
+	job.Attempts++
+	job.RetryAt = nil
+	if err := job.save(ctx); err != nil {
+		log.Error("Error saving job", err)
+	}
+
+	result, err := call(handler, job)
+	if err != nil {
+		fail(ctx, job, err)
+		return
+	}
+
+	job.Status = StatusCompleted
+	job.Progress = 100
+	job.Error = ""
+	if job.Result, err = json.Marshal(result); err != nil {
+		log.Error("Error encoding job result", err)
+	}
+	if err := job.save(ctx); err != nil {
+		log.Error("Error saving job", err)
+	}
+	notify(ctx, job, "job.completed")
+}
+
+// call runs the handler, turning a panic into a failure of the attempt.
+func call(handler Handler, job *Job) (result interface{}, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout())
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// fail schedules the next attempt of the job or, when there is none left,
+// moves it to the dead-letter list.
+func fail(ctx context.Context, job *Job, err error) {
+	log.Error("Job ", job.ID, " of type ", job.Type, " failed: ", err)
+	job.Error = err.Error()
+
+	if !IsPermanent(err) && job.Attempts < job.MaxAttempts {
+		retryAt := time.Now().Add(backoff(job.Attempts))
+		job.Status = StatusRetrying
+		job.RetryAt = &retryAt
+		if err := job.save(ctx); err != nil {
+			log.Error("Error saving job", err)
+		}
+		err := db.DefaultCache.ZAdd(ctx, delayedKey, redis.Z{
+			Score:  float64(retryAt.Unix()),
+			Member: job.ID,
+		}).Err()
+		if err != nil {
+			log.Error("Error scheduling job retry", err)
+		}
+		return
+	}
+
+	job.Status = StatusFailed
+	job.RetryAt = nil
+	if err := job.save(ctx); err != nil {
+		log.Error("Error saving job", err)
+	}
+	pipe := db.DefaultCache.TxPipeline()
+	pipe.LPush(ctx, deadKey, job.ID)
+	pipe.LTrim(ctx, deadKey, 0, deadLimit-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Error("Error moving job to the dead-letter list", err)
+	}
+	if onFailure, ok := failureHandlers[job.Type]; ok {
+		callFailure(ctx, onFailure, job)
+	}
+	notify(ctx, job, "job.failed")
+}
+
+// callFailure runs the failure handler of the job, logging a panic instead
+// of taking the worker down.
+func callFailure(ctx context.Context, onFailure FailureHandler, job *Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("Failure handler of job ", job.ID, " panicked: ", r)
+		}
+	}()
+	onFailure(ctx, job)
+}
+
+// notify pushes the job to the events stream of its owner.
+func notify(ctx context.Context, job *Job, eventType string) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"type": eventType,
+		"job":  job,
+	})
+	if err != nil {
+		log.Error("Error encoding job event", err)
+		return
+	}
+	evt, _ := json.Marshal(&models.Event{
+		UserId:  job.OwnerId,
+		Payload: string(payload),
+	})
+	if err := db.DefaultCache.Publish(ctx, "events", string(evt)).Err(); err != nil {
+		log.Error("Error publishing job event", err)
+	}
+}
+
+// runScheduler queues the retries that are due and recovers the jobs lost
+// while running.
+func runScheduler() {
+	ctx := context.Background()
+	for {
+		schedule(ctx)
+		recoverLost(ctx)
+		time.Sleep(scheduleInterval)
+	}
+}
+
+func schedule(ctx context.Context) {
+	ids, err := db.DefaultCache.ZRangeByScore(ctx, delayedKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		log.Error("Error getting job retries", err)
+		return
+	}
+	for _, id := range ids {
+		// Whoever removes the retry queues it, so it is queued once.
+		removed, err := db.DefaultCache.ZRem(ctx, delayedKey, id).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+		if err := db.DefaultCache.LPush(ctx, queueKey, id).Err(); err != nil {
+			log.Error("Error queuing job retry", err)
+		}
+	}
+}
+
+func recoverLost(ctx context.Context) {
+	locked, err := db.DefaultCache.SetNX(ctx, "jobs-recover-lock", 1, time.Minute).Result()
+	if err != nil || !locked {
+		return
+	}
+
+	ids, err := db.DefaultCache.LRange(ctx, processingKey, 0, -1).Result()
+	if err != nil {
+		log.Error("Error getting running jobs", err)
+		return
+	}
+	lost := time.Now().Add(-jobTimeout() - time.Minute)
+	for _, id := range ids {
+		job, err := load(ctx, id)
+		if err != nil {
+			continue
+		}
+		if job != nil && job.UpdatedAt.After(lost) {
+			continue
+		}
+		removed, err := db.DefaultCache.LRem(ctx, processingKey, 1, id).Result()
+		if err != nil || removed == 0 || job == nil {
+			continue
+		}
+		fail(ctx, job, fmt.Errorf("job timed out"))
+	}
+}
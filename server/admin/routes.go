@@ -0,0 +1,26 @@
+package admin
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/models"
+)
+
+var log = logger.SetupLogger()
+var usersTablename = models.User{}.TableName()
+
+type AdminRouter struct {
+}
+
+func SetupAPIRoutes(r *gin.RouterGroup) {
+	h := &AdminRouter{}
+	r.GET("/users", h.findUsers)
+	r.GET("/users/:id", h.findUser)
+	r.PATCH("/users/:id/role", h.updateRole)
+	r.POST("/users/:id/suspend", h.suspend)
+	r.POST("/users/:id/unsuspend", h.unsuspend)
+	r.POST("/users/:id/password-reset", h.forcePasswordReset)
+	r.POST("/users/:id/impersonate", h.impersonate)
+	r.POST("/users/:id/restore", h.restore)
+	r.DELETE("/users/:id", h.delete)
+}
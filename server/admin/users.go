@@ -0,0 +1,376 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
+	"github.com/juliotorresmoreno/tana-api/server/auth"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+var defaultPageSize = 20
+var maxPageSize = 100
+var impersonationLifetime = time.Hour
+
+type User struct {
+	ID                    uint       `json:"id"`
+	Verified              bool       `json:"verified"`
+	Name                  string     `json:"name"`
+	LastName              string     `json:"last_name"`
+	Email                 string     `json:"email"`
+	PhotoURL              string     `json:"photo_url"`
+	Phone                 string     `json:"phone"`
+	Business              string     `json:"business"`
+	Rol                   string     `json:"rol"`
+	TOTPEnabled           bool       `json:"totp_enabled" gorm:"column:totp_enabled"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	SuspendedAt           *time.Time `json:"suspended_at"`
+	CreationAt            time.Time  `json:"creation_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+	DeletedAt             *time.Time `json:"deleted_at"`
+}
+
+type UsersPage struct {
+	Items []User `json:"items"`
+	Total int64  `json:"total"`
+	Page  int    `json:"page"`
+	Limit int    `json:"limit"`
+}
+
+// findUsers supports the q, verified, role, suspended, deleted, created_from
+// and created_to filters, and page/limit pagination.
+func (h *AdminRouter) findUsers(c *gin.Context) {
+	conn := db.DefaultClient
+	query := conn.Table(usersTablename)
+
+	switch c.Query("deleted") {
+	case "true":
+		query = query.Where("deleted_at IS NOT NULL")
+	case "all":
+	default:
+		query = query.Where("deleted_at IS NULL")
+	}
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		like := "%" + strings.ToLower(q) + "%"
+		query = query.Where(
+			"lower(name) LIKE ? OR lower(last_name) LIKE ? OR lower(email) LIKE ?",
+			like, like, like,
+		)
+	}
+	if verified, err := strconv.ParseBool(c.Query("verified")); err == nil {
+		query = query.Where("verified = ?", verified)
+	}
+	if suspended, err := strconv.ParseBool(c.Query("suspended")); err == nil {
+		if suspended {
+			query = query.Where("suspended_at IS NOT NULL")
+		} else {
+			query = query.Where("suspended_at IS NULL")
+		}
+	}
+	if role := c.Query("role"); role != "" {
+		if role == middlewares.DefaultRole {
+			query = query.Where("rol = ? OR rol = ''", role)
+		} else {
+			query = query.Where("rol = ?", role)
+		}
+	}
+	if from, err := time.Parse(time.RFC3339, c.Query("created_from")); err == nil {
+		query = query.Where("creation_at >= ?", from)
+	}
+	if to, err := time.Parse(time.RFC3339, c.Query("created_to")); err == nil {
+		query = query.Where("creation_at <= ?", to)
+	}
+
+	page, _ := strconv.Atoi(c.Query("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit < 1 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	result := &UsersPage{Items: make([]User, 0), Page: page, Limit: limit}
+	tx := query.Count(&result.Total)
+	if tx.Error != nil {
+		log.Error("Error counting users", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	tx = query.Order("id desc").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&result.Items)
+	if tx.Error != nil {
+		log.Error("Error getting users", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+func (h *AdminRouter) findUser(c *gin.Context) {
+	user := &User{}
+	tx := db.DefaultClient.Table(usersTablename).
+		Where("id = ?", c.Param("id")).
+		First(user)
+	if tx.Error != nil {
+		log.Error("Error getting user", tx.Error)
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// findTarget loads the user the request is about, refusing to let admins act
+// on their own account.
+func findTarget(c *gin.Context, unscoped bool) (*models.User, bool) {
+	session := middlewares.GetUser(c)
+
+	id, _ := strconv.Atoi(c.Param("id"))
+	if uint(id) == session.ID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "You can't perform this action on your own account",
+		})
+		return nil, false
+	}
+
+	conn := db.DefaultClient
+	if unscoped {
+		conn = conn.Unscoped()
+	}
+	user := &models.User{}
+	tx := conn.Where("id = ?", id).Limit(1).Find(user)
+	if tx.Error != nil {
+		log.Error("Error getting user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if user.ID == 0 {
+		utils.Response(c, utils.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
+
+type RolePayload struct {
+	Rol string `json:"rol"`
+}
+
+func (h *AdminRouter) updateRole(c *gin.Context) {
+	payload := &RolePayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+	if !middlewares.ValidRole(payload.Rol) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"rol": "Must be one of " + strings.Join(middlewares.Roles, ", "),
+		})
+		return
+	}
+
+	user, ok := findTarget(c, false)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Model(user).Update("rol", payload.Rol)
+	if tx.Error != nil {
+		log.Error("Error updating role", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	record(c, "admin.user_role", user,
+		gin.H{"rol": user.Rol},
+		gin.H{"rol": payload.Rol},
+	)
+
+	c.JSON(200, gin.H{"message": "update success"})
+}
+
+func (h *AdminRouter) suspend(c *gin.Context) {
+	user, ok := findTarget(c, false)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Model(user).Update("suspended_at", time.Now())
+	if tx.Error != nil {
+		log.Error("Error suspending user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if err := utils.RevokeUserSessions(user.ID); err != nil {
+		log.Error("Error revoking sessions", err)
+	}
+
+	record(c, "admin.user_suspend", user,
+		gin.H{"suspended": user.SuspendedAt != nil},
+		gin.H{"suspended": true},
+	)
+
+	c.JSON(200, gin.H{"message": "User suspended"})
+}
+
+func (h *AdminRouter) unsuspend(c *gin.Context) {
+	user, ok := findTarget(c, false)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Model(user).Update("suspended_at", nil)
+	if tx.Error != nil {
+		log.Error("Error unsuspending user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	record(c, "admin.user_unsuspend", user,
+		gin.H{"suspended": user.SuspendedAt != nil},
+		gin.H{"suspended": false},
+	)
+
+	c.JSON(200, gin.H{"message": "User unsuspended"})
+}
+
+// forcePasswordReset blocks password sign ins until the user picks a new
+// password through the emailed reset link.
+func (h *AdminRouter) forcePasswordReset(c *gin.Context) {
+	user, ok := findTarget(c, false)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Model(user).Update("password_reset_required", true)
+	if tx.Error != nil {
+		log.Error("Error updating user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if err := utils.RevokeUserSessions(user.ID); err != nil {
+		log.Error("Error revoking sessions", err)
+	}
+	if err := auth.SendPasswordReset(user); err != nil {
+		log.Error("Error sending password reset", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	record(c, "admin.user_password_reset", user,
+		gin.H{"password_reset_required": user.PasswordResetRequired},
+		gin.H{"password_reset_required": true},
+	)
+
+	c.JSON(200, gin.H{"message": "Password reset sent"})
+}
+
+func (h *AdminRouter) delete(c *gin.Context) {
+	user, ok := findTarget(c, false)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Delete(user)
+	if tx.Error != nil {
+		log.Error("Error deleting user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if err := utils.RevokeUserSessions(user.ID); err != nil {
+		log.Error("Error revoking sessions", err)
+	}
+
+	record(c, "admin.user_delete", user,
+		gin.H{"deleted": false},
+		gin.H{"deleted": true},
+	)
+
+	c.JSON(200, gin.H{"message": "deleted"})
+}
+
+func (h *AdminRouter) restore(c *gin.Context) {
+	user, ok := findTarget(c, true)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Unscoped().Model(user).Update("deleted_at", nil)
+	if tx.Error != nil {
+		log.Error("Error restoring user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	record(c, "admin.user_restore", user,
+		gin.H{"deleted": user.DeletedAt.Valid},
+		gin.H{"deleted": false},
+	)
+
+	c.JSON(200, gin.H{"message": "User restored"})
+}
+
+// impersonate returns a short lived session token for the user, marked with
+// the admin that requested it. The admin's own cookie is left untouched.
+func (h *AdminRouter) impersonate(c *gin.Context) {
+	session := middlewares.GetUser(c)
+	if session.Scopes != nil || session.ImpersonatorID != 0 {
+		utils.Response(c, utils.NewForbidden(middlewares.AdminPermission))
+		return
+	}
+
+	user, ok := findTarget(c, false)
+	if !ok {
+		return
+	}
+	if middlewares.Can(user.Rol, middlewares.AdminPermission) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Admins can't be impersonated"})
+		return
+	}
+	if user.SuspendedAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Suspended users can't be impersonated"})
+		return
+	}
+
+	impersonation, err := utils.MakeImpersonationSession(c, user, session.ID, impersonationLifetime)
+	if err != nil {
+		utils.Response(c, err)
+		return
+	}
+	log.WithField("admin_id", session.ID).
+		WithField("user_id", user.ID).
+		Warn("Impersonation session created")
+	record(c, "admin.user_impersonate", user, nil, gin.H{"email": user.Email})
+
+	c.JSON(200, gin.H{
+		"token":        impersonation.Token,
+		"user":         impersonation.User,
+		"impersonated": true,
+		"expires_at":   time.Now().Add(impersonationLifetime),
+	})
+}
+
+func record(c *gin.Context, action string, user *models.User, before, after gin.H) {
+	audit.Record(c, &audit.Event{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   user.ID,
+		Before:     before,
+		After:      after,
+	})
+}
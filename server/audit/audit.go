@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+)
+
+// Event describes an audited action. Before and After are the state of the
+// target around the action, nil when it didn't exist, and are stored as a
+// field by field diff.
+type Event struct {
+	Action     string
+	ActorID    uint // defaults to the user of the request
+	TargetType string
+	TargetID   uint
+	Before     interface{}
+	After      interface{}
+}
+
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Fields that change on every write and would only add noise to diffs.
+var ignoredFields = map[string]bool{
+	"updated_at": true,
+	"updatedAt":  true,
+}
+
+// Record appends event to the audit log. Failures are logged and never
+// interrupt the request being audited.
+func Record(c *gin.Context, event *Event) {
+	entry := &models.AuditLog{
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		TargetId:   event.TargetID,
+		IP:         c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+	}
+
+	actorID := event.ActorID
+	if user := middlewares.GetUser(c); user != nil {
+		if actorID == 0 {
+			actorID = user.ID
+		}
+		if user.ImpersonatorID != 0 {
+			impersonatorID := user.ImpersonatorID
+			entry.ImpersonatorId = &impersonatorID
+		}
+		entry.WorkspaceId = user.Workspace()
+	}
+	if actorID != 0 {
+		entry.ActorId = &actorID
+	}
+
+	changes, err := json.Marshal(Diff(event.Before, event.After))
+	if err != nil {
+		log.Error("Error encoding audit changes", err)
+		changes = []byte("{}")
+	}
+	entry.Changes = string(changes)
+
+	if tx := db.DefaultClient.Create(entry); tx.Error != nil {
+		log.Error("Error recording audit log", tx.Error)
+	}
+}
+
+// Diff compares the JSON representation of before and after and returns the
+// fields that differ.
+func Diff(before, after interface{}) map[string]Change {
+	b := fields(before)
+	a := fields(after)
+
+	changes := make(map[string]Change)
+	for key, value := range a {
+		if ignoredFields[key] {
+			continue
+		}
+		if previous, ok := b[key]; !ok || !reflect.DeepEqual(previous, value) {
+			changes[key] = Change{Before: b[key], After: value}
+		}
+	}
+	for key, value := range b {
+		if _, ok := a[key]; !ok && !ignoredFields[key] {
+			changes[key] = Change{Before: value}
+		}
+	}
+	return changes
+}
+
+func fields(value interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	if value == nil {
+		return result
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return result
+	}
+	json.Unmarshal(data, &result)
+	return result
+}
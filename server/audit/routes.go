@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+)
+
+var log = logger.SetupLogger()
+var tablename = models.AuditLog{}.TableName()
+var defaultPageSize = 50
+var maxPageSize = 200
+var maxExportSize = 10000
+
+type AuditRouter struct {
+}
+
+func SetupAPIRoutes(r *gin.RouterGroup) {
+	h := &AuditRouter{}
+	r.GET("", h.find)
+}
+
+type Entry struct {
+	ID             uint            `json:"id"`
+	ActorId        *uint           `json:"actor_id"`
+	ImpersonatorId *uint           `json:"impersonator_id,omitempty"`
+	WorkspaceId    *uint           `json:"workspace_id,omitempty"`
+	Action         string          `json:"action"`
+	TargetType     string          `json:"target_type"`
+	TargetId       uint            `json:"target_id"`
+	IP             string          `json:"ip"`
+	UserAgent      string          `json:"user_agent"`
+	Changes        json.RawMessage `json:"changes"`
+	CreationAt     time.Time       `json:"creation_at"`
+}
+
+type EntriesPage struct {
+	Items []Entry `json:"items"`
+	Total int64   `json:"total"`
+	Page  int     `json:"page"`
+	Limit int     `json:"limit"`
+}
+
+// filter applies the query string filters. Users only see their own
+// actions, admins see every action and can filter by actor_id.
+func filter(c *gin.Context) *gorm.DB {
+	session := middlewares.GetUser(c)
+
+	query := db.DefaultClient.Table(tablename)
+	if middlewares.Allowed(session, middlewares.AdminPermission) {
+		if actorID, err := strconv.Atoi(c.Query("actor_id")); err == nil {
+			query = query.Where("actor_id = ?", actorID)
+		}
+	} else {
+		query = query.Where("actor_id = ?", session.ID)
+	}
+
+	if actions := c.Query("action"); actions != "" {
+		query = query.Where("action IN ?", strings.Split(actions, ","))
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if targetID, err := strconv.Atoi(c.Query("target_id")); err == nil {
+		query = query.Where("target_id = ?", targetID)
+	}
+	if from, err := time.Parse(time.RFC3339, c.Query("from")); err == nil {
+		query = query.Where("creation_at >= ?", from)
+	}
+	if to, err := time.Parse(time.RFC3339, c.Query("to")); err == nil {
+		query = query.Where("creation_at <= ?", to)
+	}
+	return query
+}
+
+// find lists the audit log, newest first, as JSON pages or, with
+// format=csv, as a CSV export of up to maxExportSize entries.
+func (h *AuditRouter) find(c *gin.Context) {
+	if c.Query("format") == "csv" {
+		h.export(c)
+		return
+	}
+
+	page, _ := strconv.Atoi(c.Query("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit < 1 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	result := &EntriesPage{Items: make([]Entry, 0), Page: page, Limit: limit}
+	tx := filter(c).Count(&result.Total)
+	if tx.Error != nil {
+		log.Error("Error counting audit log", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	tx = filter(c).
+		Order("id desc").
+		Offset((page - 1) * limit).
+		Limit(limit).
+		Find(&result.Items)
+	if tx.Error != nil {
+		log.Error("Error getting audit log", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+func (h *AuditRouter) export(c *gin.Context) {
+	entries := make([]Entry, 0)
+	tx := filter(c).
+		Order("id desc").
+		Limit(maxExportSize).
+		Find(&entries)
+	if tx.Error != nil {
+		log.Error("Error getting audit log", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=audit-%s.csv", time.Now().Format("20060102-150405"),
+	))
+	c.Status(200)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{
+		"id", "creation_at", "actor_id", "impersonator_id", "workspace_id",
+		"action", "target_type", "target_id", "ip", "user_agent", "changes",
+	})
+	for _, entry := range entries {
+		writer.Write([]string{
+			fmt.Sprint(entry.ID),
+			entry.CreationAt.UTC().Format(time.RFC3339),
+			optional(entry.ActorId),
+			optional(entry.ImpersonatorId),
+			optional(entry.WorkspaceId),
+			csvCell(entry.Action),
+			csvCell(entry.TargetType),
+			fmt.Sprint(entry.TargetId),
+			csvCell(entry.IP),
+			csvCell(entry.UserAgent),
+			csvCell(string(entry.Changes)),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Error("Error writing audit export", err)
+	}
+}
+
+// csvCell keeps spreadsheets from running a value as a formula, like a user
+// agent starting with =.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func optional(id *uint) string {
+	if id == nil {
+		return ""
+	}
+	return fmt.Sprint(*id)
+}
@@ -18,7 +18,12 @@ func NewSignUpValidator() *SignUpValidator {
 }
 
 func PasswordValidation(fl validator.FieldLevel) bool {
-	password := fl.Field().String()
+	return IsValidPassword(fl.Field().String())
+}
+
+// IsValidPassword requires at least 7 characters with upper and lower case
+// letters, a number and a symbol.
+func IsValidPassword(password string) bool {
 	var (
 		hasMinLen  = false
 		hasUpper   = false
@@ -81,7 +86,7 @@ func (cv *SignUpValidator) ValidateSignUp(form *SignUpPayload) (SignUpValidation
 				errorsMap[field] = "Invalid email format!"
 			case "phone":
 				errorsMap[field] = "Invalid phone number!"
-			case "pattern":
+			case "pattern", "password":
 				errorsMap[field] = "Password does not meet requirements!"
 			default:
 				errorsMap[field] = "Invalid field!"
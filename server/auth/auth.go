@@ -2,12 +2,11 @@ package auth
 
 import (
 	"net/http"
-	"time"
-
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
 	"github.com/juliotorresmoreno/tana-api/utils"
 )
@@ -19,16 +18,42 @@ func SetupAUTHRoutes(r *gin.RouterGroup) {
 	auth := &AuthRouter{}
 
 	r.GET("", auth.Ping)
-	r.GET("/session", auth.Session)
 	r.POST("/sign-in", auth.SignIn)
+	r.POST("/sign-in/2fa", auth.SignInTwoFactor)
 	r.POST("/sign-up", auth.SignUp)
+	r.POST("/password/forgot", auth.ForgotPassword)
+	r.POST("/password/reset", auth.ResetPassword)
+
+	authenticated := middlewares.Authorize(middlewares.PolicyAuthenticated)
+	account := middlewares.Scope("user")
+	r.GET("/session", authenticated, account, auth.Session)
+	r.POST("/verify", authenticated, account, auth.Verify)
+	r.POST("/verify/resend", authenticated, account, auth.ResendVerification)
+
+	// Sessions, second factors and identities decide who can sign in, so
+	// only a session can manage them.
+	sessionOnly := middlewares.RequireSession()
+	r.POST("/logout", authenticated, sessionOnly, auth.Logout)
+	r.GET("/sessions", authenticated, sessionOnly, auth.Sessions)
+	r.DELETE("/sessions", authenticated, sessionOnly, auth.LogoutEverywhere)
+	r.DELETE("/sessions/:id", authenticated, sessionOnly, auth.RevokeSession)
+	r.GET("/sign-in-attempts", authenticated, sessionOnly, auth.SignInAttempts)
+
+	r.POST("/2fa/enroll", authenticated, sessionOnly, auth.EnrollTwoFactor)
+	r.POST("/2fa/confirm", authenticated, sessionOnly, auth.ConfirmTwoFactor)
+	r.POST("/2fa/recovery-codes", authenticated, sessionOnly, auth.RegenerateRecoveryCodes)
+	r.POST("/2fa/disable", authenticated, sessionOnly, auth.DisableTwoFactor)
+
+	r.GET("/identities", authenticated, sessionOnly, auth.Identities)
+	r.DELETE("/identities/:id", authenticated, sessionOnly, auth.Unlink)
+	r.DELETE("/lockouts", middlewares.Authorize(middlewares.PolicyAdmin), auth.ClearLockout)
 }
 
 type SignUpPayload struct {
 	Name     string `json:"name" validate:"required,validname"`
 	LastName string `json:"last_name" validate:"required,validname"`
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=6"`
+	Password string `json:"password" validate:"required,password"`
 	Phone    string `json:"phone" validate:"max=15"`
 }
 
@@ -78,21 +103,17 @@ func (auth *AuthRouter) SignUp(c *gin.Context) {
 		return
 	}
 
-	session, err := utils.MakeSession(user)
+	if err := SendValidationCode(user); err != nil {
+		log.Error("Error sending validation code", err)
+	}
+
+	session, err := utils.MakeSession(c, user)
 	if err != nil {
 		utils.Response(c, err)
+		return
 	}
 
-	cookie := &http.Cookie{
-		Name:     "token",
-		Value:    session.Token,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteStrictMode,
-	}
-	http.SetCookie(c.Writer, cookie)
+	utils.SetSessionCookie(c, session)
 
 	c.JSON(200, session.User)
 }
@@ -111,13 +132,30 @@ func (auth *AuthRouter) SignIn(c *gin.Context) {
 		return
 	}
 
+	throttled, err := checkSignIn(payload.Email, c.ClientIP())
+	if err != nil {
+		log.Error("Error checking sign in throttle", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if throttled != nil {
+		recordSignInAttempt(c, payload.Email, 0, false, "throttled")
+		respondThrottled(c, throttled)
+		return
+	}
+
 	conn := db.DefaultClient
 	user := &models.User{}
 
-	tx := conn.Select(utils.SessionFields, "password").First(
+	tx := conn.Select(
+		utils.SessionFields,
+		"password", "totp_enabled", "suspended_at", "password_reset_required",
+	).First(
 		user, "email = ?", payload.Email,
 	)
 	if tx.Error != nil {
+		recordSignInFailure(payload.Email, c.ClientIP())
+		recordSignInAttempt(c, payload.Email, 0, false, "unknown_email")
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "User or password incorrect",
 		})
@@ -126,6 +164,8 @@ func (auth *AuthRouter) SignIn(c *gin.Context) {
 
 	ok, err := utils.ComparePassword(payload.Password, user.Password)
 	if !ok || err != nil {
+		recordSignInFailure(payload.Email, c.ClientIP())
+		recordSignInAttempt(c, payload.Email, user.ID, false, "invalid_password")
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "User or password incorrect",
 		})
@@ -133,32 +173,75 @@ func (auth *AuthRouter) SignIn(c *gin.Context) {
 	}
 	user.Password = ""
 
-	session, err := utils.MakeSession(user)
+	challenge, reason, err := afterAuthentication(user)
 	if err != nil {
+		if reason != "" {
+			recordSignInAttempt(c, payload.Email, user.ID, false, reason)
+		}
 		utils.Response(c, err)
+		return
 	}
-
-	cookie := &http.Cookie{
-		Name:     "token",
-		Value:    session.Token,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteStrictMode,
+	if challenge != "" {
+		recordSignInAttempt(c, payload.Email, user.ID, true, reason)
+		c.JSON(200, gin.H{
+			"two_factor_required": true,
+			"challenge":           challenge,
+		})
+		return
 	}
-	http.SetCookie(c.Writer, cookie)
 
-	c.JSON(200, session.User)
-}
+	// With a second factor the failures are cleared once it passes.
+	if err := clearSignInFailures(payload.Email); err != nil {
+		log.Error("Error clearing sign in failures", err)
+	}
 
-func (auth *AuthRouter) Session(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
+	session, err := utils.MakeSession(c, user)
 	if err != nil {
 		utils.Response(c, err)
 		return
 	}
-	c.JSON(200, session)
+
+	recordSignInAttempt(c, payload.Email, user.ID, true, "")
+	utils.SetSessionCookie(c, session)
+
+	c.JSON(200, session.User)
+}
+
+var errAccountSuspended = &utils.HttpResponse{
+	Status: http.StatusForbidden,
+	Obj:    utils.HttpError{Message: "Account suspended"},
+}
+
+var errPasswordResetRequired = &utils.HttpResponse{
+	Status: http.StatusForbidden,
+	Obj:    utils.HttpError{Message: "Password reset required, check your email"},
+}
+
+// afterAuthentication runs the checks every sign in method applies once the
+// user proved who they are. It returns the reason the sign in stops along
+// with its error, or the challenge of the second factor for users with TOTP
+// enabled. With neither, the caller makes the session. The user needs
+// suspended_at, password_reset_required and totp_enabled loaded.
+func afterAuthentication(user *models.User) (challenge string, reason string, err error) {
+	if user.SuspendedAt != nil {
+		return "", "suspended", errAccountSuspended
+	}
+	if user.PasswordResetRequired {
+		return "", "password_reset_required", errPasswordResetRequired
+	}
+	if user.TOTPEnabled {
+		challenge, err := makeChallenge(user)
+		if err != nil {
+			log.Error("Error creating challenge", err)
+			return "", "", utils.StatusInternalServerError
+		}
+		return challenge, "two_factor_required", nil
+	}
+	return "", "", nil
+}
+
+func (auth *AuthRouter) Session(c *gin.Context) {
+	c.JSON(200, middlewares.GetUser(c))
 }
 
 func (auth *AuthRouter) Ping(c *gin.Context) {
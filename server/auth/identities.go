@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"github.com/markbates/goth"
+	"gorm.io/gorm"
+)
+
+// Errors returned by resolveIdentity are sent back to the frontend as the
+// oauth_error query parameter.
+var (
+	errIdentityInUse    = errors.New("identity_in_use")
+	errEmailRequired    = errors.New("email_required")
+	errEmailNotVerified = errors.New("email_not_verified")
+	errProvisionFailed  = errors.New("provision_failed")
+	errLinkFailed       = errors.New("link_failed")
+)
+
+// resolveIdentity finds the local user behind an OAuth identity. Known
+// identities sign in their user; otherwise the identity is linked to the
+// signed in user, to the verified account with the same email, or to a new
+// account built from the provider profile.
+func resolveIdentity(c *gin.Context, guser goth.User) (*models.User, error) {
+	conn := db.DefaultClient
+
+	identity := &models.UserIdentity{}
+	tx := conn.Where("provider = ? AND provider_user_id = ?", guser.Provider, guser.UserID).
+		Limit(1).
+		Find(identity)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		return nil, errLinkFailed
+	}
+
+	current := middlewares.GetUser(c)
+	if identity.ID != 0 {
+		if current != nil && current.ID != identity.UserId {
+			return nil, errIdentityInUse
+		}
+		if err := saveIdentity(identity, guser); err != nil {
+			return nil, err
+		}
+		return findIdentityUser(identity.UserId)
+	}
+
+	if current != nil {
+		identity.UserId = current.ID
+		if err := saveIdentity(identity, guser); err != nil {
+			return nil, err
+		}
+		return findIdentityUser(current.ID)
+	}
+
+	email := normalizeEmail(guser.Email)
+	if email == "" {
+		return nil, errEmailRequired
+	}
+
+	user := &models.User{}
+	tx = conn.Where("lower(email) = ?", email).Limit(1).Find(user)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		return nil, errLinkFailed
+	}
+
+	// Both sides must have proven the email before the accounts are linked,
+	// otherwise a provider account with someone else's email takes theirs.
+	if user.ID != 0 && (!user.Verified || !emailVerified(guser)) {
+		return nil, errEmailNotVerified
+	}
+
+	if user.ID == 0 {
+		user, err := provisionUser(guser, email)
+		if err != nil {
+			return nil, err
+		}
+		identity.UserId = user.ID
+		if err := saveIdentity(identity, guser); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	identity.UserId = user.ID
+	if err := saveIdentity(identity, guser); err != nil {
+		return nil, err
+	}
+	return findIdentityUser(user.ID)
+}
+
+func provisionUser(guser goth.User, email string) (*models.User, error) {
+	name, lastName := guser.FirstName, guser.LastName
+	if name == "" && lastName == "" {
+		parts := strings.SplitN(strings.TrimSpace(guser.Name), " ", 2)
+		name = parts[0]
+		if len(parts) > 1 {
+			lastName = parts[1]
+		}
+	}
+	if name == "" {
+		name = guser.NickName
+	}
+
+	user := &models.User{
+		Name:     name,
+		LastName: lastName,
+		Email:    email,
+		PhotoURL: guser.AvatarURL,
+		Verified: emailVerified(guser),
+	}
+	tx := db.DefaultClient.Create(user)
+	if tx.Error != nil {
+		log.Error("Error provisioning user", tx.Error)
+		return nil, errProvisionFailed
+	}
+
+	if !user.Verified {
+		if err := SendValidationCode(user); err != nil {
+			log.Error("Error sending validation code", err)
+		}
+	}
+	return user, nil
+}
+
+// emailVerified trusts the email_verified claim when the provider sends one.
+func emailVerified(guser goth.User) bool {
+	switch verified := guser.RawData["email_verified"].(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+func saveIdentity(identity *models.UserIdentity, guser goth.User) error {
+	identity.Provider = guser.Provider
+	identity.ProviderUserId = guser.UserID
+	identity.Email = guser.Email
+	identity.AccessToken = guser.AccessToken
+	identity.RefreshToken = guser.RefreshToken
+	identity.ExpiresAt = nil
+	if !guser.ExpiresAt.IsZero() {
+		expiresAt := guser.ExpiresAt
+		identity.ExpiresAt = &expiresAt
+	}
+
+	tx := db.DefaultClient.Save(identity)
+	if tx.Error != nil {
+		log.Error("Error saving identity", tx.Error)
+		return errLinkFailed
+	}
+	return nil
+}
+
+func findIdentityUser(userID uint) (*models.User, error) {
+	user := &models.User{}
+	tx := db.DefaultClient.
+		Select(utils.SessionFields, "totp_enabled", "suspended_at", "password_reset_required").
+		First(user, userID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		return nil, errLinkFailed
+	}
+	return user, nil
+}
+
+type Identity struct {
+	ID         uint       `json:"id"`
+	Provider   string     `json:"provider"`
+	Email      string     `json:"email"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	CreationAt time.Time  `json:"creation_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (auth *AuthRouter) Identities(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	identities := make([]Identity, 0)
+	tx := db.DefaultClient.Model(&models.UserIdentity{}).
+		Where("user_id = ?", session.ID).
+		Find(&identities)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, identities)
+}
+
+func (auth *AuthRouter) Unlink(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	err := db.DefaultClient.Transaction(func(tx *gorm.DB) error {
+		identity := &models.UserIdentity{}
+		result := tx.Where("id = ? AND user_id = ?", c.Param("id"), session.ID).
+			Limit(1).
+			Find(identity)
+		if result.Error != nil {
+			return result.Error
+		}
+		if identity.ID == 0 {
+			return utils.StatusNotFound
+		}
+
+		// Don't leave the account without a way to sign in.
+		user := &models.User{}
+		if result := tx.Select("id", "password").First(user, session.ID); result.Error != nil {
+			return result.Error
+		}
+		count := int64(0)
+		result = tx.Model(&models.UserIdentity{}).
+			Where("user_id = ?", session.ID).
+			Count(&count)
+		if result.Error != nil {
+			return result.Error
+		}
+		if user.Password == "" && count <= 1 {
+			return utils.StatusBadRequest
+		}
+
+		return tx.Delete(identity).Error
+	})
+	if err == utils.StatusNotFound {
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+	if err == utils.StatusBadRequest {
+		c.JSON(400, gin.H{
+			"message": "Set a password before removing your last sign in method",
+		})
+		return
+	}
+	if err != nil {
+		log.Error("Error unlinking identity", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "deleted"})
+}
@@ -3,18 +3,16 @@ package auth
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
-	"github.com/juliotorresmoreno/tana-api/db"
-	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
 	"github.com/juliotorresmoreno/tana-api/utils"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
-	"github.com/markbates/goth/providers/google"
 )
 
 type OauthRouter struct {
@@ -26,9 +24,13 @@ type OauthRouter struct {
 
 func SetupOAUTHRoutes(r *gin.RouterGroup) {
 	auth := &OauthRouter{
-		key:    "",
+		key:    os.Getenv("OAUTH_SESSION_KEY"),
 		maxAge: 86400 * 30,
-		isProd: false,
+		isProd: os.Getenv("ENV") == "production",
+	}
+	if auth.key == "" {
+		log.Warn("OAUTH_SESSION_KEY is not set, using a random key")
+		auth.key, _ = utils.GenerateRandomString(64)
 	}
 
 	store := sessions.NewFilesystemStore("/tmp", []byte(auth.key))
@@ -39,15 +41,19 @@ func SetupOAUTHRoutes(r *gin.RouterGroup) {
 
 	gothic.Store = store
 
-	goth.UseProviders(
-		google.New(
-			os.Getenv("GOOGLE_KEY"),
-			os.Getenv("GOOGLE_SECRET"),
-			os.Getenv("CALLBACK_BASE_URL")+"/google/callback",
-		),
-	)
+	m := map[string]string{}
+	providers := []goth.Provider{}
+	for _, config := range LoadProviderConfigs() {
+		provider, err := NewProvider(config, os.Getenv("CALLBACK_BASE_URL"))
+		if err != nil {
+			log.Error("Error setting up oauth provider ", config.Name, ": ", err)
+			continue
+		}
+		providers = append(providers, provider)
+		m[config.Name] = config.DisplayName
+	}
+	goth.UseProviders(providers...)
 
-	m := map[string]string{"google": "Google"}
 	var keys []string
 	for k := range m {
 		keys = append(keys, k)
@@ -60,13 +66,35 @@ func SetupOAUTHRoutes(r *gin.RouterGroup) {
 	r.GET("/:provider/callback", auth.AuthCallback)
 	r.GET("/:provider/logout", auth.Logout)
 	r.GET("/:provider", auth.AuthHandler)
-	r.GET("", auth.Ping)
+	r.GET("", auth.Providers)
 }
 
-func (auth *OauthRouter) Ping(c *gin.Context) {
-	c.JSON(200, gin.H{
-		"message": "ok",
-	})
+type Provider struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	URL         string `json:"url"`
+}
+
+// Providers lists the enabled providers so the frontend can render a sign in
+// button for each one.
+func (auth *OauthRouter) Providers(c *gin.Context) {
+	providers := make([]Provider, 0, len(auth.providerIndex.Providers))
+	for _, name := range auth.providerIndex.Providers {
+		providers = append(providers, Provider{
+			Name:        name,
+			DisplayName: auth.providerIndex.ProvidersMap[name],
+			URL:         os.Getenv("CALLBACK_BASE_URL") + "/" + name,
+		})
+	}
+	c.JSON(200, providers)
+}
+
+func (auth *OauthRouter) enabled(c *gin.Context) bool {
+	if _, ok := auth.providerIndex.ProvidersMap[c.Param("provider")]; !ok {
+		utils.Response(c, utils.StatusNotFound)
+		return false
+	}
+	return true
 }
 
 func (p *OauthRouter) Logout(c *gin.Context) {
@@ -76,6 +104,9 @@ func (p *OauthRouter) Logout(c *gin.Context) {
 }
 
 func (p *OauthRouter) AuthHandler(c *gin.Context) {
+	if !p.enabled(c) {
+		return
+	}
 	provider := c.Param("provider")
 	q := c.Request.URL.Query()
 	q.Add("provider", provider)
@@ -89,6 +120,9 @@ func (p *OauthRouter) AuthHandler(c *gin.Context) {
 }
 
 func (auth *OauthRouter) AuthCallback(c *gin.Context) {
+	if !auth.enabled(c) {
+		return
+	}
 	provider := c.Param("provider")
 	q := c.Request.URL.Query()
 	q.Add("provider", provider)
@@ -104,31 +138,52 @@ func (auth *OauthRouter) AuthCallback(c *gin.Context) {
 }
 
 func complete(c *gin.Context, guser goth.User) {
-	conn := db.DefaultClient
-	user := &models.User{}
-	tx := conn.Find(user, &models.User{Email: guser.Email})
-	if tx.Error != nil {
-		utils.Response(c, utils.StatusInternalServerError)
+	frontend := os.Getenv("FRONTEND_BASE_URL")
+	user, err := resolveIdentity(c, guser)
+	if err != nil {
+		c.Redirect(
+			http.StatusTemporaryRedirect,
+			frontend+"?oauth_error="+url.QueryEscape(err.Error()),
+		)
 		return
 	}
 
-	session, err := utils.MakeSession(user)
+	// TOTP users finish signing in with the challenge, like after a password.
+	challenge, reason, err := afterAuthentication(user)
 	if err != nil {
-		utils.Response(c, err)
+		if reason == "" {
+			reason = "sign_in_failed"
+		}
+		c.Redirect(
+			http.StatusTemporaryRedirect,
+			frontend+"?oauth_error="+url.QueryEscape(reason),
+		)
+		return
+	}
+	if challenge != "" {
+		c.Redirect(
+			http.StatusTemporaryRedirect,
+			frontend+"?two_factor_challenge="+url.QueryEscape(challenge),
+		)
+		return
 	}
 
-	cookie := &http.Cookie{
-		Name:     "token",
-		Value:    session.Token,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		Secure:   false,
-		SameSite: http.SameSiteStrictMode,
+	session, err := utils.MakeSession(c, user)
+	if err != nil {
+		utils.Response(c, err)
+		return
 	}
 
-	http.SetCookie(c.Writer, cookie)
-	c.Redirect(http.StatusTemporaryRedirect, os.Getenv("FRONTEND_BASE_URL"))
+	audit.Record(c, &audit.Event{
+		Action:     "auth.sign_in",
+		ActorID:    user.ID,
+		TargetType: "user",
+		TargetID:   user.ID,
+		After:      gin.H{"email": user.Email, "method": guser.Provider},
+	})
+
+	utils.SetSessionCookie(c, session)
+	c.Redirect(http.StatusTemporaryRedirect, frontend)
 }
 
 type ProviderIndex struct {
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/mailer"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+var passwordResetTTL = time.Hour
+
+// Reset emails to an address are spaced by passwordResetCooldown and an IP
+// can ask for maxPasswordResetsPerIP of them per passwordResetIPWindow, so
+// the endpoint can't be used to flood an inbox.
+var passwordResetCooldown = time.Minute
+var maxPasswordResetsPerIP = 10
+var passwordResetIPWindow = time.Hour
+
+type PasswordErrors struct {
+	Password string `json:"password"`
+}
+
+var invalidPassword = PasswordErrors{
+	Password: "Password does not meet requirements!",
+}
+
+// ChangePassword stores the new password of the user and revokes all of its
+// sessions.
+func ChangePassword(userID uint, password string) error {
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	conn := db.DefaultClient
+	tx := conn.Model(&models.User{}).
+		Where("id = ?", userID).
+		Updates(map[string]interface{}{
+			"password":                hash,
+			"password_reset_required": false,
+		})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	return utils.RevokeUserSessions(userID)
+}
+
+type ForgotPasswordPayload struct {
+	Email string `json:"email"`
+}
+
+func (auth *AuthRouter) ForgotPassword(c *gin.Context) {
+	payload := &ForgotPasswordPayload{}
+	if err := c.ShouldBind(payload); err != nil || payload.Email == "" {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	email := normalizeEmail(payload.Email)
+	allowed, err := allowPasswordReset(email, c.ClientIP())
+	if err != nil {
+		log.Error("Error checking password reset limit", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		utils.Response(c, utils.StatusTooManyRequests)
+		return
+	}
+
+	// The response is the same whether the account exists or not, so this
+	// endpoint can't be used to find out which emails are registered.
+	response := gin.H{"message": "If the account exists, a reset link was sent"}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select("id", "email").
+		Where("LOWER(email) = ?", email).
+		Limit(1).
+		Find(user)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if user.ID == 0 {
+		c.JSON(200, response)
+		return
+	}
+
+	if err := SendPasswordReset(user); err != nil {
+		log.Error("Error sending password reset", err)
+	}
+
+	c.JSON(200, response)
+}
+
+// allowPasswordReset counts the request against the limits of the email and
+// the IP, and reports whether a reset can be sent.
+func allowPasswordReset(email, ip string) (bool, error) {
+	ctx := context.Background()
+	key := "password-reset-ip-" + ip
+	count, err := db.DefaultCache.Incr(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	if count == 1 {
+		db.DefaultCache.Expire(ctx, key, passwordResetIPWindow)
+	}
+	if count > int64(maxPasswordResetsPerIP) {
+		return false, nil
+	}
+	return db.DefaultCache.SetNX(ctx, "password-reset-email-"+email, "1", passwordResetCooldown).Result()
+}
+
+// SendPasswordReset emails the user a single use link to choose a new
+// password.
+func SendPasswordReset(user *models.User) error {
+	token, err := utils.GenerateRandomString(64)
+	if err != nil {
+		return err
+	}
+
+	cmd := db.DefaultCache.Set(
+		context.Background(),
+		"password-reset-"+token,
+		user.ID, passwordResetTTL,
+	)
+	if cmd.Err() != nil {
+		return cmd.Err()
+	}
+
+	return mailer.Send(&mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Use this link to choose a new password: %s/reset-password?token=%s\n\nIt expires in %d minutes.",
+			os.Getenv("FRONTEND_BASE_URL"), token, int(passwordResetTTL.Minutes()),
+		),
+	})
+}
+
+type ResetPasswordPayload struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (auth *AuthRouter) ResetPassword(c *gin.Context) {
+	payload := &ResetPasswordPayload{}
+	if err := c.ShouldBind(payload); err != nil || payload.Token == "" {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	if !IsValidPassword(payload.Password) {
+		c.JSON(http.StatusBadRequest, invalidPassword)
+		return
+	}
+
+	value, err := db.DefaultCache.GetDel(
+		context.Background(),
+		"password-reset-"+payload.Token,
+	).Result()
+	if err == redis.Nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	userID, _ := strconv.Atoi(value)
+	if err := ChangePassword(uint(userID), payload.Password); err != nil {
+		log.Error("Error changing password", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Password updated successfully"})
+}
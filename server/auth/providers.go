@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/gitlab"
+	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/microsoftonline"
+	"github.com/markbates/goth/providers/openidConnect"
+)
+
+// ProviderConfig describes an OAuth provider. Built in providers are read
+// from <NAME>_KEY and <NAME>_SECRET, and are enabled when the key is set.
+// Generic OpenID Connect issuers are listed by name in OIDC_PROVIDERS and
+// configured with OIDC_<NAME>_DISCOVERY_URL, OIDC_<NAME>_CLIENT_ID,
+// OIDC_<NAME>_CLIENT_SECRET, OIDC_<NAME>_SCOPES and OIDC_<NAME>_DISPLAY_NAME.
+type ProviderConfig struct {
+	Name         string
+	DisplayName  string
+	Kind         string
+	Key          string
+	Secret       string
+	BaseURL      string
+	DiscoveryURL string
+	Scopes       []string
+}
+
+var builtinProviders = []ProviderConfig{
+	{Name: "google", DisplayName: "Google", Kind: "google"},
+	{Name: "github", DisplayName: "GitHub", Kind: "github"},
+	{Name: "microsoft", DisplayName: "Microsoft", Kind: "microsoft"},
+	{Name: "gitlab", DisplayName: "GitLab", Kind: "gitlab"},
+}
+
+func LoadProviderConfigs() []ProviderConfig {
+	configs := make([]ProviderConfig, 0)
+
+	for _, config := range builtinProviders {
+		prefix := strings.ToUpper(config.Name)
+		config.Key = os.Getenv(prefix + "_KEY")
+		config.Secret = os.Getenv(prefix + "_SECRET")
+		config.BaseURL = os.Getenv(prefix + "_BASE_URL")
+		config.Scopes = strings.Fields(os.Getenv(prefix + "_SCOPES"))
+		if config.Key != "" {
+			configs = append(configs, config)
+		}
+	}
+
+	for _, name := range strings.Fields(os.Getenv("OIDC_PROVIDERS")) {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		config := ProviderConfig{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "_DISPLAY_NAME"),
+			Kind:         "oidc",
+			Key:          os.Getenv(prefix + "_CLIENT_ID"),
+			Secret:       os.Getenv(prefix + "_CLIENT_SECRET"),
+			DiscoveryURL: os.Getenv(prefix + "_DISCOVERY_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "_SCOPES")),
+		}
+		if config.DisplayName == "" {
+			config.DisplayName = name
+		}
+		configs = append(configs, config)
+	}
+
+	return configs
+}
+
+// NewProvider builds the goth provider for config. Its callback is
+// callbackBaseURL/<name>/callback.
+func NewProvider(config ProviderConfig, callbackBaseURL string) (goth.Provider, error) {
+	callbackURL := callbackBaseURL + "/" + config.Name + "/callback"
+
+	switch config.Kind {
+	case "google":
+		provider := google.New(config.Key, config.Secret, callbackURL, config.Scopes...)
+		provider.SetName(config.Name)
+		return provider, nil
+	case "github":
+		provider := github.New(config.Key, config.Secret, callbackURL, config.Scopes...)
+		provider.SetName(config.Name)
+		return provider, nil
+	case "microsoft":
+		provider := microsoftonline.New(config.Key, config.Secret, callbackURL, config.Scopes...)
+		provider.SetName(config.Name)
+		return provider, nil
+	case "gitlab":
+		var provider *gitlab.Provider
+		if config.BaseURL != "" {
+			baseURL := strings.TrimSuffix(config.BaseURL, "/")
+			provider = gitlab.NewCustomisedURL(
+				config.Key, config.Secret, callbackURL,
+				baseURL+"/oauth/authorize", baseURL+"/oauth/token", baseURL+"/api/v4/user",
+				config.Scopes...,
+			)
+		} else {
+			provider = gitlab.New(config.Key, config.Secret, callbackURL, config.Scopes...)
+		}
+		provider.SetName(config.Name)
+		return provider, nil
+	case "oidc":
+		if config.DiscoveryURL == "" || config.Key == "" {
+			return nil, fmt.Errorf("oidc provider %s needs a discovery url and a client id", config.Name)
+		}
+		scopes := config.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"email", "profile"}
+		}
+		provider, err := openidConnect.NewNamed(
+			config.Name, config.Key, config.Secret, callbackURL, config.DiscoveryURL, scopes...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// NewNamed adds an -oidc suffix, the routes look providers up by name.
+		provider.SetName(config.Name)
+		return provider, nil
+	}
+
+	return nil, fmt.Errorf("unknown provider kind %s", config.Kind)
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+)
+
+// newOIDCServer stands in for an OpenID Connect issuer that signs in the
+// subject "user-1" with the authorization code "code-1".
+func newOIDCServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"userinfo_endpoint":      server.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, secret, _ := r.BasicAuth()
+		if clientID == "" {
+			clientID, secret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+		}
+		if r.Form.Get("code") != "code-1" || clientID != "client-1" || secret != "secret-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   server.URL,
+			"aud":   "client-1",
+			"sub":   "user-1",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"email": "ana@example.com",
+			"name":  "Ana Pérez",
+		})
+		encoding := base64.RawURLEncoding
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-1",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token": encoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+				encoding.EncodeToString(claims) + ".",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":            "user-1",
+			"email_verified": true,
+		})
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLoadOIDCProviderConfig(t *testing.T) {
+	t.Setenv("OIDC_PROVIDERS", "Acme-SSO")
+	t.Setenv("OIDC_ACME_SSO_DISCOVERY_URL", "https://sso.example.com/.well-known/openid-configuration")
+	t.Setenv("OIDC_ACME_SSO_CLIENT_ID", "client-1")
+	t.Setenv("OIDC_ACME_SSO_CLIENT_SECRET", "secret-1")
+	t.Setenv("OIDC_ACME_SSO_SCOPES", "email profile groups")
+
+	var config *ProviderConfig
+	for _, loaded := range LoadProviderConfigs() {
+		if loaded.Name == "acme-sso" {
+			loaded := loaded
+			config = &loaded
+		}
+	}
+	if config == nil {
+		t.Fatal("acme-sso was not loaded")
+	}
+	if config.Kind != "oidc" || config.Key != "client-1" || config.Secret != "secret-1" {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.DisplayName != "acme-sso" || len(config.Scopes) != 3 {
+		t.Errorf("unexpected config %+v", config)
+	}
+}
+
+func TestOIDCProviderRequiresDiscoveryURL(t *testing.T) {
+	_, err := NewProvider(ProviderConfig{Name: "acme", Kind: "oidc", Key: "client-1"}, "http://api.test/oauth")
+	if err == nil {
+		t.Fatal("expected an error without a discovery url")
+	}
+}
+
+func TestOIDCProviderCallback(t *testing.T) {
+	server := newOIDCServer(t)
+	t.Setenv("OIDC_PROVIDERS", "acme")
+	t.Setenv("OIDC_ACME_DISCOVERY_URL", server.URL+"/.well-known/openid-configuration")
+	t.Setenv("OIDC_ACME_CLIENT_ID", "client-1")
+	t.Setenv("OIDC_ACME_CLIENT_SECRET", "secret-1")
+
+	var provider goth.Provider
+	for _, config := range LoadProviderConfigs() {
+		if config.Name != "acme" {
+			continue
+		}
+		var err error
+		provider, err = NewProvider(config, "http://api.test/oauth")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if provider == nil {
+		t.Fatal("acme was not loaded")
+	}
+	goth.UseProviders(provider)
+	t.Cleanup(goth.ClearProviders)
+
+	store := gothic.Store
+	gothic.Store = sessions.NewCookieStore([]byte("test-session-key"))
+	t.Cleanup(func() { gothic.Store = store })
+
+	// The sign in redirects to the issuer with the callback of the provider.
+	begin := httptest.NewRecorder()
+	gothic.BeginAuthHandler(begin, httptest.NewRequest(http.MethodGet, "/oauth/acme?provider=acme", nil))
+	if begin.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("begin status = %d: %s", begin.Code, begin.Body)
+	}
+	authURL, err := url.Parse(begin.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authURL.Host != httptestHost(server) || authURL.Path != "/authorize" {
+		t.Errorf("auth url = %v", authURL)
+	}
+	query := authURL.Query()
+	if query.Get("client_id") != "client-1" || query.Get("redirect_uri") != "http://api.test/oauth/acme/callback" {
+		t.Errorf("unexpected auth params %v", query)
+	}
+
+	// The issuer sends the user back with the code and the state.
+	callback := httptest.NewRequest(
+		http.MethodGet,
+		"/oauth/acme/callback?provider=acme&code=code-1&state="+url.QueryEscape(query.Get("state")),
+		nil,
+	)
+	for _, cookie := range begin.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	guser, err := gothic.CompleteUserAuth(httptest.NewRecorder(), callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guser.Provider != "acme" || guser.UserID != "user-1" || guser.Email != "ana@example.com" {
+		t.Errorf("unexpected user %+v", guser)
+	}
+	if guser.AccessToken != "access-1" || !emailVerified(guser) {
+		t.Errorf("unexpected user %+v", guser)
+	}
+}
+
+func httptestHost(server *httptest.Server) string {
+	serverURL, _ := url.Parse(server.URL)
+	return serverURL.Host
+}
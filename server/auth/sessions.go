@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+func (auth *AuthRouter) Logout(c *gin.Context) {
+	token, _ := utils.GetToken(c)
+	if err := utils.RevokeSession(token); err != nil {
+		log.Error("Error revoking session", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	utils.ClearSessionCookie(c)
+	c.JSON(200, gin.H{"message": "Logged out"})
+}
+
+func (auth *AuthRouter) LogoutEverywhere(c *gin.Context) {
+	session := middlewares.GetUser(c)
+	if err := utils.RevokeUserSessions(session.ID); err != nil {
+		log.Error("Error revoking sessions", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	utils.ClearSessionCookie(c)
+	c.JSON(200, gin.H{"message": "Logged out from every device"})
+}
+
+func (auth *AuthRouter) Sessions(c *gin.Context) {
+	session := middlewares.GetUser(c)
+	token, _ := utils.GetToken(c)
+
+	sessions, err := utils.ListSessions(session.ID, token)
+	if err != nil {
+		log.Error("Error listing sessions", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, sessions)
+}
+
+func (auth *AuthRouter) RevokeSession(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	err := utils.RevokeSessionByID(session.ID, c.Param("id"))
+	if err == utils.StatusNotFound {
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Error revoking session", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "deleted"})
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// Failed sign ins are counted in a sliding window per email and per IP.
+// After delayAfterFailures failures every new attempt has to wait twice as
+// long as the previous one, up to maxDelay, and reaching the max failures
+// locks the email or IP out for lockoutDuration.
+var signInWindow = 15 * time.Minute
+var delayAfterFailures = 3
+var maxDelay = time.Minute
+var maxEmailFailures = 10
+var maxIPFailures = 50
+var lockoutDuration = 15 * time.Minute
+
+type throttleSubject struct {
+	kind        string
+	value       string
+	maxFailures int
+}
+
+func throttleSubjects(email, ip string) []throttleSubject {
+	return []throttleSubject{
+		{kind: "email", value: normalizeEmail(email), maxFailures: maxEmailFailures},
+		{kind: "ip", value: ip, maxFailures: maxIPFailures},
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (s throttleSubject) failuresKey() string {
+	return "signin-failures-" + s.kind + "-" + s.value
+}
+
+func (s throttleSubject) lockKey() string {
+	return "signin-lock-" + s.kind + "-" + s.value
+}
+
+type Throttled struct {
+	Message    string    `json:"message"`
+	Locked     bool      `json:"locked"`
+	RetryAfter int       `json:"retry_after"`
+	RetryAt    time.Time `json:"retry_at"`
+}
+
+// checkSignIn returns a non nil Throttled when the email or the IP has to
+// wait before trying again.
+func checkSignIn(email, ip string) (*Throttled, error) {
+	ctx := context.Background()
+	now := time.Now()
+
+	var throttled *Throttled
+	for _, subject := range throttleSubjects(email, ip) {
+		ttl, err := db.DefaultCache.PTTL(ctx, subject.lockKey()).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			throttled = longestWait(throttled, &Throttled{
+				Message: "Too many failed sign in attempts, try again later",
+				Locked:  true,
+				RetryAt: now.Add(ttl),
+			})
+			continue
+		}
+
+		key := subject.failuresKey()
+		min := strconv.FormatInt(now.Add(-signInWindow).UnixNano(), 10)
+		if err := db.DefaultCache.ZRemRangeByScore(ctx, key, "-inf", min).Err(); err != nil {
+			return nil, err
+		}
+		failures, err := db.DefaultCache.ZRevRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(failures) < delayAfterFailures {
+			continue
+		}
+
+		exponent := float64(len(failures) - delayAfterFailures)
+		delay := time.Duration(math.Min(math.Pow(2, exponent), maxDelay.Seconds())) * time.Second
+		retryAt := time.Unix(0, int64(failures[0].Score)).Add(delay)
+		if retryAt.After(now) {
+			throttled = longestWait(throttled, &Throttled{
+				Message: "Too many failed sign in attempts, wait before trying again",
+				RetryAt: retryAt,
+			})
+		}
+	}
+
+	if throttled != nil {
+		throttled.RetryAfter = int(math.Ceil(time.Until(throttled.RetryAt).Seconds()))
+	}
+	return throttled, nil
+}
+
+func longestWait(a, b *Throttled) *Throttled {
+	if a == nil || b.RetryAt.After(a.RetryAt) {
+		return b
+	}
+	return a
+}
+
+func recordSignInFailure(email, ip string) error {
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, subject := range throttleSubjects(email, ip) {
+		key := subject.failuresKey()
+		err := db.DefaultCache.ZAdd(ctx, key, redis.Z{
+			Score:  float64(now.UnixNano()),
+			Member: now.UnixNano(),
+		}).Err()
+		if err != nil {
+			return err
+		}
+		db.DefaultCache.Expire(ctx, key, signInWindow)
+
+		count, err := db.DefaultCache.ZCard(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if int(count) >= subject.maxFailures {
+			db.DefaultCache.Set(ctx, subject.lockKey(), now.Unix(), lockoutDuration)
+			db.DefaultCache.Del(ctx, key)
+		}
+	}
+	return nil
+}
+
+func clearSignInFailures(email string) error {
+	subject := throttleSubjects(email, "")[0]
+	return db.DefaultCache.Del(context.Background(), subject.failuresKey()).Err()
+}
+
+func recordSignInAttempt(c *gin.Context, email string, userID uint, success bool, reason string) {
+	attempt := &models.SignInAttempt{
+		Email:     normalizeEmail(email),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Success:   success,
+		Reason:    reason,
+	}
+	if userID != 0 {
+		attempt.UserId = &userID
+	}
+
+	tx := db.DefaultClient.Create(attempt)
+	if tx.Error != nil {
+		log.Error("Error recording sign in attempt", tx.Error)
+	}
+
+	// Password sign ins waiting for a second factor are audited once the
+	// second factor is checked.
+	if success && reason != "" {
+		return
+	}
+	event := &audit.Event{
+		Action:     "auth.sign_in",
+		ActorID:    userID,
+		TargetType: "user",
+		TargetID:   userID,
+		After:      gin.H{"email": attempt.Email, "method": "password"},
+	}
+	if !success {
+		// Whoever failed isn't known to be the user, so there is no actor.
+		event.Action = "auth.sign_in_failed"
+		event.ActorID = 0
+		event.After = gin.H{"email": attempt.Email, "reason": reason}
+	}
+	audit.Record(c, event)
+}
+
+func respondThrottled(c *gin.Context, throttled *Throttled) {
+	c.Header("Retry-After", fmt.Sprint(throttled.RetryAfter))
+	c.JSON(http.StatusTooManyRequests, throttled)
+}
+
+type SignInAttempt struct {
+	ID         uint      `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Success    bool      `json:"success"`
+	Reason     string    `json:"reason"`
+	CreationAt time.Time `json:"creation_at"`
+}
+
+func (auth *AuthRouter) SignInAttempts(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	attempts := make([]SignInAttempt, 0)
+	tx := db.DefaultClient.Model(&models.SignInAttempt{}).
+		Where("user_id = ? OR email = ?", session.ID, normalizeEmail(session.Email)).
+		Order("creation_at desc").
+		Limit(100).
+		Find(&attempts)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, attempts)
+}
+
+// ClearLockout lets admins lift the lockout and failure count of an email
+// and/or an IP, given as query parameters.
+func (auth *AuthRouter) ClearLockout(c *gin.Context) {
+	email := c.Query("email")
+	ip := c.Query("ip")
+	if email == "" && ip == "" {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	keys := []string{}
+	for _, subject := range throttleSubjects(email, ip) {
+		if subject.value == "" {
+			continue
+		}
+		keys = append(keys, subject.lockKey(), subject.failuresKey())
+	}
+
+	if err := db.DefaultCache.Del(context.Background(), keys...).Err(); err != nil {
+		log.Error(err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Lockout cleared"})
+}
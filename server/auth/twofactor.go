@@ -0,0 +1,413 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+var challengeTTL = 5 * time.Minute
+var maxChallengeAttempts = 5
+var recoveryCodesCount = 10
+
+func challengeKey(challenge string) string {
+	return "2fa-challenge-" + challenge
+}
+
+// makeChallenge stores a short lived token that proves the password step of
+// the sign in succeeded for the user.
+func makeChallenge(user *models.User) (string, error) {
+	challenge, err := utils.GenerateRandomString(64)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	key := challengeKey(challenge)
+	if err := db.DefaultCache.HSet(ctx, key, "user_id", user.ID, "attempts", 0).Err(); err != nil {
+		return "", err
+	}
+	if err := db.DefaultCache.Expire(ctx, key, challengeTTL).Err(); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// verifyTOTP checks the code against the encrypted secret of the user and
+// rejects codes that were already used.
+func verifyTOTP(user *models.User, code string) bool {
+	secret, err := utils.Decrypt(user.TOTPSecret)
+	if err != nil {
+		log.Error("Error decrypting two factor secret", err)
+		return false
+	}
+	step, ok := utils.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return false
+	}
+
+	used, err := db.DefaultCache.SetNX(
+		context.Background(),
+		fmt.Sprintf("totp-used-%v-%v", user.ID, step),
+		"1", 3*time.Minute,
+	).Result()
+	return err == nil && used
+}
+
+func useRecoveryCode(userID uint, code string) (bool, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return false, nil
+	}
+
+	conn := db.DefaultClient
+	codes := make([]*models.RecoveryCode, 0)
+	tx := conn.Where("user_id = ? AND used_at IS NULL", userID).Find(&codes)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+
+	for _, recoveryCode := range codes {
+		ok, _ := utils.ComparePassword(code, recoveryCode.CodeHash)
+		if !ok {
+			continue
+		}
+		tx := conn.Model(recoveryCode).
+			Where("used_at IS NULL").
+			Update("used_at", time.Now())
+		if tx.Error != nil {
+			return false, tx.Error
+		}
+		return tx.RowsAffected == 1, nil
+	}
+	return false, nil
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user and returns
+// the new ones in plaintext; only their hashes are stored.
+func generateRecoveryCodes(userID uint) ([]string, error) {
+	conn := db.DefaultClient
+	tx := conn.Where("user_id = ?", userID).Delete(&models.RecoveryCode{})
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	codes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := utils.GenerateCode(10)
+		if err != nil {
+			return nil, err
+		}
+		code = code[:5] + "-" + code[5:]
+
+		hash, err := utils.HashPassword(code)
+		if err != nil {
+			return nil, err
+		}
+		tx := conn.Create(&models.RecoveryCode{UserId: userID, CodeHash: hash})
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+type EnrollTwoFactorPayload struct {
+	Password string `json:"password"`
+}
+
+// EnrollTwoFactor asks for the password, like disabling does, so a stolen
+// session can't bind another authenticator to the account.
+func (auth *AuthRouter) EnrollTwoFactor(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &EnrollTwoFactorPayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select("id", "email", "password", "totp_enabled").First(user, session.ID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	ok, err := utils.ComparePassword(payload.Password, user.Password)
+	if !ok || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"password": "Password incorrect"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two factor authentication already enabled"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	encrypted, err := utils.Encrypt(secret)
+	if err != nil {
+		log.Error("Error encrypting two factor secret", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	tx = conn.Model(user).Update("totp_secret", encrypted)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "Tana"
+	}
+	c.JSON(200, gin.H{
+		"secret": secret,
+		"uri":    utils.TOTPURI(issuer, user.Email, secret),
+	})
+}
+
+type TwoFactorCodePayload struct {
+	Code string `json:"code"`
+}
+
+type ConfirmTwoFactorPayload struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+func (auth *AuthRouter) ConfirmTwoFactor(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &ConfirmTwoFactorPayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select("id", "password", "totp_secret", "totp_enabled").First(user, session.ID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	ok, err := utils.ComparePassword(payload.Password, user.Password)
+	if !ok || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"password": "Password incorrect"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Two factor authentication already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" || !verifyTOTP(user, payload.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "Invalid code"})
+		return
+	}
+
+	tx = conn.Model(user).Update("totp_enabled", true)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		log.Error("Error generating recovery codes", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+func (auth *AuthRouter) RegenerateRecoveryCodes(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &TwoFactorCodePayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select("id", "totp_secret", "totp_enabled").First(user, session.ID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if !user.TOTPEnabled || !verifyTOTP(user, payload.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "Invalid code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		log.Error("Error generating recovery codes", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+type DisableTwoFactorPayload struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+func (auth *AuthRouter) DisableTwoFactor(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &DisableTwoFactorPayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select("id", "password", "totp_secret", "totp_enabled").First(user, session.ID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	ok, err := utils.ComparePassword(payload.Password, user.Password)
+	if !ok || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"password": "Password incorrect"})
+		return
+	}
+	if !user.TOTPEnabled || !verifyTOTP(user, payload.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "Invalid code"})
+		return
+	}
+
+	tx = conn.Model(user).
+		Select("totp_secret", "totp_enabled").
+		Updates(&models.User{})
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	tx = conn.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{})
+	if tx.Error != nil {
+		log.Error(tx.Error)
+	}
+
+	c.JSON(200, gin.H{"message": "Two factor authentication disabled"})
+}
+
+type SignInTwoFactorPayload struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (auth *AuthRouter) SignInTwoFactor(c *gin.Context) {
+	payload := &SignInTwoFactorPayload{}
+	if err := c.ShouldBind(payload); err != nil || payload.Challenge == "" {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	key := challengeKey(payload.Challenge)
+	userID, err := db.DefaultCache.HGet(ctx, key, "user_id").Result()
+	if err != nil || userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid or expired challenge"})
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select(utils.SessionFields, "totp_secret", "totp_enabled").
+		First(user, "id = ? AND deleted_at IS NULL AND suspended_at IS NULL", userID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusUnauthorized)
+		return
+	}
+
+	// Codes are guessed like passwords, so they share the throttle.
+	throttled, err := checkSignIn(user.Email, c.ClientIP())
+	if err != nil {
+		log.Error("Error checking sign in throttle", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if throttled != nil {
+		recordSignInAttempt(c, user.Email, user.ID, false, "throttled")
+		respondThrottled(c, throttled)
+		return
+	}
+
+	ok := false
+	if payload.RecoveryCode != "" {
+		ok, err = useRecoveryCode(user.ID, payload.RecoveryCode)
+		if err != nil {
+			log.Error("Error using recovery code", err)
+			utils.Response(c, utils.StatusInternalServerError)
+			return
+		}
+	} else {
+		ok = verifyTOTP(user, payload.Code)
+	}
+
+	if !ok {
+		attempts, _ := db.DefaultCache.HIncrBy(ctx, key, "attempts", 1).Result()
+		if int(attempts) >= maxChallengeAttempts {
+			db.DefaultCache.Del(ctx, key)
+		}
+		recordSignInFailure(user.Email, c.ClientIP())
+		recordSignInAttempt(c, user.Email, user.ID, false, "invalid_two_factor_code")
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid code"})
+		return
+	}
+
+	// Only one request can consume the challenge.
+	deleted, err := db.DefaultCache.Del(ctx, key).Result()
+	if err != nil || deleted == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid or expired challenge"})
+		return
+	}
+
+	if err := clearSignInFailures(user.Email); err != nil {
+		log.Error("Error clearing sign in failures", err)
+	}
+
+	session, err := utils.MakeSession(c, user)
+	if err != nil {
+		utils.Response(c, err)
+		return
+	}
+
+	recordSignInAttempt(c, user.Email, user.ID, true, "")
+	utils.SetSessionCookie(c, session)
+
+	c.JSON(200, session.User)
+}
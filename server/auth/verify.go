@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/mailer"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+)
+
+var validationCodeLength = 6
+var validationCodeTTL = 30 * time.Minute
+var maxValidationAttempts = 5
+var resendCooldown = time.Minute
+
+// SendValidationCode stores a new validation code for the user and emails it.
+func SendValidationCode(user *models.User) error {
+	code, err := utils.GenerateCode(validationCodeLength)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(validationCodeTTL)
+	user.ValidationCode = code
+	user.ValidationCodeExpiresAt = &expiresAt
+	user.ValidationAttempts = 0
+
+	conn := db.DefaultClient
+	tx := conn.Model(user).
+		Select("validation_code", "validation_code_expires_at", "validation_attempts").
+		Updates(user)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	return mailer.Send(&mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Your verification code is %s. It expires in %d minutes.",
+			code, int(validationCodeTTL.Minutes()),
+		),
+	})
+}
+
+type VerifyPayload struct {
+	Code string `json:"code"`
+}
+
+func (auth *AuthRouter) Verify(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &VerifyPayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.First(user, session.ID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	if user.Verified {
+		c.JSON(200, gin.H{"message": "Email already verified"})
+		return
+	}
+
+	if user.ValidationCode == "" ||
+		user.ValidationCodeExpiresAt == nil ||
+		time.Now().After(*user.ValidationCodeExpiresAt) ||
+		user.ValidationAttempts >= maxValidationAttempts {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Verification code expired, request a new one",
+		})
+		return
+	}
+
+	// Every guess takes an attempt before the code is compared, so parallel
+	// guesses can't go past the limit.
+	tx = conn.Model(user).
+		Where("validation_attempts < ?", maxValidationAttempts).
+		Update("validation_attempts", gorm.Expr("validation_attempts + 1"))
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Verification code expired, request a new one",
+		})
+		return
+	}
+
+	if strings.ToUpper(strings.TrimSpace(payload.Code)) != user.ValidationCode {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message":            "Invalid verification code",
+			"attempts_remaining": maxValidationAttempts - user.ValidationAttempts - 1,
+		})
+		return
+	}
+
+	tx = conn.Model(user).
+		Select("verified", "validation_code", "validation_code_expires_at", "validation_attempts").
+		Updates(&models.User{Verified: true})
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Email verified"})
+}
+
+func (auth *AuthRouter) ResendVerification(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.First(user, session.ID)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	if user.Verified {
+		c.JSON(200, gin.H{"message": "Email already verified"})
+		return
+	}
+
+	cmd := db.DefaultCache.SetNX(
+		context.Background(),
+		fmt.Sprintf("verify-resend-%v", user.ID),
+		"1", resendCooldown,
+	)
+	if cmd.Err() != nil {
+		log.Error(cmd.Err())
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if !cmd.Val() {
+		utils.Response(c, utils.StatusTooManyRequests)
+		return
+	}
+
+	if err := SendValidationCode(user); err != nil {
+		log.Error("Error sending validation code", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Verification code sent"})
+}
@@ -9,7 +9,9 @@ import (
 	"github.com/go-playground/validator"
 	"github.com/juliotorresmoreno/tana-api/db"
 	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
 	"github.com/juliotorresmoreno/tana-api/utils"
 )
 
@@ -44,6 +46,7 @@ type Connection struct {
 	Description string     `json:"description" validate:"max=256"`
 	PhotoURL    string     `json:"photo_url" validate:"url,max=1000"`
 	MmluId      uint       `json:"mmlu_id"`
+	MmluVersion *int       `json:"mmlu_version" validate:"omitempty,min=0"`
 	Mmlu        Mmlu       `json:"mmlu"`
 	CreationAt  time.Time  `json:"creation_at"`
 	UpdatedAt   time.Time  `json:"updated_at"`
@@ -51,21 +54,15 @@ type Connection struct {
 }
 
 func (h *ConnectionsRouter) findOne(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 	connection := &Connection{}
 
 	tx := conn.Table(tablename).
 		Where("id = ?", c.Param("id")).
-		Where(&models.Connection{
-			OwnerId: session.ID,
-		}).First(connection)
+		Scopes(utils.OwnedBy(session)).
+		First(connection)
 	if tx.Error != nil {
 		log.Error(tx.Error)
 		c.JSON(404, gin.H{"message": "Not found"})
@@ -76,20 +73,14 @@ func (h *ConnectionsRouter) findOne(c *gin.Context) {
 }
 
 func (h *ConnectionsRouter) find(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 	connections := &[]Connection{}
 
 	tx := conn.Table(tablename).
-		Where(&models.Connection{
-			OwnerId: session.ID,
-		}).Find(connections)
+		Scopes(utils.OwnedBy(session)).
+		Find(connections)
 	if tx.Error != nil {
 		log.Error(tx.Error)
 		utils.Response(c, utils.StatusInternalServerError)
@@ -103,20 +94,16 @@ type ConnectionValidationErrors struct {
 	Name        string `json:"name,omitempty"`
 	Description string `json:"description,omitempty"`
 	PhotoURL    string `json:"photo_url,omitempty"`
+	MmluVersion string `json:"mmlu_version,omitempty"`
 }
 
 func (h *ConnectionsRouter) create(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 	payload := &Connection{}
 
-	err = c.ShouldBind(payload)
+	err := c.ShouldBind(payload)
 	if err != nil {
 		log.Error("Error binding payload", err)
 		utils.Response(c, utils.StatusBadRequest)
@@ -128,7 +115,9 @@ func (h *ConnectionsRouter) create(c *gin.Context) {
 		Description: payload.Description,
 		PhotoURL:    payload.PhotoURL,
 		OwnerId:     session.ID,
+		WorkspaceId: session.Workspace(),
 		MmluId:      payload.MmluId,
+		MmluVersion: pinned(payload.MmluVersion),
 	}
 
 	validate := validator.New()
@@ -155,6 +144,7 @@ func (h *ConnectionsRouter) create(c *gin.Context) {
 			Name:        errorsMap["Name"],
 			PhotoURL:    errorsMap["PhotoURL"],
 			Description: errorsMap["Description"],
+			MmluVersion: errorsMap["MmluVersion"],
 		}
 
 		log.Error("Error validating user input", customErrors)
@@ -162,6 +152,13 @@ func (h *ConnectionsRouter) create(c *gin.Context) {
 		return
 	}
 
+	if !mmluAvailable(c, session, payload.MmluId) {
+		return
+	}
+	if !versionAvailable(c, payload.MmluId, connection.MmluVersion) {
+		return
+	}
+
 	tx := conn.Create(connection)
 	if tx.Error != nil {
 		log.Error(tx.Error)
@@ -169,21 +166,23 @@ func (h *ConnectionsRouter) create(c *gin.Context) {
 		return
 	}
 
+	audit.Record(c, &audit.Event{
+		Action:     "connection.create",
+		TargetType: "connection",
+		TargetID:   connection.ID,
+		After:      snapshot(connection),
+	})
+
 	c.JSON(200, gin.H{"message": "create connection"})
 }
 
 func (h *ConnectionsRouter) update(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 	payload := &Connection{}
 
-	err = c.ShouldBind(payload)
+	err := c.ShouldBind(payload)
 	if err != nil {
 		log.Error("Error binding payload", err)
 		utils.Response(c, utils.StatusBadRequest)
@@ -194,7 +193,6 @@ func (h *ConnectionsRouter) update(c *gin.Context) {
 		Name:        payload.Name,
 		Description: payload.Description,
 		PhotoURL:    payload.PhotoURL,
-		OwnerId:     session.ID,
 		MmluId:      payload.MmluId,
 	}
 
@@ -222,6 +220,7 @@ func (h *ConnectionsRouter) update(c *gin.Context) {
 			Name:        errorsMap["Name"],
 			PhotoURL:    errorsMap["PhotoURL"],
 			Description: errorsMap["Description"],
+			MmluVersion: errorsMap["MmluVersion"],
 		}
 
 		log.Error("Error validating user input", customErrors)
@@ -229,38 +228,165 @@ func (h *ConnectionsRouter) update(c *gin.Context) {
 		return
 	}
 
-	id, _ := strconv.Atoi(c.Param("id"))
-	tx := conn.Where(&models.Connection{
-		ID:      uint(id),
-		OwnerId: session.ID,
-	}).Updates(connection)
+	if payload.MmluId != 0 && !mmluAvailable(c, session, payload.MmluId) {
+		return
+	}
+
+	before, ok := findConnection(c, session)
+	if !ok {
+		return
+	}
+
+	mmluId := before.MmluId
+	if payload.MmluId != 0 {
+		mmluId = payload.MmluId
+	}
+	if !versionAvailable(c, mmluId, pinned(payload.MmluVersion)) {
+		return
+	}
+
+	tx := conn.Where("id = ?", before.ID).
+		Scopes(utils.OwnedBy(session)).
+		Updates(connection)
 	if tx.Error != nil {
 		log.Error(tx.Error)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	// A pin only makes sense for the mmlu it was taken from, so changing the
+	// mmlu without a new pin follows its latest version.
+	if payload.MmluVersion != nil || mmluId != before.MmluId {
+		tx = conn.Model(&models.Connection{}).
+			Where("id = ?", before.ID).
+			Update("mmlu_version", pinned(payload.MmluVersion))
+		if tx.Error != nil {
+			log.Error(tx.Error)
+			utils.Response(c, utils.StatusInternalServerError)
+			return
+		}
+	}
+
+	after, ok := findConnection(c, session)
+	if !ok {
+		return
+	}
+	audit.Record(c, &audit.Event{
+		Action:     "connection.update",
+		TargetType: "connection",
+		TargetID:   before.ID,
+		Before:     snapshot(before),
+		After:      snapshot(after),
+	})
+
 	c.JSON(200, gin.H{"message": "update connection"})
 }
 
 func (h *ConnectionsRouter) delete(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
+	session := middlewares.GetUser(c)
+
+	connection, ok := findConnection(c, session)
+	if !ok {
 		return
 	}
 
 	conn := db.DefaultClient
-	id, _ := strconv.Atoi(c.Param("id"))
-	tx := conn.Where(&models.Connection{
-		OwnerId: session.ID,
-	}).Delete(&models.Connection{}, uint(id))
+	tx := conn.Scopes(utils.OwnedBy(session)).
+		Delete(&models.Connection{}, connection.ID)
 	if tx.Error != nil {
 		log.Error(tx.Error)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	audit.Record(c, &audit.Event{
+		Action:     "connection.delete",
+		TargetType: "connection",
+		TargetID:   connection.ID,
+		Before:     snapshot(connection),
+	})
+
 	c.JSON(200, gin.H{"message": "delete connection"})
 }
+
+// mmluAvailable checks that the connection points to an mmlu of the same
+// workspace, or personal space, as the connection itself.
+func mmluAvailable(c *gin.Context, session *utils.User, mmluId uint) bool {
+	count := int64(0)
+	tx := db.DefaultClient.Model(&models.Mmlu{}).
+		Where("id = ? AND deleted_at IS NULL", mmluId).
+		Scopes(utils.OwnedBy(session)).
+		Count(&count)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return false
+	}
+	if count == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"mmlu_id": "Mmlu not found!"})
+		return false
+	}
+	return true
+}
+
+// pinned is the version a connection is pinned to. A zero mmlu_version
+// follows the latest version.
+func pinned(version *int) *int {
+	if version == nil || *version == 0 {
+		return nil
+	}
+	return version
+}
+
+// versionAvailable checks that the pinned version exists.
+func versionAvailable(c *gin.Context, mmluId uint, version *int) bool {
+	if version == nil {
+		return true
+	}
+	count := int64(0)
+	tx := db.DefaultClient.Model(&models.MmluVersion{}).
+		Where("mmlu_id = ? AND version = ?", mmluId, *version).
+		Count(&count)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return false
+	}
+	if count == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"mmlu_version": "Version not found!"})
+		return false
+	}
+	return true
+}
+
+// findConnection loads the connection of the id param, responding with a 404
+// if the user can't reach it.
+func findConnection(c *gin.Context, session *utils.User) (*models.Connection, bool) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	connection := &models.Connection{}
+	tx := db.DefaultClient.Scopes(utils.OwnedBy(session)).
+		Where("id = ?", id).
+		Limit(1).
+		Find(connection)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if connection.ID == 0 {
+		c.JSON(404, gin.H{"message": "Not found"})
+		return nil, false
+	}
+	return connection, true
+}
+
+// snapshot is what the audit log keeps of a connection.
+func snapshot(connection *models.Connection) gin.H {
+	return gin.H{
+		"name":         connection.Name,
+		"description":  connection.Description,
+		"photo_url":    connection.PhotoURL,
+		"mmlu_id":      connection.MmluId,
+		"mmlu_version": connection.MmluVersion,
+	}
+}
@@ -0,0 +1,65 @@
+package conversation
+
+import (
+	"context"
+	"time"
+
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+// historyLength is how many of the latest turns of the conversation are sent
+// with every generation, from CONVERSATION_HISTORY.
+func historyLength() int {
+	return utils.IntFromEnv("CONVERSATION_HISTORY", 50)
+}
+
+// Message is a turn of a conversation as the API returns it.
+type Message struct {
+	ID         uint      `json:"id"`
+	Role       string    `json:"role"`
+	Content    string    `json:"content"`
+	CreationAt time.Time `json:"creation_at"`
+}
+
+func newMessage(message *models.ConversationMessage) *Message {
+	return &Message{
+		ID:         message.ID,
+		Role:       message.Role,
+		Content:    message.Content,
+		CreationAt: message.CreationAt,
+	}
+}
+
+// history returns the latest turns of the conversation of the user with the
+// connection, oldest first. A negative limit returns all of them.
+func history(ctx context.Context, userID, connectionID uint, limit int) ([]*models.ConversationMessage, error) {
+	messages := make([]*models.ConversationMessage, 0)
+	tx := db.DefaultClient.WithContext(ctx).
+		Where("user_id = ? AND connection_id = ?", userID, connectionID).
+		Order("id DESC").
+		Limit(limit).
+		Find(&messages)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// chatMessages builds what the model is sent: the system prompt, the history
+// of the conversation and the prompt of the user.
+func chatMessages(systemPrompt string, turns []*models.ConversationMessage, prompt string) []providers.Message {
+	messages := make([]providers.Message, 0, len(turns)+2)
+	if systemPrompt != "" {
+		messages = append(messages, providers.Message{Role: providers.RoleSystem, Content: systemPrompt})
+	}
+	for _, turn := range turns {
+		messages = append(messages, providers.Message{Role: turn.Role, Content: turn.Content})
+	}
+	return append(messages, providers.Message{Role: providers.RoleUser, Content: prompt})
+}
@@ -0,0 +1,59 @@
+package conversation
+
+import (
+	"testing"
+
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/providers"
+)
+
+func TestChatMessages(t *testing.T) {
+	turns := []*models.ConversationMessage{
+		{Role: providers.RoleSystem, Content: "Attachment precios.pdf:\n\ncuesta 5"},
+		{Role: providers.RoleUser, Content: "Hola"},
+		{Role: providers.RoleAssistant, Content: "¿En qué te ayudo?"},
+	}
+	messages := chatMessages("Sé breve.", turns, "¿Cuánto cuesta?")
+	if len(messages) != 5 {
+		t.Fatalf("messages = %+v", messages)
+	}
+	if messages[0] != (providers.Message{Role: providers.RoleSystem, Content: "Sé breve."}) {
+		t.Errorf("first message = %+v", messages[0])
+	}
+	if messages[3].Role != providers.RoleAssistant || messages[3].Content != "¿En qué te ayudo?" {
+		t.Errorf("history out of order: %+v", messages)
+	}
+	if messages[4] != (providers.Message{Role: providers.RoleUser, Content: "¿Cuánto cuesta?"}) {
+		t.Errorf("last message = %+v", messages[4])
+	}
+
+	if messages := chatMessages("", nil, "Hola"); len(messages) != 1 || messages[0].Role != providers.RoleUser {
+		t.Errorf("messages without system prompt = %+v", messages)
+	}
+}
+
+func TestGenerationOptions(t *testing.T) {
+	temperature := 0.3
+	options := generationOptions(&models.Mmlu{
+		Temperature:    &temperature,
+		MaxTokens:      64,
+		Stop:           models.JSONList{"###"},
+		ContextWindow:  4096,
+		ResponseFormat: models.ResponseFormatText,
+		ResponseSchema: models.JSON(`{"type":"object"}`),
+	})
+	if options.Temperature != &temperature || options.MaxTokens != 64 || options.ContextWindow != 4096 {
+		t.Errorf("unexpected options %+v", options)
+	}
+	if len(options.Stop) != 1 || options.Schema != nil {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	options = generationOptions(&models.Mmlu{
+		ResponseFormat: models.ResponseFormatJSONSchema,
+		ResponseSchema: models.JSON(`{"type":"object"}`),
+	})
+	if string(options.Schema) != `{"type":"object"}` {
+		t.Errorf("schema = %s", options.Schema)
+	}
+}
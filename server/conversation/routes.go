@@ -1,66 +1,55 @@
 package conversation
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/knowledge"
 	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"github.com/juliotorresmoreno/tana-api/queue"
+	"github.com/juliotorresmoreno/tana-api/server/mmlu"
+	"github.com/juliotorresmoreno/tana-api/server/uploads"
 	"github.com/juliotorresmoreno/tana-api/utils"
 )
 
 var log = logger.SetupLogger()
 
+var errModelUnavailable = &utils.HttpResponse{
+	Status: http.StatusBadGateway,
+	Obj:    utils.HttpError{Message: "The model isn't available"},
+}
+
 type ConversationRouter struct {
 }
 
 func SetupAPIRoutes(r *gin.RouterGroup) {
+	queue.Register(attachJobType, runAttachJob)
+	queue.OnFailure(attachJobType, removeAttachment)
+
 	conversation := &ConversationRouter{}
 	r.GET("/:id", conversation.findOne)
 	r.POST("/:id", conversation.generate)
 	r.POST("/:id/attach", conversation.attach)
 }
 
-type Message struct {
-	Answer   string
-	Response string
-}
-
-type AttachPayload struct {
-	Attachment string `json:"attachment"`
-}
-
 func (h *ConversationRouter) attach(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		utils.Response(c, err)
-		return
-	}
-
-	payload := &AttachPayload{}
-	if err := c.BindJSON(payload); err != nil {
-		log.Error("Error binding payload", err)
-		utils.Response(c, utils.StatusBadRequest)
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	connectionID, _ := strconv.Atoi(c.Param("id"))
 	connection := &models.Connection{}
 	conn := db.DefaultClient
 
-	tx := conn.Where(&models.Connection{
-		OwnerId: session.ID,
-	}).First(connection, connectionID)
+	tx := conn.Scopes(utils.OwnedBy(session)).First(connection, connectionID)
 
 	if tx.Error != nil {
 		log.Error("Error finding connection", tx.Error)
@@ -74,87 +63,83 @@ func (h *ConversationRouter) attach(c *gin.Context) {
 		return
 	}
 
-	attachment, err := utils.ParseBase64File(payload.Attachment)
-	if err != nil {
-		log.Error("Error parsing attachment", err)
-		utils.Response(c, err)
+	attachment, ok := uploads.ReceiveAttachment(c)
+	if !ok {
 		return
 	}
 
-	// Decodificar el string en base64 a bytes.
-	decoded, err := base64.StdEncoding.DecodeString(attachment)
+	job, err := queue.Enqueue(c, session.ID, attachJobType, &attachJob{
+		UserID:       session.ID,
+		ConnectionID: connection.ID,
+		Attachment:   attachment,
+	})
 	if err != nil {
-		log.Error("Error decoding attachment", err)
+		log.Error("Error queuing attachment", err)
+		attachment.Remove()
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
-	fileName := utils.GenerateRandomFileName("attachment_", ".pdf")
-	filePath := filepath.Join(os.TempDir(), fileName)
+	c.JSON(http.StatusAccepted, job)
+}
 
-	// Escribir los bytes decodificados en el archivo.
-	err = os.WriteFile(filePath, decoded, 0644)
-	if err != nil {
-		log.Error("Error writing attachment to file", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error writing attachment to file"})
-		return
-	}
+const attachJobType = "conversation.attach"
 
-	outputName := utils.GenerateRandomFileName("attachment_", ".txt")
-	outputPath := filepath.Join(os.TempDir(), outputName)
+type attachJob struct {
+	UserID       uint                `json:"user_id"`
+	ConnectionID uint                `json:"connection_id"`
+	Attachment   *uploads.Attachment `json:"attachment"`
+}
 
-	err = utils.PDFToText(filePath, outputPath)
-	if err != nil {
-		log.Error("Error converting attachment to text", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error converting attachment to text"})
-		return
+// runAttachJob adds the text of an attachment to the conversation as a
+// system message, so the next generations see it. The attachment is removed
+// once it is saved, or by removeAttachment when the job is given up.
+func runAttachJob(ctx context.Context, job *queue.Job) (interface{}, error) {
+	payload := &attachJob{}
+	if err := job.Decode(payload); err != nil {
+		return nil, queue.Permanent(err)
 	}
+	attachment := payload.Attachment
 
-	foutput, err := os.Open(outputPath)
-	if err != nil {
-		log.Error("Error opening attachment", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error opening attachment"})
-		return
+	connection := &models.Connection{}
+	tx := db.DefaultClient.WithContext(ctx).Limit(1).Find(connection, payload.ConnectionID)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if connection.ID == 0 {
+		return nil, queue.Permanent(errors.New("The connection no longer exists"))
 	}
-	defer foutput.Close()
 
-	output, err := io.ReadAll(foutput)
+	document, err := attachment.Extract()
 	if err != nil {
 		log.Error("Error reading attachment", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading attachment"})
-		return
+		return nil, queue.Permanent(errors.New("The attachment can't be read!"))
+	}
+	job.SetProgress(ctx, 50)
+	output, _ := document.Text()
+
+	message := &models.ConversationMessage{
+		UserId:       payload.UserID,
+		ConnectionId: connection.ID,
+		Role:         providers.RoleSystem,
+		Content:      fmt.Sprintf("Attachment %s:\n\n%s", attachment.Name, output),
 	}
+	tx = db.DefaultClient.WithContext(ctx).Create(message)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	attachment.Remove()
 
-	body := bytes.NewBufferString("")
-	json.NewEncoder(body).Encode(map[string]interface{}{
-		"title":         connection.Description,
-		"attachment":    string(output),
-		"user_id":       session.ID,
-		"connection_id": connection.ID,
-	})
+	return gin.H{"message_id": message.ID, "connection_id": connection.ID}, nil
+}
 
-	var aiUrl = os.Getenv("AI_URL")
-	conversation := fmt.Sprintf("conversation-%v-%v", session.ID, connection.ID)
-	url := aiUrl + "/conversation/" + conversation + "/attach"
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		log.Error("Error creating request", err)
-		utils.Response(c, utils.StatusInternalServerError)
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Error("Error making request", err)
-		utils.Response(c, utils.StatusInternalServerError)
+// removeAttachment deletes the attachment of a job that was given up.
+func removeAttachment(ctx context.Context, job *queue.Job) {
+	payload := &attachJob{}
+	if err := job.Decode(payload); err != nil || payload.Attachment == nil {
 		return
 	}
-	defer resp.Body.Close()
-	if resp.Header.Get("Content-Type") != "" {
-		c.Header("Content-Type", resp.Header.Get("Content-Type"))
-	}
-	c.Status(resp.StatusCode)
-	utils.Copy(c.Writer, resp.Body)
+	payload.Attachment.Remove()
 }
 
 type GeneratePayload struct {
@@ -162,12 +147,7 @@ type GeneratePayload struct {
 }
 
 func (h *ConversationRouter) generate(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		utils.Response(c, err)
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	payload := &GeneratePayload{}
 	if err := c.BindJSON(payload); err != nil {
@@ -179,9 +159,7 @@ func (h *ConversationRouter) generate(c *gin.Context) {
 	connectionID, _ := strconv.Atoi(c.Param("id"))
 	connection := &models.Connection{}
 	conn := db.DefaultClient
-	tx := conn.Where(&models.Connection{
-		OwnerId: session.ID,
-	}).First(connection, connectionID)
+	tx := conn.Scopes(utils.OwnedBy(session)).First(connection, connectionID)
 	if tx.Error != nil {
 		log.Error("Error finding connection", tx.Error)
 		utils.Response(c, utils.StatusNotFound)
@@ -194,50 +172,135 @@ func (h *ConversationRouter) generate(c *gin.Context) {
 		return
 	}
 
-	body := bytes.NewBufferString("")
-	json.NewEncoder(body).Encode(map[string]interface{}{
-		"title":         connection.Description,
-		"prompt":        payload.Prompt,
-		"user_id":       session.ID,
-		"connection_id": connection.ID,
-	})
-
-	var aiUrl = os.Getenv("AI_URL")
-	conversation := fmt.Sprintf("conversation-%v-%v", session.ID, connection.ID)
-	url := aiUrl + "/conversation/" + conversation
-	req, err := http.NewRequest("POST", url, body)
+	// Generations use the version the connection is pinned to, or the
+	// latest one.
+	version, err := mmlu.LoadVersion(connection.MmluId, connection.MmluVersion)
 	if err != nil {
-		log.Error("Error creating request", err)
+		log.Error("Error loading mmlu version", err)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+	settings := &models.Mmlu{}
+	version.Settings.Apply(settings)
+
+	matches := relevantKnowledge(c, connection.MmluId, version, payload.Prompt)
+	settings.SystemPrompt = knowledge.Prompt(settings.SystemPrompt, matches)
+
+	provider, err := providers.Get(settings.Provider)
+	if err != nil {
+		log.Error("Error getting provider", err)
+		utils.Response(c, errModelUnavailable)
+		return
+	}
+	turns, err := history(c.Request.Context(), session.ID, connection.ID, historyLength())
 	if err != nil {
-		log.Error("Error making request", err)
+		log.Error("Error getting conversation", err)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-	c.Header("Content-Type", "text/plain")
-	c.Status(http.StatusOK)
-	utils.Copy(c.Writer, resp.Body)
-}
+	request := &providers.ChatRequest{
+		Model:    settings.Model,
+		Messages: chatMessages(settings.SystemPrompt, turns, payload.Prompt),
+		Options:  generationOptions(settings),
+	}
 
-func (h *ConversationRouter) findOne(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
+	// The answer is streamed as the model writes it. Once the first piece is
+	// sent errors can only be logged.
+	answer := strings.Builder{}
+	started := false
+	err = provider.ChatStream(c.Request.Context(), request, func(chunk *providers.ChatChunk) error {
+		if chunk.Content == "" {
+			return nil
+		}
+		if !started {
+			c.Header("Content-Type", "text/plain")
+			c.Header("X-Knowledge-Citations", citations(matches))
+			c.Status(http.StatusOK)
+			started = true
+		}
+		answer.WriteString(chunk.Content)
+		if _, err := c.Writer.WriteString(chunk.Content); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
 	if err != nil {
-		log.Error("Error validating session", err)
-		utils.Response(c, err)
+		log.Error("Error generating answer", err)
+		if !started {
+			utils.Response(c, errModelUnavailable)
+		}
 		return
 	}
+	if !started {
+		c.Header("Content-Type", "text/plain")
+		c.Header("X-Knowledge-Citations", citations(matches))
+		c.Status(http.StatusOK)
+	}
+
+	tx = conn.Create([]*models.ConversationMessage{
+		{UserId: session.ID, ConnectionId: connection.ID, Role: providers.RoleUser, Content: payload.Prompt},
+		{UserId: session.ID, ConnectionId: connection.ID, Role: providers.RoleAssistant, Content: answer.String()},
+	})
+	if tx.Error != nil {
+		log.Error("Error saving conversation", tx.Error)
+	}
+}
+
+// relevantKnowledge returns the chunks of the messages of the version, as
+// the version has them, closest to the prompt. Generations go on without
+// knowledge when it can't be retrieved.
+func relevantKnowledge(c *gin.Context, mmluID uint, version *mmlu.Version, prompt string) []*knowledge.Match {
+	sources := make([]knowledge.Source, 0, len(version.Messages))
+	for _, message := range version.Messages {
+		sources = append(sources, knowledge.Source{MessageID: message.ID, Content: message.Content})
+	}
+	matches, err := knowledge.Retrieve(c.Request.Context(), version.Settings.Provider, mmluID, sources, prompt)
+	if err != nil {
+		log.Error("Error retrieving knowledge", err)
+		return nil
+	}
+	return matches
+}
+
+// citations maps the citation numbers of the answer to the source messages.
+func citations(matches []*knowledge.Match) string {
+	result := make([]gin.H, 0, len(matches))
+	for _, match := range matches {
+		result = append(result, gin.H{
+			"citation":   match.Citation,
+			"message_id": match.MessageID,
+			"position":   match.Position,
+			"page":       match.Page,
+		})
+	}
+	data, _ := json.Marshal(result)
+	return string(data)
+}
+
+// generationOptions are the settings of the mmlu the model generates with,
+// so connections on the same model can behave differently.
+func generationOptions(mmlu *models.Mmlu) providers.Options {
+	options := providers.Options{
+		Temperature:   mmlu.Temperature,
+		TopP:          mmlu.TopP,
+		MaxTokens:     mmlu.MaxTokens,
+		Stop:          mmlu.Stop,
+		ContextWindow: mmlu.ContextWindow,
+	}
+	if mmlu.ResponseFormat == models.ResponseFormatJSONSchema {
+		options.Schema = json.RawMessage(mmlu.ResponseSchema)
+	}
+	return options
+}
+
+func (h *ConversationRouter) findOne(c *gin.Context) {
+	session := middlewares.GetUser(c)
 
 	connectionID, _ := strconv.Atoi(c.Param("id"))
 	connection := &models.Connection{}
 	conn := db.DefaultClient
-	tx := conn.Where(&models.Connection{
-		OwnerId: session.ID,
-	}).First(connection, connectionID)
+	tx := conn.Scopes(utils.OwnedBy(session)).First(connection, connectionID)
 	if tx.Error != nil {
 		log.Error("Error finding connection", tx.Error)
 		utils.Response(c, utils.StatusNotFound)
@@ -250,27 +313,16 @@ func (h *ConversationRouter) findOne(c *gin.Context) {
 		return
 	}
 
-	var aiUrl = os.Getenv("AI_URL")
-	conversation := fmt.Sprintf("conversation-%v-%v", session.ID, connection.ID)
-	url := aiUrl + "/conversation/" + conversation
-	req, err := http.NewRequest("GET", url, nil)
+	turns, err := history(c.Request.Context(), session.ID, connection.ID, -1)
 	if err != nil {
-		log.Error("Error creating request", err)
+		log.Error("Error getting conversation", err)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Error("Error making request", err)
-		utils.Response(c, utils.StatusInternalServerError)
-		return
+	messages := make([]*Message, 0, len(turns))
+	for _, turn := range turns {
+		messages = append(messages, newMessage(turn))
 	}
-	defer res.Body.Close()
 
-	_, err = io.Copy(c.Writer, res.Body)
-	if err != nil {
-		log.Error("Error copying response", err)
-		utils.Response(c, utils.StatusInternalServerError)
-		return
-	}
+	c.JSON(200, messages)
 }
@@ -1,17 +1,24 @@
 package credentials
 
 import (
+	"fmt"
+	"io"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
 	"github.com/google/uuid"
 	"github.com/juliotorresmoreno/tana-api/db"
 	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
 	"github.com/juliotorresmoreno/tana-api/utils"
 )
 
 var maxCredentials = 10
+var maxGracePeriod = 30 * 24 * time.Hour
 var tablename = models.Credential{}.TableName()
 var log = logger.SetupLogger()
 
@@ -23,34 +30,54 @@ func SetupAPIRoutes(r *gin.RouterGroup) {
 	r.GET("", h.find)
 	r.GET("/:id", h.findOne)
 	r.POST("/generate", h.create)
+	r.POST("/:id/rotate", h.rotate)
 	r.DELETE("/:id", h.delete)
 }
 
 type Credential struct {
-	ID         uint       `json:"id"`
-	ApiKey     string     `json:"api_key"`
-	ApiSecret  string     `json:"api_secret"`
-	LastUsed   *time.Time `json:"last_used"`
-	CreationAt time.Time  `json:"creation_at"`
-	UpdatedAt  time.Time  `json:"updated_at"`
-	DeletedAt  *time.Time `json:"deleted_at"`
+	ID                uint              `json:"id"`
+	ApiKey            string            `json:"api_key"`
+	SecretPrefix      string            `json:"secret_prefix"`
+	Scopes            models.StringList `json:"scopes"`
+	AllowedIPs        models.StringList `json:"allowed_ips"`
+	ExpiresAt         *time.Time        `json:"expires_at"`
+	PreviousExpiresAt *time.Time        `json:"previous_expires_at"`
+	LastUsed          *time.Time        `json:"last_used"`
+	CreationAt        time.Time         `json:"creation_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+	DeletedAt         *time.Time        `json:"deleted_at"`
 }
 
-func (h *CredentialsRouter) find(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
+func newCredential(credential *models.Credential) Credential {
+	return Credential{
+		ID:                credential.ID,
+		ApiKey:            credential.ApiKey,
+		SecretPrefix:      credential.SecretPrefix,
+		Scopes:            credential.Scopes,
+		AllowedIPs:        credential.AllowedIPs,
+		ExpiresAt:         credential.ExpiresAt,
+		PreviousExpiresAt: credential.PreviousExpiresAt,
+		LastUsed:          credential.LastUsed,
+		CreationAt:        credential.CreationAt,
+		UpdatedAt:         credential.UpdatedAt,
 	}
+}
+
+// GeneratedCredential is returned only once, when the credential is created.
+// Afterwards the secret can't be recovered.
+type GeneratedCredential struct {
+	Credential
+	ApiSecret string `json:"api_secret"`
+}
+
+func (h *CredentialsRouter) find(c *gin.Context) {
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 
 	credentials := make([]Credential, 0)
 	tx := conn.Table(tablename).
-		Where(models.Credential{
-			OwnerId: session.ID,
-		}).
+		Scopes(utils.OwnedBy(session)).
 		Where("deleted_at is null").
 		Limit(maxCredentials).
 		Find(&credentials)
@@ -64,21 +91,14 @@ func (h *CredentialsRouter) find(c *gin.Context) {
 }
 
 func (h *CredentialsRouter) findOne(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 
 	credential := &Credential{}
 	tx := conn.Table(tablename).
 		Where("id = ?", c.Param("id")).
-		Where(models.Credential{
-			OwnerId: session.ID,
-		}).
+		Scopes(utils.OwnedBy(session)).
 		Where("deleted_at is null").
 		First(credential)
 	if tx.Error != nil {
@@ -91,20 +111,13 @@ func (h *CredentialsRouter) findOne(c *gin.Context) {
 }
 
 func (h *CredentialsRouter) create(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 
 	count := int64(0)
 	tx := conn.Table(tablename).
-		Where(models.Credential{
-			OwnerId: session.ID,
-		}).
+		Scopes(utils.OwnedBy(session)).
 		Where("deleted_at is null").
 		Count(&count)
 	if tx.Error != nil {
@@ -113,18 +126,59 @@ func (h *CredentialsRouter) create(c *gin.Context) {
 		return
 	}
 
-	if int(count) > maxCredentials {
-		c.JSON(400, gin.H{"message": "You can't create more than 5 credentials"})
+	if int(count) >= maxCredentials {
+		c.JSON(400, gin.H{
+			"message": fmt.Sprintf("You can't create more than %d credentials", maxCredentials),
+		})
+		return
+	}
+
+	payload := &CreatePayload{}
+	if err := c.ShouldBindJSON(payload); err != nil && err != io.EOF {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
 		return
 	}
+	if len(payload.Scopes) == 0 {
+		payload.Scopes = []string{"*"}
+	}
 
-	apiSecret, _ := utils.GenerateRandomString(50)
+	if customErrors, ok := validateCreate(payload); !ok {
+		log.Error("Error validating user input", customErrors)
+		c.JSON(http.StatusBadRequest, customErrors)
+		return
+	}
+
+	for _, scope := range payload.Scopes {
+		if !session.HasScope(scope) {
+			c.JSON(http.StatusBadRequest, CredentialValidationErrors{
+				Scopes: "You can't grant a scope you don't have!",
+			})
+			return
+		}
+	}
+
+	apiSecret, err := utils.GenerateRandomString(50)
+	if err != nil {
+		log.Error("Error generating secret", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
 
 	credential := &models.Credential{
-		OwnerId:   session.ID,
-		ApiKey:    uuid.New().String(),
-		ApiSecret: apiSecret,
+		OwnerId:     session.ID,
+		WorkspaceId: session.Workspace(),
+		ApiKey:      uuid.New().String(),
+		Scopes:      payload.Scopes,
+		AllowedIPs:  payload.AllowedIPs,
+		ExpiresAt:   payload.ExpiresAt,
 	}
+	if err := utils.SealCredentialSecret(credential, apiSecret); err != nil {
+		log.Error("Error hashing secret", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
 	tx = conn.Create(credential)
 	if tx.Error != nil {
 		log.Error("Error creating credential", tx.Error)
@@ -132,26 +186,190 @@ func (h *CredentialsRouter) create(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{"message": "create success"})
+	audit.Record(c, &audit.Event{
+		Action:     "credential.create",
+		TargetType: "credential",
+		TargetID:   credential.ID,
+		After:      newCredential(credential),
+	})
+
+	c.JSON(200, &GeneratedCredential{
+		Credential: newCredential(credential),
+		ApiSecret:  apiSecret,
+	})
 }
 
-func (h *CredentialsRouter) delete(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
+type RotatePayload struct {
+	// GracePeriod is how many seconds the current secret stays valid.
+	GracePeriod *int `json:"grace_period"`
+}
+
+func (h *CredentialsRouter) rotate(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &RotatePayload{}
+	if err := c.ShouldBindJSON(payload); err != nil && err != io.EOF {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	grace := defaultGracePeriod()
+	if payload.GracePeriod != nil {
+		grace = time.Duration(*payload.GracePeriod) * time.Second
+	}
+	if grace < 0 || grace > maxGracePeriod {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"grace_period": fmt.Sprintf("Must be between 0 and %d seconds", int(maxGracePeriod.Seconds())),
+		})
+		return
+	}
+
+	conn := db.DefaultClient
+	credential := &models.Credential{}
+	// The new secret authenticates as the owner of the credential, so only
+	// the owner can rotate it, even inside a workspace.
+	tx := conn.Where("id = ?", c.Param("id")).
+		Scopes(utils.OwnedBy(session)).
+		Where(models.Credential{
+			OwnerId: session.ID,
+		}).
+		Where("deleted_at is null").
+		First(credential)
+	if tx.Error != nil {
+		log.Error("Error getting credential", tx.Error)
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+
+	apiSecret, err := utils.GenerateRandomString(50)
 	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
+		log.Error("Error generating secret", err)
+		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	before := newCredential(credential)
+	if err := utils.RotateCredentialSecret(credential, apiSecret, grace); err != nil {
+		log.Error("Error hashing secret", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	tx = conn.Model(credential).
+		Select(
+			"secret_hash", "secret_prefix", "signing_key",
+			"previous_secret_hash", "previous_signing_key", "previous_expires_at",
+		).
+		Updates(credential)
+	if tx.Error != nil {
+		log.Error("Error rotating credential", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	audit.Record(c, &audit.Event{
+		Action:     "credential.rotate",
+		TargetType: "credential",
+		TargetID:   credential.ID,
+		Before:     before,
+		After:      newCredential(credential),
+	})
+
+	c.JSON(200, &GeneratedCredential{
+		Credential: newCredential(credential),
+		ApiSecret:  apiSecret,
+	})
+}
+
+// defaultGracePeriod is how long the previous secret stays valid after a
+// rotation without a grace period, from CREDENTIAL_GRACE_PERIOD.
+func defaultGracePeriod() time.Duration {
+	return utils.DurationFromEnv("CREDENTIAL_GRACE_PERIOD", 24*time.Hour)
+}
+
+type CreatePayload struct {
+	Scopes     []string   `json:"scopes" validate:"max=20,dive,scope"`
+	AllowedIPs []string   `json:"allowed_ips" validate:"max=20,dive,ipcidr"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type CredentialValidationErrors struct {
+	Scopes     string `json:"scopes,omitempty"`
+	AllowedIPs string `json:"allowed_ips,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+}
+
+func validateCreate(payload *CreatePayload) (CredentialValidationErrors, bool) {
+	validate := validator.New()
+	validate.RegisterValidation("scope", func(fl validator.FieldLevel) bool {
+		return middlewares.ValidScope(fl.Field().String())
+	})
+	validate.RegisterValidation("ipcidr", func(fl validator.FieldLevel) bool {
+		return utils.ValidIPOrCIDR(fl.Field().String())
+	})
+
+	customErrors := CredentialValidationErrors{}
+	valid := true
+	if err := validate.Struct(payload); err != nil {
+		for _, err := range err.(validator.ValidationErrors) {
+			switch err.Tag() {
+			case "scope":
+				customErrors.Scopes = "Invalid scope!"
+			case "ipcidr":
+				customErrors.AllowedIPs = "Invalid IP address or CIDR!"
+			default:
+				if err.Field() == "AllowedIPs" {
+					customErrors.AllowedIPs = "Invalid field!"
+				} else {
+					customErrors.Scopes = "Invalid field!"
+				}
+			}
+		}
+		valid = false
+	}
+
+	if payload.ExpiresAt != nil && payload.ExpiresAt.Before(time.Now()) {
+		customErrors.ExpiresAt = "Must be in the future!"
+		valid = false
+	}
+
+	return customErrors, valid
+}
+
+func (h *CredentialsRouter) delete(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
 	conn := db.DefaultClient
 
-	tx := conn.Where(&models.Credential{OwnerId: session.ID}).
-		Delete(&models.Credential{}, c.Param("id"))
+	credential := &models.Credential{}
+	tx := conn.Scopes(utils.OwnedBy(session)).
+		Where("id = ?", c.Param("id")).
+		Limit(1).
+		Find(credential)
+	if tx.Error != nil {
+		log.Error("Error getting credential", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if credential.ID == 0 {
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+
+	tx = conn.Delete(credential)
 	if tx.Error != nil {
 		log.Error("Error deleting credential", tx.Error)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	audit.Record(c, &audit.Event{
+		Action:     "credential.delete",
+		TargetType: "credential",
+		TargetID:   credential.ID,
+		Before:     newCredential(credential),
+	})
+
 	c.JSON(200, gin.H{"message": "deleted"})
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/juliotorresmoreno/tana-api/db"
 	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
 	"github.com/juliotorresmoreno/tana-api/utils"
 )
@@ -70,23 +71,42 @@ var Manager = &manager{
 func SetupAPIRoutes(r *gin.RouterGroup) {
 	go Manager.Run()
 	events := &EventsRouter{}
-	r.GET("", events.subscribe)
+	r.GET("",
+		middlewares.Authorize(middlewares.PolicyAuthenticated),
+		middlewares.Permission("event"),
+		events.subscribe,
+	)
 	r.POST("/:id", events.publish)
 }
 
-func (h *EventsRouter) publish(c *gin.Context) {
+// canPublish accepts the server API_KEY for any user, and credentials with
+// the event:publish scope for their own user.
+func canPublish(c *gin.Context, userId uint) error {
+	if user := middlewares.GetUser(c); user != nil && user.Scopes != nil {
+		if user.ID != userId || !user.HasScope("event:publish") || !middlewares.Allowed(user, "event:publish") {
+			return utils.NewForbidden("event:publish")
+		}
+		return nil
+	}
+
 	token, err := utils.GetToken(c)
 	if err != nil {
-		log.Error("Error getting token", err)
-		utils.Response(c, err)
-		return
+		return err
 	}
 	if token != os.Getenv("API_KEY") {
-		utils.Response(c, utils.StatusUnauthorized)
-		return
+		return utils.StatusUnauthorized
 	}
+	return nil
+}
 
+func (h *EventsRouter) publish(c *gin.Context) {
 	userId, _ := strconv.Atoi(c.Param("id"))
+	if err := canPublish(c, uint(userId)); err != nil {
+		log.Error("Error authorizing publish", err)
+		utils.Response(c, err)
+		return
+	}
+
 	payload, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		log.Error("Error reading body", err)
@@ -105,12 +125,7 @@ func (h *EventsRouter) publish(c *gin.Context) {
 }
 
 func (h *EventsRouter) subscribe(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		utils.Response(c, err)
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	bus := make(chan interface{})
 	Manager.Subscribe <- &Subscription{
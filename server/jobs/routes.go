@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/queue"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+var log = logger.SetupLogger()
+
+type JobsRouter struct {
+}
+
+func SetupAPIRoutes(r *gin.RouterGroup) {
+	jobs := &JobsRouter{}
+	r.GET("/:id", jobs.findOne)
+}
+
+// findOne reports the status and progress of a job of the user. Finished
+// jobs carry their result or the error they failed with.
+func (h *JobsRouter) findOne(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	job, err := queue.Find(c, session.ID, c.Param("id"))
+	if err != nil {
+		log.Error("Error getting job", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+
+	c.JSON(200, job)
+}
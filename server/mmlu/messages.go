@@ -1,6 +1,9 @@
 package mmlu
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -8,8 +11,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator"
 	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/knowledge"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/queue"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
+	"github.com/juliotorresmoreno/tana-api/server/uploads"
 	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
 )
 
 type MessageValidationErrors struct {
@@ -28,12 +37,7 @@ type Message struct {
 }
 
 func (h *MMLURouter) findMessages(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	mmluId, _ := strconv.Atoi(c.Param("id"))
 	messages := &[]Message{}
@@ -41,7 +45,8 @@ func (h *MMLURouter) findMessages(c *gin.Context) {
 	tx := conn.Preload("Mmlu").
 		Model(models.Message{}).
 		Where("deleted_at is null").
-		Where(&models.Message{OwnerId: session.ID, MmluId: uint(mmluId)}).
+		Where(&models.Message{MmluId: uint(mmluId)}).
+		Scopes(utils.OwnedBy(session)).
 		Find(messages)
 	if tx.Error != nil {
 		log.Error(tx.Error)
@@ -56,12 +61,7 @@ type createMessagePayload struct {
 }
 
 func (h *MMLURouter) createMessage(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	mmluId, _ := strconv.Atoi(c.Param("id"))
 	payload := &createMessagePayload{}
@@ -100,49 +100,51 @@ func (h *MMLURouter) createMessage(c *gin.Context) {
 		return
 	}
 
-	message := &models.Message{
-		Content: payload.Content,
-		MmluId:  uint(mmluId),
-		OwnerId: session.ID,
-		Role:    "system",
-	}
 	conn := db.DefaultClient
-	tx := conn.Create(message)
+	mmlu := &models.Mmlu{}
+	tx := conn.Scopes(utils.OwnedBy(session)).
+		Where("id = ?", mmluId).
+		Limit(1).
+		Find(mmlu)
 	if tx.Error != nil {
 		log.Error(tx.Error)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
-
-	c.JSON(200, gin.H{"message": "create success"})
-}
-
-type AttachPayload struct {
-	Attachment string `json:"attachment"`
-}
-
-func (h *MMLURouter) attachMessage(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		utils.Response(c, err)
+	if mmlu.ID == 0 {
+		utils.Response(c, utils.StatusNotFound)
 		return
 	}
 
-	payload := &AttachPayload{}
-	if err := c.BindJSON(payload); err != nil {
-		log.Error("Error binding payload", err)
-		utils.Response(c, utils.StatusBadRequest)
+	message := &models.Message{
+		Content:     payload.Content,
+		MmluId:      mmlu.ID,
+		OwnerId:     session.ID,
+		WorkspaceId: session.Workspace(),
+		Role:        "system",
+	}
+	err := versioned(session, mmlu.ID, "message.create", func(tx *gorm.DB) error {
+		return tx.Create(message).Error
+	})
+	if err != nil {
+		log.Error(err)
+		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	ingest(message.ID)
+
+	c.JSON(200, gin.H{"message": "create success"})
+}
+
+func (h *MMLURouter) attachMessage(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
 	mmluID, _ := strconv.Atoi(c.Param("id"))
 	mmlu := &models.Mmlu{}
 	conn := db.DefaultClient
 
-	tx := conn.Where(&models.Connection{
-		OwnerId: session.ID,
-	}).First(mmlu, mmluID)
+	tx := conn.Scopes(utils.OwnedBy(session)).First(mmlu, mmluID)
 
 	if tx.Error != nil {
 		log.Error("Error finding connection", tx.Error)
@@ -156,28 +158,97 @@ func (h *MMLURouter) attachMessage(c *gin.Context) {
 		return
 	}
 
-	content, err := utils.ReadPDF(payload.Attachment)
+	attachment, ok := uploads.ReceiveAttachment(c)
+	if !ok {
+		return
+	}
+
+	// Extracting a large document takes longer than a request should, so it
+	// happens in a job.
+	job, err := queue.Enqueue(c, session.ID, attachJobType, &attachJob{
+		UserID:      session.ID,
+		WorkspaceID: session.WorkspaceID,
+		MmluID:      mmlu.ID,
+		Attachment:  attachment,
+	})
 	if err != nil {
-		log.Error("Error reading attachment", err)
-		utils.Response(c, err)
+		log.Error("Error queuing attachment", err)
+		attachment.Remove()
+		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
-	message := &models.Message{
-		Content: content,
-		MmluId:  uint(mmlu.ID),
-		OwnerId: session.ID,
-		Role:    "system",
+	c.JSON(http.StatusAccepted, job)
+}
+
+const attachJobType = "mmlu.attach"
+
+type attachJob struct {
+	UserID      uint                `json:"user_id"`
+	WorkspaceID uint                `json:"workspace_id"`
+	MmluID      uint                `json:"mmlu_id"`
+	Attachment  *uploads.Attachment `json:"attachment"`
+}
+
+// runAttachJob turns an attachment into a system message of the mmlu. The
+// attachment is removed once it is saved, or by removeAttachment when the job
+// is given up.
+func runAttachJob(ctx context.Context, job *queue.Job) (interface{}, error) {
+	payload := &attachJob{}
+	if err := job.Decode(payload); err != nil {
+		return nil, queue.Permanent(err)
 	}
+	attachment := payload.Attachment
 
-	tx = conn.Create(message)
+	mmlu := &models.Mmlu{}
+	tx := db.DefaultClient.WithContext(ctx).Select("id").Limit(1).Find(mmlu, payload.MmluID)
 	if tx.Error != nil {
-		log.Error(tx.Error)
-		utils.Response(c, utils.StatusInternalServerError)
-		return
+		return nil, tx.Error
+	}
+	if mmlu.ID == 0 {
+		return nil, queue.Permanent(errors.New("The mmlu no longer exists"))
 	}
 
-	c.JSON(200, gin.H{"message": "create success"})
+	document, err := attachment.Extract()
+	if err != nil {
+		log.Error("Error reading attachment", err)
+		return nil, queue.Permanent(errors.New("The attachment can't be read!"))
+	}
+	job.SetProgress(ctx, 50)
+
+	content, starts := document.Text()
+	pages, _ := json.Marshal(starts)
+
+	session := &utils.User{ID: payload.UserID, WorkspaceID: payload.WorkspaceID}
+	message := &models.Message{
+		Content:     content,
+		Pages:       pages,
+		MmluId:      mmlu.ID,
+		OwnerId:     session.ID,
+		WorkspaceId: session.Workspace(),
+		Role:        "system",
+	}
+
+	err = versioned(session, mmlu.ID, "message.create", func(tx *gorm.DB) error {
+		return tx.Create(message).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	attachment.Remove()
+
+	ingest(message.ID)
+
+	return gin.H{"message_id": message.ID, "mmlu_id": mmlu.ID}, nil
+}
+
+// removeAttachment deletes the attachment of a job that was given up.
+func removeAttachment(ctx context.Context, job *queue.Job) {
+	payload := &attachJob{}
+	if err := job.Decode(payload); err != nil || payload.Attachment == nil {
+		return
+	}
+	payload.Attachment.Remove()
 }
 
 type updateMessagePayload struct {
@@ -185,12 +256,7 @@ type updateMessagePayload struct {
 }
 
 func (h *MMLURouter) updateMessage(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	payload := &updateMessagePayload{}
 	if err := c.ShouldBind(payload); err != nil {
@@ -228,43 +294,116 @@ func (h *MMLURouter) updateMessage(c *gin.Context) {
 		return
 	}
 
-	messageId, _ := strconv.Atoi(c.Param("messageId"))
+	before, ok := findMessage(c, session)
+	if !ok {
+		return
+	}
+
 	message := &models.Message{
 		Content: payload.Content,
 	}
-	conn := db.DefaultClient
-	tx := conn.Model(message).
-		Where(&models.Message{OwnerId: session.ID}).
-		Where("id = ?", messageId).
-		Updates(message)
-	if tx.Error != nil {
-		log.Error(tx.Error)
+	err := versioned(session, before.MmluId, "message.update", func(tx *gorm.DB) error {
+		// The page starts of an attachment don't hold for the new content.
+		return tx.Model(message).
+			Scopes(utils.OwnedBy(session)).
+			Where("id = ?", before.ID).
+			Select("content", "pages").
+			Updates(message).Error
+	})
+	if err != nil {
+		log.Error(err)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	after := *before
+	after.Content = payload.Content
+	audit.Record(c, &audit.Event{
+		Action:     "message.update",
+		TargetType: "message",
+		TargetID:   before.ID,
+		Before:     messageSnapshot(before),
+		After:      messageSnapshot(&after),
+	})
+	ingest(before.ID)
+
 	c.JSON(200, gin.H{"message": "update success"})
 }
 
 func (h *MMLURouter) deleteMessage(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
+	session := middlewares.GetUser(c)
+
+	message, ok := findMessage(c, session)
+	if !ok {
+		return
+	}
+
+	err := versioned(session, message.MmluId, "message.delete", func(tx *gorm.DB) error {
+		return tx.Model(models.Message{}).
+			Scopes(utils.OwnedBy(session)).
+			Where("id = ?", message.ID).
+			Update("deleted_at", time.Now()).Error
+	})
 	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
+		log.Error(err)
+		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	audit.Record(c, &audit.Event{
+		Action:     "message.delete",
+		TargetType: "message",
+		TargetID:   message.ID,
+		Before:     messageSnapshot(message),
+	})
+	ingest(message.ID)
+
+	c.JSON(200, gin.H{"message": "deleted"})
+}
+
+func findMessage(c *gin.Context, session *utils.User) (*models.Message, bool) {
 	messageId, _ := strconv.Atoi(c.Param("messageId"))
-	conn := db.DefaultClient
-	tx := conn.Model(models.Message{}).
-		Where(&models.Message{OwnerId: session.ID}).
+	message := &models.Message{}
+	tx := db.DefaultClient.Scopes(utils.OwnedBy(session)).
 		Where("id = ?", messageId).
-		Update("deleted_at", time.Now())
+		Limit(1).
+		Find(message)
 	if tx.Error != nil {
 		log.Error(tx.Error)
 		utils.Response(c, utils.StatusInternalServerError)
-		return
+		return nil, false
+	}
+	if message.ID == 0 {
+		utils.Response(c, utils.StatusNotFound)
+		return nil, false
 	}
+	return message, true
+}
 
-	c.JSON(200, gin.H{"message": "deleted"})
+// ingest refreshes the knowledge chunks of the message in the background,
+// embedding a whole document takes a while.
+func ingest(messageID uint) {
+	go func() {
+		if err := knowledge.Ingest(context.Background(), messageID); err != nil {
+			log.Error("Error ingesting message ", messageID, ": ", err)
+		}
+	}()
+}
+
+// ingestMmlu is ingest for every message of the mmlu.
+func ingestMmlu(mmluID uint) {
+	go func() {
+		if err := knowledge.IngestMmlu(context.Background(), mmluID); err != nil {
+			log.Error("Error ingesting mmlu ", mmluID, ": ", err)
+		}
+	}()
+}
+
+// messageSnapshot is what the audit log keeps of a message.
+func messageSnapshot(message *models.Message) gin.H {
+	return gin.H{
+		"mmlu_id": message.MmluId,
+		"role":    message.Role,
+		"content": message.Content,
+	}
 }
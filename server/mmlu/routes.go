@@ -1,6 +1,8 @@
 package mmlu
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,8 +11,13 @@ import (
 	"github.com/go-playground/validator"
 	"github.com/juliotorresmoreno/tana-api/db"
 	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"github.com/juliotorresmoreno/tana-api/queue"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
 	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
 )
 
 var log = logger.SetupLogger()
@@ -20,18 +27,29 @@ type MMLURouter struct {
 }
 
 func SetupAPIRoutes(r *gin.RouterGroup) {
+	queue.Register(attachJobType, runAttachJob)
+	queue.OnFailure(attachJobType, removeAttachment)
+
 	h := &MMLURouter{}
-	r.GET("", h.find)
-	r.GET("/:id", h.findOne)
-	r.POST("", h.create)
-	r.PATCH("/:id", h.update)
-	r.DELETE("/:id", h.delete)
-
-	r.GET("/:id/messages", h.findMessages)
-	r.POST("/:id/messages", h.createMessage)
-	r.POST("/:id/messages/attach", h.attachMessage)
-	r.PATCH("/:id/messages/:messageId", h.updateMessage)
-	r.DELETE("/:id/messages/:messageId", h.deleteMessage)
+	mmlus := middlewares.Permission("mmlu")
+	r.GET("", mmlus, h.find)
+	r.GET("/:id", mmlus, h.findOne)
+	r.POST("", mmlus, h.create)
+	r.PATCH("/:id", mmlus, h.update)
+	r.DELETE("/:id", mmlus, h.delete)
+	r.GET("/:id/versions", mmlus, h.findVersions)
+	r.GET("/:id/versions/diff", mmlus, h.diffVersions)
+	r.GET("/:id/versions/:version", mmlus, h.findVersion)
+	r.POST("/:id/versions/:version/rollback", mmlus, h.rollback)
+
+	messages := middlewares.Permission("message")
+	r.GET("/messages/search", messages, h.searchMessages)
+	r.GET("/:id/messages", messages, h.findMessages)
+	r.GET("/:id/messages/search", messages, h.searchMessages)
+	r.POST("/:id/messages", messages, h.createMessage)
+	r.POST("/:id/messages/attach", messages, h.attachMessage)
+	r.PATCH("/:id/messages/:messageId", messages, h.updateMessage)
+	r.DELETE("/:id/messages/:messageId", messages, h.deleteMessage)
 }
 
 type Mmlu struct {
@@ -40,10 +58,19 @@ type Mmlu struct {
 	Description string     `json:"description" validate:"max=256"`
 	PhotoURL    string     `json:"photo_url" validate:"max=1000"`
 	Model       string     `json:"model" validate:"required,max=100"`
-	Provider    string     `json:"provider" validate:"required,oneof=ollama"`
+	Provider    string     `json:"provider" validate:"required,provider"`
 	CreationAt  time.Time  `json:"creation_at"`
 	UpdatedAt   time.Time  `json:"updated_at"`
 	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+
+	SystemPrompt   string          `json:"system_prompt" validate:"max=20000"`
+	Temperature    *float64        `json:"temperature" validate:"omitempty,min=0,max=2"`
+	TopP           *float64        `json:"top_p" validate:"omitempty,min=0,max=1"`
+	MaxTokens      int             `json:"max_tokens" validate:"min=0,max=1000000"`
+	Stop           models.JSONList `json:"stop" validate:"stop"`
+	ContextWindow  int             `json:"context_window" validate:"min=0"`
+	ResponseFormat string          `json:"response_format" validate:"omitempty,oneof=text json_schema"`
+	ResponseSchema models.JSON     `json:"response_schema" validate:"schema"`
 }
 
 type MmluValidationErrors struct {
@@ -52,18 +79,30 @@ type MmluValidationErrors struct {
 	PhotoURL    string `json:"photo_url,omitempty"`
 	Model       string `json:"model,omitempty"`
 	Provider    string `json:"provider,omitempty"`
+
+	SystemPrompt   string `json:"system_prompt,omitempty"`
+	Temperature    string `json:"temperature,omitempty"`
+	TopP           string `json:"top_p,omitempty"`
+	MaxTokens      string `json:"max_tokens,omitempty"`
+	Stop           string `json:"stop,omitempty"`
+	ContextWindow  string `json:"context_window,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+	ResponseSchema string `json:"response_schema,omitempty"`
+}
+
+// settingColumns are the columns an update writes, zero values included so
+// settings can be cleared.
+var settingColumns = []string{
+	"name", "description", "photo_url", "provider", "model",
+	"system_prompt", "temperature", "top_p", "max_tokens", "stop",
+	"context_window", "response_format", "response_schema",
 }
 
 func (h *MMLURouter) create(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	payload := &Mmlu{}
-	err = c.ShouldBind(payload)
+	err := c.ShouldBind(payload)
 	if err != nil {
 		log.Error("Error binding payload", err)
 		utils.Response(c, utils.StatusBadRequest)
@@ -72,136 +111,115 @@ func (h *MMLURouter) create(c *gin.Context) {
 
 	conn := db.DefaultClient
 
-	mmlu := &models.Mmlu{
-		Name:        payload.Name,
-		Description: payload.Description,
-		PhotoURL:    payload.PhotoURL,
-		Provider:    payload.Provider,
-		Model:       payload.Model,
-		OwnerId:     session.ID,
-	}
+	mmlu := payload.model()
+	mmlu.OwnerId = session.ID
+	mmlu.WorkspaceId = session.Workspace()
 
-	validate := validator.New()
+	validate := newValidator()
 	if err := validate.Struct(payload); err != nil {
 		log.Error("Error validating user input", err)
-		errorsMap := make(map[string]string)
-
-		for _, err := range err.(validator.ValidationErrors) {
-			field := err.Field()
-			tag := err.Tag()
-
-			switch tag {
-			case "required":
-				errorsMap[field] = "This field is required!"
-			case "email":
-				errorsMap[field] = "Invalid email format!"
-			case "phone":
-				errorsMap[field] = "Invalid phone number!"
-			default:
-				errorsMap[field] = "Invalid field!"
-			}
-		}
-		customErrors := MmluValidationErrors{
-			Name:        errorsMap["Name"],
-			PhotoURL:    errorsMap["PhotoURL"],
-			Description: errorsMap["Description"],
-			Model:       errorsMap["Model"],
-			Provider:    errorsMap["Provider"],
-		}
+		c.JSON(http.StatusBadRequest, validationErrors(err))
+		return
+	}
 
-		log.Error("Error validating user input", customErrors)
-		c.JSON(http.StatusBadRequest, customErrors)
+	if !checkSettings(c, payload) {
 		return
 	}
 
-	tx := conn.Create(mmlu)
-	if tx.Error != nil {
-		log.Error(tx.Error)
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(mmlu).Error; err != nil {
+			return err
+		}
+		_, err := newVersion(tx, mmlu.ID, &session.ID, "create")
+		return err
+	})
+	if err != nil {
+		log.Error(err)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	audit.Record(c, &audit.Event{
+		Action:     "mmlu.create",
+		TargetType: "mmlu",
+		TargetID:   mmlu.ID,
+		After:      snapshot(mmlu),
+	})
+
 	c.JSON(200, gin.H{"message": "create success"})
 }
 
 func (h *MMLURouter) update(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	payload := &Mmlu{}
-	err = c.ShouldBind(payload)
+	err := c.ShouldBind(payload)
 	if err != nil {
 		utils.Response(c, utils.StatusBadRequest)
 		return
 	}
 
-	conn := db.DefaultClient
-
-	mmlu := &models.Mmlu{
-		Name:        payload.Name,
-		Description: payload.Description,
-		PhotoURL:    payload.PhotoURL,
-		OwnerId:     session.ID,
-	}
+	mmlu := payload.model()
 
-	validate := validator.New()
+	validate := newValidator()
 	if err := validate.Struct(payload); err != nil {
 		log.Error("Error validating user input", err)
-		errorsMap := make(map[string]string)
-
-		for _, err := range err.(validator.ValidationErrors) {
-			field := err.Field()
-			tag := err.Tag()
-
-			switch tag {
-			case "required":
-				errorsMap[field] = "This field is required!"
-			case "email":
-				errorsMap[field] = "Invalid email format!"
-			case "phone":
-				errorsMap[field] = "Invalid phone number!"
-			default:
-				errorsMap[field] = "Invalid field!"
-			}
-		}
-		customErrors := MmluValidationErrors{
-			Name:        errorsMap["Name"],
-			PhotoURL:    errorsMap["PhotoURL"],
-			Description: errorsMap["Description"],
-		}
-		c.JSON(http.StatusBadRequest, customErrors)
+		c.JSON(http.StatusBadRequest, validationErrors(err))
 		return
 	}
 
-	id := c.Param("id")
-	tx := conn.Where("id = ?", id).Updates(mmlu)
-	if tx.Error != nil {
-		log.Error(tx.Error)
+	if !checkSettings(c, payload) {
+		return
+	}
+
+	before, ok := findMmlu(c, session)
+	if !ok {
+		return
+	}
+
+	err = versioned(session, before.ID, "update", func(tx *gorm.DB) error {
+		return tx.Model(&models.Mmlu{}).
+			Where("id = ?", before.ID).
+			Scopes(utils.OwnedBy(session)).
+			Select(settingColumns).
+			Updates(mmlu).Error
+	})
+	if err != nil {
+		log.Error(err)
 		utils.Response(c, utils.StatusInternalServerError)
 		return
 	}
 
+	after, ok := findMmlu(c, session)
+	if !ok {
+		return
+	}
+	// The knowledge is embedded with a model of the provider.
+	if after.Provider != before.Provider {
+		ingestMmlu(before.ID)
+	}
+	audit.Record(c, &audit.Event{
+		Action:     "mmlu.update",
+		TargetType: "mmlu",
+		TargetID:   before.ID,
+		Before:     snapshot(before),
+		After:      snapshot(after),
+	})
+
 	c.JSON(200, gin.H{"message": "update success"})
 }
 
 func (h *MMLURouter) delete(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
+	session := middlewares.GetUser(c)
+
+	mmlu, ok := findMmlu(c, session)
+	if !ok {
 		return
 	}
 
 	conn := db.DefaultClient
-	id := c.Param("id")
-	tx := conn.Where("id = ?", id).
-		Where(&models.Mmlu{
-			OwnerId: session.ID,
-		}).
+	tx := conn.Where("id = ?", mmlu.ID).
+		Scopes(utils.OwnedBy(session)).
 		Delete(&models.Mmlu{})
 	if tx.Error != nil {
 		log.Error(tx.Error)
@@ -209,20 +227,22 @@ func (h *MMLURouter) delete(c *gin.Context) {
 		return
 	}
 
+	audit.Record(c, &audit.Event{
+		Action:     "mmlu.delete",
+		TargetType: "mmlu",
+		TargetID:   mmlu.ID,
+		Before:     snapshot(mmlu),
+	})
+
 	c.JSON(200, gin.H{"message": "deleted"})
 }
 
 func (h *MMLURouter) find(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	mmlus := &[]Mmlu{}
 	conn := db.DefaultClient
-	tx := conn.Where("deleted_at is null").Where(&models.Mmlu{OwnerId: session.ID}).
+	tx := conn.Where("deleted_at is null").Scopes(utils.OwnedBy(session)).
 		Find(mmlus)
 	if tx.Error != nil {
 		log.Error(tx.Error)
@@ -233,21 +253,15 @@ func (h *MMLURouter) find(c *gin.Context) {
 }
 
 func (h *MMLURouter) findOne(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		c.JSON(401, gin.H{"message": "Unauthorized"})
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	id, _ := strconv.Atoi(c.Param("id"))
 	mmlu := &Mmlu{}
 	conn := db.DefaultClient
 	tx := conn.Where("deleted_at is null").
 		Where("id = ?", id).
-		Where(&models.Mmlu{
-			OwnerId: session.ID,
-		}).First(mmlu)
+		Scopes(utils.OwnedBy(session)).
+		First(mmlu)
 	if tx.Error != nil {
 		log.Error(tx.Error)
 		c.JSON(404, gin.H{"message": "Not found"})
@@ -255,3 +269,173 @@ func (h *MMLURouter) findOne(c *gin.Context) {
 	}
 	c.JSON(200, mmlu)
 }
+
+// findMmlu loads the mmlu of the id param, responding with a 404 if the user
+// can't reach it.
+func findMmlu(c *gin.Context, session *utils.User) (*models.Mmlu, bool) {
+	mmlu := &models.Mmlu{}
+	tx := db.DefaultClient.Where("deleted_at is null").
+		Where("id = ?", c.Param("id")).
+		Scopes(utils.OwnedBy(session)).
+		Limit(1).
+		Find(mmlu)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if mmlu.ID == 0 {
+		c.JSON(404, gin.H{"message": "Not found"})
+		return nil, false
+	}
+	return mmlu, true
+}
+
+// snapshot is what the audit log and the versions keep of an mmlu.
+func snapshot(mmlu *models.Mmlu) *Settings {
+	return &Settings{
+		Name:           mmlu.Name,
+		Description:    mmlu.Description,
+		PhotoURL:       mmlu.PhotoURL,
+		Provider:       mmlu.Provider,
+		Model:          mmlu.Model,
+		SystemPrompt:   mmlu.SystemPrompt,
+		Temperature:    mmlu.Temperature,
+		TopP:           mmlu.TopP,
+		MaxTokens:      mmlu.MaxTokens,
+		Stop:           mmlu.Stop,
+		ContextWindow:  mmlu.ContextWindow,
+		ResponseFormat: mmlu.ResponseFormat,
+		ResponseSchema: mmlu.ResponseSchema,
+	}
+}
+
+// model is the row of the payload. The response schema only applies to the
+// json_schema format.
+func (payload *Mmlu) model() *models.Mmlu {
+	mmlu := &models.Mmlu{
+		Name:           payload.Name,
+		Description:    payload.Description,
+		PhotoURL:       payload.PhotoURL,
+		Provider:       payload.Provider,
+		Model:          payload.Model,
+		SystemPrompt:   payload.SystemPrompt,
+		Temperature:    payload.Temperature,
+		TopP:           payload.TopP,
+		MaxTokens:      payload.MaxTokens,
+		Stop:           payload.Stop,
+		ContextWindow:  payload.ContextWindow,
+		ResponseFormat: payload.ResponseFormat,
+		ResponseSchema: payload.ResponseSchema,
+	}
+	if mmlu.ResponseFormat == "" {
+		mmlu.ResponseFormat = models.ResponseFormatText
+	}
+	if mmlu.ResponseFormat != models.ResponseFormatJSONSchema {
+		mmlu.ResponseSchema = nil
+	}
+	return mmlu
+}
+
+func validationErrors(err error) MmluValidationErrors {
+	errorsMap := make(map[string]string)
+
+	for _, err := range err.(validator.ValidationErrors) {
+		field := err.Field()
+		tag := err.Tag()
+
+		switch tag {
+		case "required":
+			errorsMap[field] = "This field is required!"
+		case "provider":
+			errorsMap[field] = "Provider isn't available!"
+		case "min":
+			errorsMap[field] = "Must be at least " + err.Param() + "!"
+		case "max":
+			errorsMap[field] = "Must be at most " + err.Param() + "!"
+		case "oneof":
+			errorsMap[field] = "Must be one of: " + err.Param() + "!"
+		case "stop":
+			errorsMap[field] = "Up to 4 stop sequences of up to 100 characters!"
+		case "schema":
+			errorsMap[field] = "Must be a JSON schema object!"
+		default:
+			errorsMap[field] = "Invalid field!"
+		}
+	}
+	return MmluValidationErrors{
+		Name:           errorsMap["Name"],
+		PhotoURL:       errorsMap["PhotoURL"],
+		Description:    errorsMap["Description"],
+		Model:          errorsMap["Model"],
+		Provider:       errorsMap["Provider"],
+		SystemPrompt:   errorsMap["SystemPrompt"],
+		Temperature:    errorsMap["Temperature"],
+		TopP:           errorsMap["TopP"],
+		MaxTokens:      errorsMap["MaxTokens"],
+		Stop:           errorsMap["Stop"],
+		ContextWindow:  errorsMap["ContextWindow"],
+		ResponseFormat: errorsMap["ResponseFormat"],
+		ResponseSchema: errorsMap["ResponseSchema"],
+	}
+}
+
+// checkSettings rejects models the catalog doesn't list as available and
+// settings the model can't honor.
+func checkSettings(c *gin.Context, payload *Mmlu) bool {
+	model, err := providers.FindModel(c.Request.Context(), payload.Provider, payload.Model)
+	if err != nil {
+		log.Error("Error getting the model catalog", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return false
+	}
+	if model == nil {
+		c.JSON(http.StatusBadRequest, MmluValidationErrors{
+			Model: "Model isn't available!",
+		})
+		return false
+	}
+	if model.ContextLength > 0 && payload.ContextWindow > model.ContextLength {
+		c.JSON(http.StatusBadRequest, MmluValidationErrors{
+			ContextWindow: fmt.Sprintf("Must be at most %v!", model.ContextLength),
+		})
+		return false
+	}
+	if payload.ResponseFormat == models.ResponseFormatJSONSchema && len(payload.ResponseSchema) == 0 {
+		c.JSON(http.StatusBadRequest, MmluValidationErrors{
+			ResponseSchema: "This field is required!",
+		})
+		return false
+	}
+	return true
+}
+
+// newValidator only accepts providers configured in this server.
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterValidation("provider", func(fl validator.FieldLevel) bool {
+		_, err := providers.Get(fl.Field().String())
+		return err == nil
+	})
+	validate.RegisterValidation("stop", func(fl validator.FieldLevel) bool {
+		stop, _ := fl.Field().Interface().(models.JSONList)
+		if len(stop) > 4 {
+			return false
+		}
+		for _, sequence := range stop {
+			if sequence == "" || len(sequence) > 100 {
+				return false
+			}
+		}
+		return true
+	})
+	validate.RegisterValidation("schema", func(fl validator.FieldLevel) bool {
+		schema, _ := fl.Field().Interface().(models.JSON)
+		if len(schema) == 0 {
+			return true
+		}
+		var object map[string]interface{}
+		return json.Unmarshal(schema, &object) == nil
+	})
+	return validate
+}
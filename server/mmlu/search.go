@@ -0,0 +1,175 @@
+package mmlu
+
+import (
+	"database/sql"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+)
+
+var defaultSearchPageSize = 20
+var maxSearchPageSize = 100
+var maxQueryLength = 256
+
+// The matches are delimited in the snippets with private use characters, so
+// the snippets can be escaped before the delimiters become <mark> tags.
+const (
+	matchStart = "\uE000"
+	matchStop  = "\uE001"
+)
+
+// headlineOptions marks the matches in the snippets, which are at most two
+// fragments of the message.
+const headlineOptions = `StartSel="` + matchStart + `", StopSel="` + matchStop + `", MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" … "`
+
+var highlighter = strings.NewReplacer(matchStart, "<mark>", matchStop, "</mark>")
+
+// highlight escapes the snippet as HTML and marks its matches.
+func highlight(snippet string) string {
+	return highlighter.Replace(html.EscapeString(snippet))
+}
+
+type SearchHit struct {
+	MessageID  uint      `json:"message_id"`
+	MmluID     uint      `json:"mmlu_id"`
+	MmluName   string    `json:"mmlu_name"`
+	Role       string    `json:"role"`
+	Rank       float64   `json:"rank"`
+	Snippet    string    `json:"snippet"`
+	CreationAt time.Time `json:"creation_at"`
+}
+
+type SearchPage struct {
+	Query string      `json:"query"`
+	Items []SearchHit `json:"items"`
+	Total int64       `json:"total"`
+	Page  int         `json:"page"`
+	Limit int         `json:"limit"`
+}
+
+// searchQuery matches the words of @query, stemmed for every search
+// language, like the search_vector of the messages.
+func searchQuery(language string) string {
+	return "websearch_to_tsquery('" + language + "', @query)"
+}
+
+func anyLanguageQuery() string {
+	queries := make([]string, 0, len(models.SearchLanguages))
+	for _, language := range models.SearchLanguages {
+		queries = append(queries, searchQuery(language))
+	}
+	return "(" + strings.Join(queries, " || ") + ")"
+}
+
+// headline highlights the matches of column in the first language they were
+// found with, so the stems agree with the query.
+func headline(column string) string {
+	var expression strings.Builder
+	expression.WriteString("CASE")
+	for i, language := range models.SearchLanguages {
+		query := searchQuery(language)
+		if i == len(models.SearchLanguages)-1 {
+			expression.WriteString(" ELSE ")
+		} else {
+			expression.WriteString(" WHEN to_tsvector('" + language + "', " + column + ") @@ " + query + " THEN ")
+		}
+		expression.WriteString("ts_headline('" + language + "', " + column + ", " + query + ", @options)")
+	}
+	expression.WriteString(" END")
+	return expression.String()
+}
+
+// searchMessages ranks the messages matching q in the mmlu of the path or,
+// without one, in every mmlu the user can see.
+func (h *MMLURouter) searchMessages(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"q": "This field is required!"})
+		return
+	}
+	if len(query) > maxQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"q": "Invalid field!"})
+		return
+	}
+
+	conn := db.DefaultClient
+	mmlus := conn.Model(&models.Mmlu{}).Select("id").Scopes(utils.OwnedBy(session))
+	if c.Param("id") != "" {
+		mmluID, _ := strconv.Atoi(c.Param("id"))
+		mmlu := &models.Mmlu{}
+		tx := conn.Scopes(utils.OwnedBy(session)).Select("id").First(mmlu, mmluID)
+		if tx.Error != nil {
+			utils.Response(c, utils.StatusNotFound)
+			return
+		}
+		mmlus = mmlus.Where("id = ?", mmlu.ID)
+	}
+
+	page, _ := strconv.Atoi(c.Query("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit < 1 {
+		limit = defaultSearchPageSize
+	}
+	if limit > maxSearchPageSize {
+		limit = maxSearchPageSize
+	}
+
+	named := sql.Named("query", query)
+	matching := func() *gorm.DB {
+		return conn.Model(&models.Message{}).
+			Where("messages.mmlu_id IN (?)", mmlus).
+			Where("messages.search_vector @@ "+anyLanguageQuery(), named)
+	}
+
+	result := &SearchPage{Query: query, Items: make([]SearchHit, 0), Page: page, Limit: limit}
+	tx := matching().Count(&result.Total)
+	if tx.Error != nil {
+		log.Error("Error counting messages", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	// Snippets are only built for the page.
+	hits := matching().
+		Select(
+			"messages.id, messages.mmlu_id, messages.role, messages.content, messages.creation_at, "+
+				"ts_rank_cd(messages.search_vector, "+anyLanguageQuery()+", 32) AS rank",
+			named,
+		).
+		Order("rank DESC, messages.id DESC").
+		Offset((page - 1) * limit).
+		Limit(limit)
+	tx = conn.Table("(?) AS hits", hits).
+		Select(
+			"hits.id AS message_id, hits.mmlu_id, mmlus.name AS mmlu_name, hits.role, hits.rank, "+
+				"hits.creation_at, "+headline("hits.content")+" AS snippet",
+			named, sql.Named("options", headlineOptions),
+		).
+		Joins("JOIN mmlus ON mmlus.id = hits.mmlu_id").
+		Order("hits.rank DESC, hits.id DESC").
+		Scan(&result.Items)
+	if tx.Error != nil {
+		log.Error("Error searching messages", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	for i := range result.Items {
+		result.Items[i].Snippet = highlight(result.Items[i].Snippet)
+	}
+
+	c.JSON(200, result)
+}
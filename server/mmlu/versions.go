@@ -0,0 +1,462 @@
+package mmlu
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Settings are what the audit log and the versions keep of an mmlu.
+type Settings struct {
+	Name           string          `json:"name"`
+	Description    string          `json:"description"`
+	PhotoURL       string          `json:"photo_url"`
+	Provider       string          `json:"provider"`
+	Model          string          `json:"model"`
+	SystemPrompt   string          `json:"system_prompt"`
+	Temperature    *float64        `json:"temperature"`
+	TopP           *float64        `json:"top_p"`
+	MaxTokens      int             `json:"max_tokens"`
+	Stop           models.JSONList `json:"stop"`
+	ContextWindow  int             `json:"context_window"`
+	ResponseFormat string          `json:"response_format"`
+	ResponseSchema models.JSON     `json:"response_schema"`
+}
+
+// Apply copies the settings to mmlu.
+func (s *Settings) Apply(mmlu *models.Mmlu) {
+	mmlu.Name = s.Name
+	mmlu.Description = s.Description
+	mmlu.PhotoURL = s.PhotoURL
+	mmlu.Provider = s.Provider
+	mmlu.Model = s.Model
+	mmlu.SystemPrompt = s.SystemPrompt
+	mmlu.Temperature = s.Temperature
+	mmlu.TopP = s.TopP
+	mmlu.MaxTokens = s.MaxTokens
+	mmlu.Stop = s.Stop
+	mmlu.ContextWindow = s.ContextWindow
+	mmlu.ResponseFormat = s.ResponseFormat
+	mmlu.ResponseSchema = s.ResponseSchema
+}
+
+// KnowledgeMessage is a message of an mmlu as kept in its versions.
+type KnowledgeMessage struct {
+	ID      uint        `json:"id"`
+	Role    string      `json:"role"`
+	Content string      `json:"content"`
+	Pages   models.JSON `json:"pages,omitempty"`
+}
+
+func (m *KnowledgeMessage) equal(other *KnowledgeMessage) bool {
+	return m.ID == other.ID && m.Role == other.Role && m.Content == other.Content &&
+		bytes.Equal(m.Pages, other.Pages)
+}
+
+// Version is an MmluVersion with its content decoded. Listings leave the
+// settings and messages out.
+type Version struct {
+	Version    int                `json:"version"`
+	Change     string             `json:"change"`
+	AuthorId   *uint              `json:"author_id"`
+	CreationAt time.Time          `json:"creation_at"`
+	Settings   *Settings          `json:"settings,omitempty"`
+	Messages   []KnowledgeMessage `json:"messages,omitempty"`
+}
+
+func decodeVersion(row *models.MmluVersion) (*Version, error) {
+	version := &Version{
+		Version:    row.Version,
+		Change:     row.Change,
+		AuthorId:   row.AuthorId,
+		CreationAt: row.CreationAt,
+		Settings:   &Settings{},
+		Messages:   make([]KnowledgeMessage, 0),
+	}
+	if err := json.Unmarshal(row.Settings, version.Settings); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(row.Messages, &version.Messages); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// newVersion takes a version of the current settings and messages of the
+// mmlu. The mmlu row is locked so concurrent changes get consecutive numbers.
+func newVersion(tx *gorm.DB, mmluID uint, authorID *uint, change string) (*models.MmluVersion, error) {
+	mmlu := &models.Mmlu{}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(mmlu, mmluID).Error
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*models.Message, 0)
+	if err := tx.Where("mmlu_id = ?", mmluID).Order("id").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	knowledge := make([]KnowledgeMessage, 0, len(messages))
+	for _, message := range messages {
+		knowledge = append(knowledge, KnowledgeMessage{
+			ID:      message.ID,
+			Role:    message.Role,
+			Content: message.Content,
+			Pages:   message.Pages,
+		})
+	}
+
+	settings, err := json.Marshal(snapshot(mmlu))
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(knowledge)
+	if err != nil {
+		return nil, err
+	}
+
+	version := &models.MmluVersion{
+		MmluId:   mmluID,
+		Version:  mmlu.Version + 1,
+		Change:   change,
+		Settings: settings,
+		Messages: content,
+		AuthorId: authorID,
+	}
+	if err := tx.Create(version).Error; err != nil {
+		return nil, err
+	}
+	err = tx.Model(&models.Mmlu{}).
+		Where("id = ?", mmluID).
+		UpdateColumn("version", version.Version).Error
+	return version, err
+}
+
+// versioned runs write and takes a new version of the mmlu in the same
+// transaction, so every change is kept.
+func versioned(session *utils.User, mmluID uint, change string, write func(tx *gorm.DB) error) error {
+	return db.DefaultClient.Transaction(func(tx *gorm.DB) error {
+		if err := write(tx); err != nil {
+			return err
+		}
+		_, err := newVersion(tx, mmluID, &session.ID, change)
+		return err
+	})
+}
+
+// LoadVersion returns a version of the mmlu, or its latest one when version
+// is nil. Mmlus that haven't changed since versions exist get their first
+// one taken here.
+func LoadVersion(mmluID uint, version *int) (*Version, error) {
+	conn := db.DefaultClient
+	number := 0
+	if version != nil {
+		number = *version
+	} else {
+		mmlu := &models.Mmlu{}
+		if err := conn.Select("id", "version").First(mmlu, mmluID).Error; err != nil {
+			return nil, err
+		}
+		number = mmlu.Version
+	}
+
+	if number == 0 {
+		var row *models.MmluVersion
+		err := conn.Transaction(func(tx *gorm.DB) error {
+			var err error
+			row, err = firstVersion(tx, mmluID)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return decodeVersion(row)
+	}
+
+	row := &models.MmluVersion{}
+	err := conn.Where("mmlu_id = ? AND version = ?", mmluID, number).First(row).Error
+	if err != nil {
+		return nil, err
+	}
+	return decodeVersion(row)
+}
+
+// firstVersion takes the first version of the mmlu, unless a concurrent
+// request took it since the mmlu was read, in which case that one is
+// returned. The mmlu row is locked to decide.
+func firstVersion(tx *gorm.DB, mmluID uint) (*models.MmluVersion, error) {
+	mmlu := &models.Mmlu{}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "version").
+		First(mmlu, mmluID).Error
+	if err != nil {
+		return nil, err
+	}
+	if mmlu.Version == 0 {
+		return newVersion(tx, mmluID, nil, "create")
+	}
+
+	row := &models.MmluVersion{}
+	err = tx.Where("mmlu_id = ? AND version = ?", mmluID, mmlu.Version).First(row).Error
+	return row, err
+}
+
+func (h *MMLURouter) findVersions(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	mmlu, ok := findMmlu(c, session)
+	if !ok {
+		return
+	}
+
+	rows := make([]*models.MmluVersion, 0)
+	tx := db.DefaultClient.
+		Select("version", "change", "author_id", "creation_at").
+		Where("mmlu_id = ?", mmlu.ID).
+		Order("version DESC").
+		Find(&rows)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	versions := make([]*Version, 0, len(rows))
+	for _, row := range rows {
+		versions = append(versions, &Version{
+			Version:    row.Version,
+			Change:     row.Change,
+			AuthorId:   row.AuthorId,
+			CreationAt: row.CreationAt,
+		})
+	}
+	c.JSON(200, gin.H{"current": mmlu.Version, "versions": versions})
+}
+
+func (h *MMLURouter) findVersion(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	mmlu, ok := findMmlu(c, session)
+	if !ok {
+		return
+	}
+	version, ok := findVersion(c, mmlu.ID, c.Param("version"))
+	if !ok {
+		return
+	}
+	c.JSON(200, version)
+}
+
+// MessageChange is a knowledge message added, removed or edited between two
+// versions. Before is nil for added messages and After for removed ones.
+type MessageChange struct {
+	ID     uint              `json:"id"`
+	Before *KnowledgeMessage `json:"before"`
+	After  *KnowledgeMessage `json:"after"`
+}
+
+type VersionDiff struct {
+	From     int                     `json:"from"`
+	To       int                     `json:"to"`
+	Settings map[string]audit.Change `json:"settings"`
+	Messages []MessageChange         `json:"messages"`
+}
+
+// diffVersions compares the versions of the from and to params, by default
+// the latest version and the one before it.
+func (h *MMLURouter) diffVersions(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	mmlu, ok := findMmlu(c, session)
+	if !ok {
+		return
+	}
+
+	to := c.DefaultQuery("to", strconv.Itoa(mmlu.Version))
+	toVersion, ok := findVersion(c, mmlu.ID, to)
+	if !ok {
+		return
+	}
+	from := c.DefaultQuery("from", strconv.Itoa(toVersion.Version-1))
+	fromVersion, ok := findVersion(c, mmlu.ID, from)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, &VersionDiff{
+		From:     fromVersion.Version,
+		To:       toVersion.Version,
+		Settings: audit.Diff(fromVersion.Settings, toVersion.Settings),
+		Messages: diffMessages(fromVersion.Messages, toVersion.Messages),
+	})
+}
+
+func diffMessages(from, to []KnowledgeMessage) []MessageChange {
+	previous := make(map[uint]*KnowledgeMessage, len(from))
+	for i := range from {
+		previous[from[i].ID] = &from[i]
+	}
+
+	changes := make([]MessageChange, 0)
+	current := make(map[uint]bool, len(to))
+	for i := range to {
+		message := &to[i]
+		current[message.ID] = true
+		before, ok := previous[message.ID]
+		if !ok || !before.equal(message) {
+			changes = append(changes, MessageChange{ID: message.ID, Before: before, After: message})
+		}
+	}
+	for i := range from {
+		if !current[from[i].ID] {
+			changes = append(changes, MessageChange{ID: from[i].ID, Before: &from[i]})
+		}
+	}
+	return changes
+}
+
+// rollback restores the settings and messages of a version. The restore is
+// itself a new version, so it can be rolled back too.
+func (h *MMLURouter) rollback(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	mmlu, ok := findMmlu(c, session)
+	if !ok {
+		return
+	}
+	target, ok := findVersion(c, mmlu.ID, c.Param("version"))
+	if !ok {
+		return
+	}
+
+	// The model of an old version may not be in the catalog anymore.
+	restored := &models.Mmlu{}
+	target.Settings.Apply(restored)
+	if !checkSettings(c, &Mmlu{
+		Provider:       restored.Provider,
+		Model:          restored.Model,
+		ContextWindow:  restored.ContextWindow,
+		ResponseFormat: restored.ResponseFormat,
+		ResponseSchema: restored.ResponseSchema,
+	}) {
+		return
+	}
+
+	var version *models.MmluVersion
+	err := db.DefaultClient.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Mmlu{}).
+			Where("id = ?", mmlu.ID).
+			Select(settingColumns).
+			Updates(restored).Error
+		if err != nil {
+			return err
+		}
+		if err := restoreMessages(tx, mmlu, target.Messages); err != nil {
+			return err
+		}
+		version, err = newVersion(tx, mmlu.ID, &session.ID, "rollback")
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	ingestMmlu(mmlu.ID)
+
+	audit.Record(c, &audit.Event{
+		Action:     "mmlu.rollback",
+		TargetType: "mmlu",
+		TargetID:   mmlu.ID,
+		Before:     snapshot(mmlu),
+		After:      target.Settings,
+	})
+
+	c.JSON(200, gin.H{"message": "rollback success", "version": version.Version})
+}
+
+// restoreMessages leaves the mmlu with the messages of a version, undeleting
+// or recreating them as needed and deleting the ones added since.
+func restoreMessages(tx *gorm.DB, mmlu *models.Mmlu, messages []KnowledgeMessage) error {
+	keep := make([]uint, 0, len(messages))
+	for _, message := range messages {
+		result := tx.Unscoped().Model(&models.Message{}).
+			Where("id = ? AND mmlu_id = ?", message.ID, mmlu.ID).
+			Updates(map[string]interface{}{
+				"role":       message.Role,
+				"content":    message.Content,
+				"pages":      message.Pages,
+				"deleted_at": nil,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		id := message.ID
+		if result.RowsAffected == 0 {
+			row := &models.Message{
+				Content:     message.Content,
+				Role:        message.Role,
+				Pages:       message.Pages,
+				MmluId:      mmlu.ID,
+				OwnerId:     mmlu.OwnerId,
+				WorkspaceId: mmlu.WorkspaceId,
+			}
+			if err := tx.Create(row).Error; err != nil {
+				return err
+			}
+			id = row.ID
+		}
+		keep = append(keep, id)
+	}
+
+	stale := tx.Where("mmlu_id = ?", mmlu.ID)
+	if len(keep) > 0 {
+		stale = stale.Where("id NOT IN ?", keep)
+	}
+	return stale.Delete(&models.Message{}).Error
+}
+
+// findVersion loads a version of the mmlu, responding with a 404 if it
+// doesn't exist.
+func findVersion(c *gin.Context, mmluID uint, param string) (*Version, bool) {
+	number, err := strconv.Atoi(param)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Not found"})
+		return nil, false
+	}
+
+	row := &models.MmluVersion{}
+	tx := db.DefaultClient.
+		Where("mmlu_id = ? AND version = ?", mmluID, number).
+		Limit(1).
+		Find(row)
+	if tx.Error != nil {
+		log.Error(tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if row.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Not found"})
+		return nil, false
+	}
+
+	version, err := decodeVersion(row)
+	if err != nil {
+		log.Error(err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	return version, true
+}
@@ -1,27 +1,22 @@
 package models
 
 import (
-	"os"
-	"strings"
-
 	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/providers"
+	"github.com/juliotorresmoreno/tana-api/utils"
 )
 
-type Model struct {
-	Code     string `json:"code"`
-	Provider string `json:"provider"`
-}
+var log = logger.SetupLogger()
 
 func SetupAPIRoutes(g *gin.RouterGroup) {
 	g.GET("", func(ctx *gin.Context) {
-		models := strings.Split(os.Getenv("OLLAMA_MODELS"), " ")
-		result := []*Model{}
-		for _, model := range models {
-			result = append(result, &Model{
-				Code:     model,
-				Provider: "ollama",
-			})
+		models, err := providers.Catalog(ctx.Request.Context())
+		if err != nil {
+			log.Error("Error getting the model catalog", err)
+			utils.Response(ctx, utils.StatusInternalServerError)
+			return
 		}
-		ctx.JSON(200, result)
+		ctx.JSON(200, models)
 	})
 }
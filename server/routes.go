@@ -2,23 +2,49 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/server/admin"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
 	"github.com/juliotorresmoreno/tana-api/server/auth"
 	"github.com/juliotorresmoreno/tana-api/server/connections"
 	"github.com/juliotorresmoreno/tana-api/server/conversation"
 	"github.com/juliotorresmoreno/tana-api/server/credentials"
 	"github.com/juliotorresmoreno/tana-api/server/events"
+	"github.com/juliotorresmoreno/tana-api/server/jobs"
 	"github.com/juliotorresmoreno/tana-api/server/mmlu"
 	"github.com/juliotorresmoreno/tana-api/server/models"
+	"github.com/juliotorresmoreno/tana-api/server/uploads"
 	"github.com/juliotorresmoreno/tana-api/server/users"
+	"github.com/juliotorresmoreno/tana-api/server/workspaces"
 )
 
 func SetupAPIRoutes(r *gin.RouterGroup) {
 	auth.SetupAPIRoutes(r)
-	mmlu.SetupAPIRoutes(r.Group("/mmlu"))
-	users.SetupAPIRoutes(r.Group("/users"))
 	events.SetupAPIRoutes(r.Group("/events"))
 	models.SetupAPIRoutes(r.Group("/models"))
-	connections.SetupAPIRoutes(r.Group("/connections"))
-	credentials.SetupAPIRoutes(r.Group("/credentials"))
-	conversation.SetupAPIRoutes(r.Group("/conversation"))
+	admin.SetupAPIRoutes(r.Group("/admin", middlewares.Authorize(middlewares.PolicyAdmin)))
+
+	authenticated := middlewares.Authorize(middlewares.PolicyAuthenticated)
+	mmlu.SetupAPIRoutes(r.Group("/mmlu", authenticated))
+	users.SetupAPIRoutes(r.Group("/users", authenticated, middlewares.Scope("user")))
+	workspaces.SetupAPIRoutes(r.Group("/workspaces", authenticated, middlewares.Scope("workspace")))
+	audit.SetupAPIRoutes(r.Group("/audit", authenticated, middlewares.Scope("audit")))
+	jobs.SetupAPIRoutes(r.Group("/jobs", authenticated, middlewares.Scope("job")))
+	connections.SetupAPIRoutes(r.Group("/connections",
+		authenticated,
+		middlewares.Permission("connection"),
+	))
+	credentials.SetupAPIRoutes(r.Group("/credentials",
+		authenticated,
+		middlewares.Permission("credential"),
+	))
+	uploads.SetupAPIRoutes(r.Group("/uploads",
+		authenticated,
+		middlewares.Permission("upload"),
+	))
+	conversation.SetupAPIRoutes(r.Group("/conversation",
+		authenticated,
+		middlewares.RequireVerified(),
+		middlewares.Permission("conversation"),
+	))
 }
@@ -0,0 +1,230 @@
+package uploads
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/docextract"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+// multipartOverhead leaves room for the boundaries and headers of a
+// multipart body on top of the file itself.
+const multipartOverhead = 64 << 10
+
+// MaxAttachmentSize is the largest attachment accepted, in bytes, from
+// ATTACHMENT_MAX_SIZE.
+func MaxAttachmentSize() int64 {
+	return int64(utils.IntFromEnv("ATTACHMENT_MAX_SIZE", 20<<20))
+}
+
+// AllowedTypes are the attachment types accepted, from ATTACHMENT_TYPES as a
+// comma separated list. By default every type docextract supports.
+func AllowedTypes() []string {
+	value := os.Getenv("ATTACHMENT_TYPES")
+	if value == "" {
+		return docextract.Supported()
+	}
+	allowed := make([]string, 0)
+	for _, mime := range strings.Split(value, ",") {
+		if mime = strings.TrimSpace(mime); mime != "" {
+			allowed = append(allowed, mime)
+		}
+	}
+	return allowed
+}
+
+func allowedType(mime string) bool {
+	for _, allowed := range AllowedTypes() {
+		if allowed == mime {
+			return true
+		}
+	}
+	return false
+}
+
+func tooLarge(c *gin.Context) {
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"message":  "Attachment too large",
+		"max_size": MaxAttachmentSize(),
+	})
+}
+
+func unsupportedType(c *gin.Context, mime string) {
+	c.JSON(http.StatusUnsupportedMediaType, gin.H{
+		"message": "Unsupported attachment type",
+		"type":    mime,
+		"allowed": AllowedTypes(),
+	})
+}
+
+func isTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+// AttachPayload is the JSON body of the attach endpoints. The attachment is
+// either a base64 data URL or the id of a finished upload.
+type AttachPayload struct {
+	Attachment string `json:"attachment"`
+	UploadID   string `json:"upload_id"`
+	// Name is the file name, it tells Markdown apart from plain text.
+	Name string `json:"name"`
+}
+
+// Attachment is an attachment received by an attach endpoint. It waits in
+// the upload dir until a job extracts it.
+type Attachment struct {
+	File     string `json:"file"`
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+}
+
+func (a *Attachment) path() string {
+	return filepath.Join(uploadDir(), a.File)
+}
+
+// Extract reads the text of the attachment.
+func (a *Attachment) Extract() (*docextract.Document, error) {
+	data, err := os.ReadFile(a.path())
+	if err != nil {
+		return nil, err
+	}
+	return docextract.ExtractAs(data, a.MimeType)
+}
+
+// Remove deletes the attachment once it is no longer needed.
+func (a *Attachment) Remove() {
+	err := os.Remove(a.path())
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Error removing attachment", err)
+	}
+}
+
+// ReceiveAttachment stores the attachment of the request after checking its
+// size and type. The attachment comes as the file field of a
+// multipart/form-data body or as an AttachPayload. On failure the error is
+// already written to the response.
+func ReceiveAttachment(c *gin.Context) (*Attachment, bool) {
+	if err := os.MkdirAll(uploadDir(), 0700); err != nil {
+		log.Error("Error creating upload dir", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	attachment := &Attachment{File: utils.GenerateRandomFileName("attachment-", "")}
+
+	hints, ok := receiveAttachment(c, attachment)
+	if !ok {
+		attachment.Remove()
+		return nil, false
+	}
+
+	mime, err := sniff(attachment.path(), hints...)
+	if err != nil && err != docextract.ErrUnsupported {
+		log.Error("Error reading attachment", err)
+		attachment.Remove()
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if err != nil || !allowedType(mime) {
+		attachment.Remove()
+		unsupportedType(c, mime)
+		return nil, false
+	}
+	attachment.MimeType = mime
+	return attachment, true
+}
+
+// receiveAttachment writes the attachment to its file and returns the hints
+// of its type.
+func receiveAttachment(c *gin.Context, attachment *Attachment) ([]string, bool) {
+	max := MaxAttachmentSize()
+
+	if c.ContentType() == "multipart/form-data" {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max+multipartOverhead)
+		file, header, err := c.Request.FormFile("file")
+		if isTooLarge(err) {
+			tooLarge(c)
+			return nil, false
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"file": "This field is required!"})
+			return nil, false
+		}
+		defer file.Close()
+
+		if header.Size > max {
+			tooLarge(c)
+			return nil, false
+		}
+		attachment.Name = header.Filename
+		if err := writeAttachment(attachment, file); err != nil {
+			log.Error("Error writing attachment", err)
+			utils.Response(c, utils.StatusInternalServerError)
+			return nil, false
+		}
+		return []string{header.Filename, header.Header.Get("Content-Type")}, true
+	}
+
+	// Base64 takes four bytes for every three.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max/3*4+multipartOverhead)
+	payload := &AttachPayload{}
+	if err := c.ShouldBindJSON(payload); err != nil {
+		if isTooLarge(err) {
+			tooLarge(c)
+			return nil, false
+		}
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return nil, false
+	}
+	attachment.Name = payload.Name
+
+	if payload.UploadID != "" {
+		upload, err := claim(middlewares.GetUser(c).ID, payload.UploadID, attachment.path())
+		if err != nil {
+			utils.Response(c, err)
+			return nil, false
+		}
+		if attachment.Name == "" {
+			attachment.Name = upload.Name
+		}
+		return []string{payload.Name, upload.Name, upload.Type}, true
+	}
+
+	data, declared, err := utils.DecodeBase64File(payload.Attachment)
+	if err != nil {
+		log.Error("Error decoding attachment", err)
+		utils.Response(c, err)
+		return nil, false
+	}
+	if int64(len(data)) > max {
+		tooLarge(c)
+		return nil, false
+	}
+	if err := writeAttachment(attachment, bytes.NewReader(data)); err != nil {
+		log.Error("Error writing attachment", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	return []string{payload.Name, declared}, true
+}
+
+func writeAttachment(attachment *Attachment, content io.Reader) error {
+	file, err := os.OpenFile(attachment.path(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
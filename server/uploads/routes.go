@@ -0,0 +1,438 @@
+// Package uploads receives attachments in chunks so big files can be sent
+// over unreliable connections. A client creates an upload with the size of
+// the file, sends the chunks with PATCH from the offset the server reports
+// and, once complete, hands the upload id to an attach endpoint instead of
+// the file.
+package uploads
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/docextract"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+var log = logger.SetupLogger()
+
+var cleanInterval = time.Hour
+
+// uploadTTL is how long an upload is kept since it was created, from
+// UPLOAD_TTL.
+func uploadTTL() time.Duration {
+	return utils.DurationFromEnv("UPLOAD_TTL", 24*time.Hour)
+}
+
+// Setup checks where uploads are kept. Attachments are read by whichever
+// instance runs their job, so in production UPLOAD_DIR must be set to a
+// directory every instance mounts.
+func Setup() error {
+	if os.Getenv("ENV") == "production" && os.Getenv("UPLOAD_DIR") == "" {
+		return errors.New("UPLOAD_DIR must be set to a directory shared by every instance")
+	}
+	return os.MkdirAll(uploadDir(), 0700)
+}
+
+// uploadDir is where the chunks are written, from UPLOAD_DIR, and defaults
+// to a temporary directory that only works with a single instance.
+func uploadDir() string {
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "tana-uploads")
+}
+
+var errUploadIncomplete = &utils.HttpResponse{
+	Status: http.StatusConflict,
+	Obj:    utils.HttpError{Message: "Upload incomplete"},
+}
+
+var errUploadBusy = &utils.HttpResponse{
+	Status: http.StatusConflict,
+	Obj:    utils.HttpError{Message: "Upload in progress"},
+}
+
+type UploadsRouter struct {
+}
+
+func SetupAPIRoutes(r *gin.RouterGroup) {
+	go runCleaner()
+
+	uploads := &UploadsRouter{}
+	r.POST("", uploads.create)
+	r.GET("/:id", uploads.findOne)
+	r.PATCH("/:id", uploads.write)
+	r.DELETE("/:id", uploads.delete)
+}
+
+type Upload struct {
+	ID        string    `json:"id"`
+	OwnerId   uint      `json:"-"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type,omitempty"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Complete  bool      `json:"complete"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func uploadKey(id string) string {
+	return "upload-" + id
+}
+
+func (u *Upload) path() string {
+	return filepath.Join(uploadDir(), u.ID)
+}
+
+// cachedUpload keeps the owner, left out of the responses, in the cache.
+type cachedUpload struct {
+	*Upload
+	OwnerId uint `json:"owner_id"`
+}
+
+func (u *Upload) save(ctx context.Context) error {
+	u.Complete = u.Offset == u.Size
+	data, err := json.Marshal(&cachedUpload{Upload: u, OwnerId: u.OwnerId})
+	if err != nil {
+		return err
+	}
+	return db.DefaultCache.Set(ctx, uploadKey(u.ID), data, time.Until(u.ExpiresAt)).Err()
+}
+
+// sniff returns the type of the file at path, from the start of its content
+// as that is all mimetype looks at.
+func sniff(path string, hints ...string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 3072)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return docextract.Detect(head[:n], hints...)
+}
+
+// findUpload returns the upload of the owner, StatusNotFound when there is
+// none or it belongs to somebody else.
+func findUpload(ctx context.Context, ownerID uint, id string) (*Upload, error) {
+	data, err := db.DefaultCache.Get(ctx, uploadKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, utils.StatusNotFound
+	}
+	if err != nil {
+		log.Error("Error getting upload", err)
+		return nil, utils.StatusInternalServerError
+	}
+	cached := &cachedUpload{Upload: &Upload{}}
+	if err := json.Unmarshal(data, cached); err != nil {
+		log.Error("Error decoding upload", err)
+		return nil, utils.StatusInternalServerError
+	}
+	upload := cached.Upload
+	upload.OwnerId = cached.OwnerId
+	if upload.OwnerId != ownerID {
+		return nil, utils.StatusNotFound
+	}
+	return upload, nil
+}
+
+// lock keeps two requests from writing the same upload at once.
+func lock(ctx context.Context, id string) (func(), error) {
+	key := "upload-lock-" + id
+	locked, err := db.DefaultCache.SetNX(ctx, key, 1, time.Hour).Result()
+	if err != nil {
+		log.Error("Error locking upload", err)
+		return nil, utils.StatusInternalServerError
+	}
+	if !locked {
+		return nil, errUploadBusy
+	}
+	return func() { db.DefaultCache.Del(context.Background(), key) }, nil
+}
+
+func removeUpload(upload *Upload) {
+	db.DefaultCache.Del(context.Background(), uploadKey(upload.ID))
+	err := os.Remove(upload.path())
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Error removing upload", err)
+	}
+}
+
+type CreatePayload struct {
+	Name string `json:"name" validate:"required,max=255"`
+	Type string `json:"type" validate:"max=255"`
+	Size int64  `json:"size" validate:"required,min=1"`
+}
+
+type CreateValidationErrors struct {
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"`
+	Size string `json:"size,omitempty"`
+}
+
+func (h *UploadsRouter) create(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &CreatePayload{}
+	if err := c.ShouldBindJSON(payload); err != nil {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(payload); err != nil {
+		errorsMap := make(map[string]string)
+		for _, err := range err.(validator.ValidationErrors) {
+			switch err.Tag() {
+			case "required":
+				errorsMap[err.Field()] = "This field is required!"
+			default:
+				errorsMap[err.Field()] = "Invalid field!"
+			}
+		}
+		c.JSON(http.StatusBadRequest, CreateValidationErrors{
+			Name: errorsMap["Name"],
+			Type: errorsMap["Type"],
+			Size: errorsMap["Size"],
+		})
+		return
+	}
+
+	if payload.Size > MaxAttachmentSize() {
+		tooLarge(c)
+		return
+	}
+
+	id, err := utils.GenerateRandomString(32)
+	if err != nil {
+		log.Error("Error generating upload id", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	upload := &Upload{
+		ID:        id,
+		OwnerId:   session.ID,
+		Name:      payload.Name,
+		Type:      payload.Type,
+		Size:      payload.Size,
+		ExpiresAt: time.Now().Add(uploadTTL()),
+	}
+
+	if err := os.MkdirAll(uploadDir(), 0700); err != nil {
+		log.Error("Error creating upload dir", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	file, err := os.OpenFile(upload.path(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error("Error creating upload", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	file.Close()
+
+	if err := upload.save(c); err != nil {
+		log.Error("Error saving upload", err)
+		removeUpload(upload)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Upload-Offset", "0")
+	c.JSON(http.StatusCreated, upload)
+}
+
+func (h *UploadsRouter) findOne(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	upload, err := findUpload(c, session.ID, c.Param("id"))
+	if err != nil {
+		utils.Response(c, err)
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.JSON(200, upload)
+}
+
+// write appends the body of the request to the upload. The Upload-Offset
+// header must match the offset of the upload, so a client that lost a
+// response asks for the upload and resumes from there.
+func (h *UploadsRouter) write(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid Upload-Offset header"})
+		return
+	}
+
+	unlock, err := lock(c, c.Param("id"))
+	if err != nil {
+		utils.Response(c, err)
+		return
+	}
+	defer unlock()
+
+	upload, err := findUpload(c, session.ID, c.Param("id"))
+	if err != nil {
+		utils.Response(c, err)
+		return
+	}
+	if offset != upload.Offset {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "Offset mismatch",
+			"offset":  upload.Offset,
+		})
+		return
+	}
+
+	file, err := os.OpenFile(upload.path(), os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error("Error opening upload", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Seek(upload.Offset, io.SeekStart); err != nil {
+		log.Error("Error seeking upload", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	// Whatever was received before a failure is kept, the client resumes
+	// from the new offset.
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, upload.Size-upload.Offset)
+	written, copyErr := io.Copy(file, body)
+	upload.Offset += written
+	if err := upload.save(c); err != nil {
+		log.Error("Error saving upload", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if isTooLarge(copyErr) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message": "Chunk exceeds the size of the upload",
+			"offset":  upload.Offset,
+			"size":    upload.Size,
+		})
+		return
+	}
+	if copyErr != nil {
+		log.Error("Error writing upload", copyErr)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Upload interrupted",
+			"offset":  upload.Offset,
+		})
+		return
+	}
+
+	// The type is known once the upload is complete, there is no point in
+	// keeping one that can't be attached.
+	if upload.Complete {
+		mime, err := sniff(upload.path(), upload.Name, upload.Type)
+		if err != nil && err != docextract.ErrUnsupported {
+			log.Error("Error reading upload", err)
+			utils.Response(c, utils.StatusInternalServerError)
+			return
+		}
+		if err != nil || !allowedType(mime) {
+			removeUpload(upload)
+			unsupportedType(c, mime)
+			return
+		}
+	}
+
+	c.JSON(200, upload)
+}
+
+func (h *UploadsRouter) delete(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	upload, err := findUpload(c, session.ID, c.Param("id"))
+	if err != nil {
+		utils.Response(c, err)
+		return
+	}
+	removeUpload(upload)
+
+	c.JSON(200, gin.H{"message": "Upload deleted"})
+}
+
+// claim moves the file of a complete upload to path and removes the upload,
+// an upload is attached only once.
+func claim(ownerID uint, id string, path string) (*Upload, error) {
+	ctx := context.Background()
+	unlock, err := lock(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	upload, err := findUpload(ctx, ownerID, id)
+	if err != nil {
+		return nil, err
+	}
+	if !upload.Complete {
+		return nil, errUploadIncomplete
+	}
+	if err := os.Rename(upload.path(), path); err != nil {
+		log.Error("Error claiming upload", err)
+		return nil, utils.StatusInternalServerError
+	}
+	removeUpload(upload)
+	return upload, nil
+}
+
+// runCleaner periodically removes the files of the uploads that expired, and
+// those of attachments no job picked up in as long.
+func runCleaner() {
+	for {
+		clean()
+		time.Sleep(cleanInterval)
+	}
+}
+
+func clean() {
+	entries, err := os.ReadDir(uploadDir())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error("Error reading upload dir", err)
+		}
+		return
+	}
+	expired := time.Now().Add(-uploadTTL())
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(expired) {
+			continue
+		}
+		exists, err := db.DefaultCache.Exists(context.Background(), uploadKey(entry.Name())).Result()
+		if err != nil || exists > 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(uploadDir(), entry.Name())); err != nil {
+			log.Error("Error removing upload", err)
+		}
+	}
+}
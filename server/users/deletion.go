@@ -0,0 +1,252 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/mailer"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+)
+
+var purgeInterval = time.Hour
+
+// deletionGracePeriod is how long an account can still be recovered after
+// its deletion was requested, from ACCOUNT_DELETION_GRACE_PERIOD.
+func deletionGracePeriod() time.Duration {
+	return utils.DurationFromEnv("ACCOUNT_DELETION_GRACE_PERIOD", 14*24*time.Hour)
+}
+
+type DeletePayload struct {
+	Password string `json:"password"`
+}
+
+// deleteMe schedules the deletion of the account. Until the grace period is
+// over the user can still sign in and cancel it.
+func (h *UsersRouter) deleteMe(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &DeletePayload{}
+	if err := c.ShouldBindJSON(payload); err != nil && err != io.EOF {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select("id", "email", "password", "deletion_scheduled_at").First(user, session.ID)
+	if tx.Error != nil {
+		log.Error("Error getting user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	// Accounts created through oauth have no password to confirm.
+	if user.Password != "" {
+		if ok, _ := utils.ComparePassword(payload.Password, user.Password); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"password": "Invalid password!"})
+			return
+		}
+	}
+
+	if user.DeletionScheduledAt != nil {
+		c.JSON(200, gin.H{"deletion_scheduled_at": user.DeletionScheduledAt})
+		return
+	}
+
+	count := int64(0)
+	tx = conn.Model(&models.WorkspaceMember{}).
+		Joins("JOIN workspaces ON workspaces.id = workspace_members.workspace_id AND workspaces.deleted_at IS NULL").
+		Where("workspaces.owner_id = ? AND workspace_members.user_id <> ?", session.ID, session.ID).
+		Count(&count)
+	if tx.Error != nil {
+		log.Error("Error getting workspaces", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Delete your workspaces or remove their members before deleting your account",
+		})
+		return
+	}
+
+	scheduledAt := time.Now().Add(deletionGracePeriod())
+	tx = conn.Model(user).Update("deletion_scheduled_at", scheduledAt)
+	if tx.Error != nil {
+		log.Error("Error scheduling deletion", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	err := mailer.Send(&mailer.Message{
+		To:      user.Email,
+		Subject: "Your account will be deleted",
+		Body: fmt.Sprintf(
+			"Your account and all of its data will be deleted on %s. To keep it, sign in and cancel the deletion from your account before then: %s",
+			scheduledAt.UTC().Format("January 2, 2006 15:04 MST"), os.Getenv("FRONTEND_BASE_URL"),
+		),
+	})
+	if err != nil {
+		log.Error("Error sending deletion notice", err)
+	}
+
+	audit.Record(c, &audit.Event{
+		Action:     "user.deletion_request",
+		TargetType: "user",
+		TargetID:   session.ID,
+		After:      gin.H{"deletion_scheduled_at": scheduledAt},
+	})
+
+	c.JSON(200, gin.H{"deletion_scheduled_at": scheduledAt})
+}
+
+func (h *UsersRouter) cancelDeletion(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	tx := db.DefaultClient.Model(&models.User{}).
+		Where("id = ? AND deletion_scheduled_at IS NOT NULL", session.ID).
+		Update("deletion_scheduled_at", nil)
+	if tx.Error != nil {
+		log.Error("Error canceling deletion", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "No deletion is scheduled"})
+		return
+	}
+
+	audit.Record(c, &audit.Event{
+		Action:     "user.deletion_cancel",
+		TargetType: "user",
+		TargetID:   session.ID,
+	})
+
+	c.JSON(200, gin.H{"message": "Deletion canceled"})
+}
+
+// runPurger periodically purges the accounts whose grace period is over and
+// the exports that expired.
+func runPurger() {
+	for {
+		purge()
+		time.Sleep(purgeInterval)
+	}
+}
+
+func purge() {
+	// Only one instance purges at a time.
+	ctx := context.Background()
+	locked, err := db.DefaultCache.SetNX(ctx, "account-purge-lock", 1, purgeInterval/2).Result()
+	if err != nil {
+		log.Error("Error locking purge", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	users := make([]*models.User, 0)
+	tx := db.DefaultClient.Unscoped().
+		Select("id").
+		Where("deletion_scheduled_at <= ?", time.Now()).
+		Find(&users)
+	if tx.Error != nil {
+		log.Error("Error getting accounts to purge", tx.Error)
+		return
+	}
+	for _, user := range users {
+		if err := purgeUser(user.ID); err != nil {
+			log.Error("Error purging account", user.ID, err)
+			continue
+		}
+		log.WithField("user_id", user.ID).Info("Account purged")
+	}
+
+	exports := make([]*models.DataExport, 0)
+	tx = db.DefaultClient.Where("expires_at <= ?", time.Now()).Find(&exports)
+	if tx.Error != nil {
+		log.Error("Error getting expired exports", tx.Error)
+		return
+	}
+	for _, export := range exports {
+		removeExport(export)
+		db.DefaultClient.Delete(export)
+	}
+}
+
+func removeExport(export *models.DataExport) {
+	if export.FileName == "" {
+		return
+	}
+	err := os.Remove(filepath.Join(exportDir(), export.FileName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Error removing export", err)
+	}
+}
+
+// purgeUser hard deletes the user and every row it owns, including the
+// workspaces it owns along with their content. The audit log is kept.
+func purgeUser(userID uint) error {
+	exports := make([]*models.DataExport, 0)
+	if tx := db.DefaultClient.Where("user_id = ?", userID).Find(&exports); tx.Error != nil {
+		return tx.Error
+	}
+	for _, export := range exports {
+		removeExport(export)
+	}
+
+	err := db.DefaultClient.Transaction(func(tx *gorm.DB) error {
+		// A session so every statement below starts from the unscoped db
+		// instead of piling up conditions on a shared one.
+		tx = tx.Unscoped().Session(&gorm.Session{})
+		workspaces := tx.Model(&models.Workspace{}).Select("id").Where("owner_id = ?", userID)
+		mmlus := tx.Model(&models.Mmlu{}).Select("id").
+			Where("owner_id = ? OR workspace_id IN (?)", userID, workspaces)
+		connections := tx.Model(&models.Connection{}).Select("id").
+			Where("owner_id = ? OR workspace_id IN (?) OR mmlu_id IN (?)", userID, workspaces, mmlus)
+
+		deletes := []struct {
+			model interface{}
+			where string
+			args  []interface{}
+		}{
+			{&models.ConversationMessage{}, "user_id = ? OR connection_id IN (?)", []interface{}{userID, connections}},
+			{&models.Message{}, "owner_id = ? OR workspace_id IN (?) OR mmlu_id IN (?)", []interface{}{userID, workspaces, mmlus}},
+			{&models.Connection{}, "owner_id = ? OR workspace_id IN (?) OR mmlu_id IN (?)", []interface{}{userID, workspaces, mmlus}},
+			{&models.MmluVersion{}, "mmlu_id IN (?)", []interface{}{mmlus}},
+			{&models.Credential{}, "owner_id = ? OR workspace_id IN (?)", []interface{}{userID, workspaces}},
+			{&models.Mmlu{}, "id IN (?)", []interface{}{mmlus}},
+			{&models.WorkspaceInvitation{}, "invited_by_id = ? OR workspace_id IN (?)", []interface{}{userID, workspaces}},
+			{&models.WorkspaceMember{}, "user_id = ? OR workspace_id IN (?)", []interface{}{userID, workspaces}},
+			{&models.Workspace{}, "owner_id = ?", []interface{}{userID}},
+			{&models.RecoveryCode{}, "user_id = ?", []interface{}{userID}},
+			{&models.UserIdentity{}, "user_id = ?", []interface{}{userID}},
+			{&models.SignInAttempt{}, "user_id = ?", []interface{}{userID}},
+			{&models.DataExport{}, "user_id = ?", []interface{}{userID}},
+			{&models.User{}, "id = ?", []interface{}{userID}},
+		}
+		for _, d := range deletes {
+			if err := tx.Where(d.where, d.args...).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return utils.RevokeUserSessions(userID)
+}
@@ -0,0 +1,358 @@
+package users
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/queue"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+var exportTTL = 7 * 24 * time.Hour
+
+// Setup checks where exports are kept. Archives are built by whichever
+// instance runs their job and downloaded from any, so in production
+// EXPORT_DIR must be set to a directory every instance mounts.
+func Setup() error {
+	if os.Getenv("ENV") == "production" && os.Getenv("EXPORT_DIR") == "" {
+		return errors.New("EXPORT_DIR must be set to a directory shared by every instance")
+	}
+	return os.MkdirAll(exportDir(), 0700)
+}
+
+// exportDir is where archives are kept until they expire, from EXPORT_DIR,
+// and defaults to a temporary directory that only works with a single
+// instance.
+func exportDir() string {
+	if dir := os.Getenv("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "tana-exports")
+}
+
+type DataExport struct {
+	ID          uint       `json:"id"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size"`
+	Error       string     `json:"error,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreationAt  time.Time  `json:"creation_at"`
+}
+
+func newDataExport(export *models.DataExport) DataExport {
+	result := DataExport{
+		ID:          export.ID,
+		Status:      export.Status,
+		Size:        export.Size,
+		Error:       export.Error,
+		ExpiresAt:   export.ExpiresAt,
+		CompletedAt: export.CompletedAt,
+		CreationAt:  export.CreationAt,
+	}
+	if exportAvailable(export) {
+		result.DownloadURL = fmt.Sprintf("%s/me/exports/%d/download", basePath, export.ID)
+	}
+	return result
+}
+
+func exportAvailable(export *models.DataExport) bool {
+	return export.Status == models.DataExportReady &&
+		export.ExpiresAt != nil &&
+		time.Now().Before(*export.ExpiresAt)
+}
+
+// createExport starts building an archive with the data of the user. Only one
+// export can be pending at a time.
+func (h *UsersRouter) createExport(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	conn := db.DefaultClient
+	export := &models.DataExport{}
+	tx := conn.Where("user_id = ? AND status = ?", session.ID, models.DataExportPending).
+		Limit(1).
+		Find(export)
+	if tx.Error != nil {
+		log.Error("Error getting exports", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if export.ID != 0 {
+		c.JSON(http.StatusAccepted, newDataExport(export))
+		return
+	}
+
+	export = &models.DataExport{
+		UserId: session.ID,
+		Status: models.DataExportPending,
+	}
+	tx = conn.Create(export)
+	if tx.Error != nil {
+		log.Error("Error creating export", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	// The queue retries the export when it fails or its instance stops, so
+	// it doesn't stay pending.
+	if _, err := queue.Enqueue(c, session.ID, exportJobType, &exportJob{ExportID: export.ID}); err != nil {
+		log.Error("Error queuing export", err)
+		conn.Delete(export)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	audit.Record(c, &audit.Event{
+		Action:     "user.export",
+		TargetType: "user",
+		TargetID:   session.ID,
+	})
+
+	c.JSON(http.StatusAccepted, newDataExport(export))
+}
+
+func (h *UsersRouter) findExports(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	exports := make([]*models.DataExport, 0)
+	tx := db.DefaultClient.Where("user_id = ?", session.ID).
+		Order("id desc").
+		Limit(20).
+		Find(&exports)
+	if tx.Error != nil {
+		log.Error("Error getting exports", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	result := make([]DataExport, 0, len(exports))
+	for _, export := range exports {
+		result = append(result, newDataExport(export))
+	}
+	c.JSON(200, result)
+}
+
+func findExport(c *gin.Context) (*models.DataExport, bool) {
+	session := middlewares.GetUser(c)
+
+	export := &models.DataExport{}
+	tx := db.DefaultClient.Where("id = ? AND user_id = ?", c.Param("id"), session.ID).
+		Limit(1).
+		Find(export)
+	if tx.Error != nil {
+		log.Error("Error getting export", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if export.ID == 0 {
+		utils.Response(c, utils.StatusNotFound)
+		return nil, false
+	}
+	return export, true
+}
+
+func (h *UsersRouter) findExport(c *gin.Context) {
+	export, ok := findExport(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, newDataExport(export))
+}
+
+func (h *UsersRouter) downloadExport(c *gin.Context) {
+	export, ok := findExport(c)
+	if !ok {
+		return
+	}
+	if !exportAvailable(export) {
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+
+	c.FileAttachment(
+		filepath.Join(exportDir(), export.FileName),
+		fmt.Sprintf("tana-export-%s.zip", export.CreationAt.Format("2006-01-02")),
+	)
+}
+
+const exportJobType = "user.export"
+
+type exportJob struct {
+	ExportID uint `json:"export_id"`
+}
+
+// runExportJob writes the archive of the export and marks it as ready. When
+// the job is given up failExport marks it as failed.
+func runExportJob(ctx context.Context, job *queue.Job) (interface{}, error) {
+	payload := &exportJob{}
+	if err := job.Decode(payload); err != nil {
+		return nil, queue.Permanent(err)
+	}
+
+	conn := db.DefaultClient.WithContext(ctx)
+	export := &models.DataExport{}
+	tx := conn.Where("id = ? AND status = ?", payload.ExportID, models.DataExportPending).
+		Limit(1).
+		Find(export)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if export.ID == 0 {
+		return nil, queue.Permanent(errors.New("The export no longer exists"))
+	}
+
+	fileName, size, err := writeExport(export)
+	if err != nil {
+		log.Error("Error building export", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(exportTTL)
+	export.Status = models.DataExportReady
+	export.FileName = fileName
+	export.Size = size
+	export.CompletedAt = &now
+	export.ExpiresAt = &expiresAt
+	tx = conn.Model(export).
+		Select("status", "file_name", "size", "completed_at", "expires_at").
+		Updates(export)
+	if tx.Error != nil {
+		os.Remove(filepath.Join(exportDir(), fileName))
+		return nil, tx.Error
+	}
+	return newDataExport(export), nil
+}
+
+// failExport marks the export of a job that was given up as failed.
+func failExport(ctx context.Context, job *queue.Job) {
+	payload := &exportJob{}
+	if err := job.Decode(payload); err != nil {
+		return
+	}
+	tx := db.DefaultClient.WithContext(ctx).Model(&models.DataExport{}).
+		Where("id = ? AND status = ?", payload.ExportID, models.DataExportPending).
+		Updates(map[string]interface{}{
+			"status": models.DataExportFailed,
+			"error":  "The export couldn't be built, please try again later",
+		})
+	if tx.Error != nil {
+		log.Error("Error updating export", tx.Error)
+	}
+}
+
+type exportFile struct {
+	Name string
+	Data interface{}
+}
+
+func writeExport(export *models.DataExport) (string, int64, error) {
+	files, err := collectUserData(export.UserId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := os.MkdirAll(exportDir(), 0700); err != nil {
+		return "", 0, err
+	}
+	name, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return "", 0, err
+	}
+	fileName := fmt.Sprintf("%d-%s.zip", export.ID, name)
+	path := filepath.Join(exportDir(), fileName)
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(path + ".tmp")
+
+	archive := zip.NewWriter(f)
+	for _, file := range files {
+		w, err := archive.Create(file.Name)
+		if err != nil {
+			f.Close()
+			return "", 0, err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.Data); err != nil {
+			f.Close()
+			return "", 0, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return fileName, info.Size(), nil
+}
+
+// collectUserData gathers everything stored about the user. Secrets, like
+// password hashes, api secrets and oauth tokens, are left out.
+func collectUserData(userID uint) ([]exportFile, error) {
+	conn := db.DefaultClient
+
+	profile := &User{}
+	if tx := conn.Table(tablename).Where("id = ?", userID).First(profile); tx.Error != nil {
+		return nil, tx.Error
+	}
+	files := []exportFile{{Name: "profile.json", Data: profile}}
+
+	queries := []struct {
+		name    string
+		table   string
+		columns string
+		where   string
+	}{
+		{"mmlus.json", "mmlus", "id, name, description, photo_url, model, provider, workspace_id, creation_at, updated_at", "owner_id = ? AND deleted_at IS NULL"},
+		{"messages.json", "messages", "id, mmlu_id, workspace_id, role, content, creation_at, updated_at", "owner_id = ? AND deleted_at IS NULL"},
+		{"mmlu_versions.json", "mmlu_versions", "mmlu_id, version, change, settings, messages, creation_at", "author_id = ?"},
+		{"connections.json", "connections", "id, name, description, photo_url, mmlu_id, mmlu_version, workspace_id, creation_at, updated_at", "owner_id = ? AND deleted_at IS NULL"},
+		{"credentials.json", "credentials", "id, api_key, secret_prefix, scopes, allowed_ips, expires_at, last_used, workspace_id, creation_at, updated_at", "owner_id = ? AND deleted_at IS NULL"},
+		{"identities.json", "user_identities", "provider, email, creation_at", "user_id = ?"},
+		{"sign_in_attempts.json", "sign_in_attempts", "ip, user_agent, success, reason, creation_at", "user_id = ?"},
+		{"workspaces.json", "workspace_members", "workspace_id, role, creation_at", "user_id = ?"},
+		{"conversations.json", "conversation_messages", "connection_id, role, content, creation_at", "user_id = ?"},
+	}
+	for _, query := range queries {
+		rows := make([]map[string]interface{}, 0)
+		tx := conn.Table(query.table).
+			Select(query.columns).
+			Where(query.where, userID).
+			Order("creation_at").
+			Find(&rows)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		files = append(files, exportFile{Name: query.name, Data: rows})
+	}
+
+	return files, nil
+}
@@ -1,53 +1,76 @@
 package users
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator"
 	"github.com/juliotorresmoreno/tana-api/db"
 	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/mailer"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
 	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/queue"
+	"github.com/juliotorresmoreno/tana-api/server/audit"
+	"github.com/juliotorresmoreno/tana-api/server/auth"
 	"github.com/juliotorresmoreno/tana-api/utils"
 )
 
 var log = logger.SetupLogger()
 var tablename = models.User{}.TableName()
 
+// basePath is where the routes are mounted, used to build download links.
+var basePath string
+
 type UsersRouter struct {
 }
 
 func SetupAPIRoutes(r *gin.RouterGroup) {
+	go runPurger()
+	queue.Register(exportJobType, runExportJob)
+	queue.OnFailure(exportJobType, failExport)
+	basePath = r.BasePath()
+
 	users := &UsersRouter{}
 	r.GET("/me", users.findMe)
 	r.PATCH("/me", users.updateMe)
+	r.DELETE("/me", users.deleteMe)
+	r.POST("/me/cancel-deletion", users.cancelDeletion)
+	r.POST("/me/password", users.changePassword)
+	r.POST("/me/export", users.createExport)
+	r.GET("/me/exports", users.findExports)
+	r.GET("/me/exports/:id", users.findExport)
+	r.GET("/me/exports/:id/download", users.downloadExport)
 }
 
 type User struct {
-	ID           uint       `json:"id"`
-	Verified     bool       `json:"verified"`
-	Name         string     `json:"name" validate:"omitempty,min=2,max=100"`
-	LastName     string     `json:"last_name" validate:"omitempty,min=2,max=100"`
-	Email        string     `json:"email" validate:"omitempty,email"`
-	PhotoURL     string     `json:"photo_url"`
-	Phone        string     `json:"phone" validate:"omitempty,min=7,max=15"`
-	Business     string     `json:"business"`
-	PositionName string     `json:"position_name"`
-	Url          string     `json:"url" validate:"omitempty,url"`
-	Description  string     `json:"description" validate:"max=1000"`
-	CreationAt   time.Time  `json:"creation_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
-	DeletedAt    *time.Time `json:"deleted_at"`
+	ID           uint   `json:"id"`
+	Verified     bool   `json:"verified"`
+	Name         string `json:"name" validate:"omitempty,min=2,max=100"`
+	LastName     string `json:"last_name" validate:"omitempty,min=2,max=100"`
+	Email        string `json:"email" validate:"omitempty,email"`
+	PhotoURL     string `json:"photo_url"`
+	Phone        string `json:"phone" validate:"omitempty,min=7,max=15"`
+	Business     string `json:"business"`
+	PositionName string `json:"position_name"`
+	Url          string `json:"url" validate:"omitempty,url"`
+	Description  string `json:"description" validate:"max=1000"`
+
+	// CurrentPassword is only read, to change the email.
+	CurrentPassword string `json:"current_password,omitempty" gorm:"-"`
+
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at"`
+	CreationAt          time.Time  `json:"creation_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	DeletedAt           *time.Time `json:"deleted_at"`
 }
 
 func (h *UsersRouter) findMe(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		utils.Response(c, err)
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	conn := db.DefaultClient
 	user := &User{}
@@ -71,12 +94,7 @@ type UpdateValidationErrors struct {
 }
 
 func (h *UsersRouter) updateMe(c *gin.Context) {
-	session, err := utils.ValidateSession(c)
-	if err != nil {
-		log.Error("Error validating session", err)
-		utils.Response(c, err)
-		return
-	}
+	session := middlewares.GetUser(c)
 
 	var userInput User
 	if err := c.BindJSON(&userInput); err != nil {
@@ -120,12 +138,142 @@ func (h *UsersRouter) updateMe(c *gin.Context) {
 	}
 
 	conn := db.DefaultClient
-	tx := conn.Table(tablename).Where("id = ?", session.ID).Updates(&userInput)
+	before := &User{}
+	tx := conn.Table(tablename).Where("id = ?", session.ID).First(before)
+	if tx.Error != nil {
+		log.Error("Error getting user", tx.Error)
+		utils.Response(c, tx.Error)
+		return
+	}
+
+	// The email receives the password resets, so changing it asks for the
+	// password like changing the password does.
+	emailChanged := userInput.Email != "" && !strings.EqualFold(userInput.Email, before.Email)
+	if emailChanged {
+		user := &models.User{}
+		tx := conn.Select("id", "password").First(user, session.ID)
+		if tx.Error != nil {
+			log.Error("Error getting user", tx.Error)
+			utils.Response(c, utils.StatusInternalServerError)
+			return
+		}
+		ok, err := utils.ComparePassword(userInput.CurrentPassword, user.Password)
+		if !ok || err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"current_password": "Password incorrect",
+			})
+			return
+		}
+	}
+
+	// Verification and deletion have their own flows.
+	tx = conn.Table(tablename).
+		Where("id = ?", session.ID).
+		Omit("id", "verified", "deletion_scheduled_at").
+		Updates(&userInput)
 	if tx.Error != nil {
 		log.Error("Error updating user", tx.Error)
 		utils.Response(c, tx.Error)
 		return
 	}
 
+	// A new email has to be verified again, and the previous one hears about
+	// the change in case it wasn't the owner.
+	if emailChanged {
+		user := &models.User{ID: session.ID, Email: userInput.Email}
+		tx = conn.Model(user).Update("verified", false)
+		if tx.Error != nil {
+			log.Error("Error updating user", tx.Error)
+			utils.Response(c, tx.Error)
+			return
+		}
+		if err := auth.SendValidationCode(user); err != nil {
+			log.Error("Error sending validation code", err)
+		}
+		if err := sendEmailChangeNotice(before.Email, userInput.Email); err != nil {
+			log.Error("Error sending email change notice", err)
+		}
+	}
+
+	after := &User{}
+	tx = conn.Table(tablename).Where("id = ?", session.ID).First(after)
+	if tx.Error != nil {
+		log.Error("Error getting user", tx.Error)
+		utils.Response(c, tx.Error)
+		return
+	}
+	audit.Record(c, &audit.Event{
+		Action:     "user.update",
+		TargetType: "user",
+		TargetID:   session.ID,
+		Before:     before,
+		After:      after,
+	})
+
 	c.JSON(200, gin.H{"message": "Profile updated successfully"})
 }
+
+func sendEmailChangeNotice(previous, email string) error {
+	return mailer.Send(&mailer.Message{
+		To:      previous,
+		Subject: "Your email was changed",
+		Body: fmt.Sprintf(
+			"The email of your account was changed to %s. If you didn't change it, reset your password and contact support: %s",
+			email, os.Getenv("FRONTEND_BASE_URL"),
+		),
+	})
+}
+
+type ChangePasswordPayload struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+func (h *UsersRouter) changePassword(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &ChangePasswordPayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select("id", "password").First(user, session.ID)
+	if tx.Error != nil {
+		log.Error("Error getting user", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	ok, err := utils.ComparePassword(payload.CurrentPassword, user.Password)
+	if !ok || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"current_password": "Password incorrect",
+		})
+		return
+	}
+
+	if !auth.IsValidPassword(payload.Password) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"password": "Password does not meet requirements!",
+		})
+		return
+	}
+
+	if err := auth.ChangePassword(session.ID, payload.Password); err != nil {
+		log.Error("Error changing password", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	audit.Record(c, &audit.Event{
+		Action:     "user.password_change",
+		TargetType: "user",
+		TargetID:   session.ID,
+	})
+
+	c.JSON(200, gin.H{"message": "Password updated successfully"})
+}
@@ -0,0 +1,245 @@
+package workspaces
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/mailer"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var invitationTTL = 7 * 24 * time.Hour
+var workspaceRoles = []string{
+	middlewares.WorkspaceRoleAdmin,
+	middlewares.WorkspaceRoleMember,
+	middlewares.WorkspaceRoleViewer,
+}
+
+type Invitation struct {
+	ID          uint      `json:"id"`
+	Email       string    `json:"email"`
+	Role        string    `json:"role"`
+	InvitedById uint      `json:"invited_by_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreationAt  time.Time `json:"creation_at"`
+}
+
+// Only a hash of the invitation token is stored, like for api secrets.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *WorkspacesRouter) findInvitations(c *gin.Context) {
+	workspace, ok := findManaged(c)
+	if !ok {
+		return
+	}
+
+	invitations := make([]Invitation, 0)
+	tx := db.DefaultClient.Model(&models.WorkspaceInvitation{}).
+		Where("workspace_id = ? AND accepted_at IS NULL AND expires_at > ?", workspace.ID, time.Now()).
+		Order("creation_at desc").
+		Find(&invitations)
+	if tx.Error != nil {
+		log.Error("Error getting invitations", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, invitations)
+}
+
+type InvitePayload struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+func (h *WorkspacesRouter) invite(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	workspace, ok := findManaged(c)
+	if !ok {
+		return
+	}
+
+	payload := &InvitePayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+	payload.Email = strings.ToLower(strings.TrimSpace(payload.Email))
+	if payload.Role == "" {
+		payload.Role = middlewares.WorkspaceRoleMember
+	}
+	if err := validator.New().Var(payload.Email, "required,email,max=300"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"email": "Invalid email format!"})
+		return
+	}
+	if !middlewares.ValidWorkspaceRole(payload.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"role": "Must be one of " + strings.Join(workspaceRoles, ", ")})
+		return
+	}
+
+	count := int64(0)
+	tx := db.DefaultClient.Model(&models.WorkspaceMember{}).
+		Joins("JOIN users ON users.id = workspace_members.user_id").
+		Where("workspace_members.workspace_id = ? AND lower(users.email) = ?", workspace.ID, payload.Email).
+		Count(&count)
+	if tx.Error != nil {
+		log.Error("Error getting members", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"email": "Already a member of the workspace!"})
+		return
+	}
+
+	token, err := utils.GenerateRandomString(64)
+	if err != nil {
+		log.Error("Error generating token", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	invitation := &models.WorkspaceInvitation{
+		WorkspaceId: workspace.ID,
+		Email:       payload.Email,
+		Role:        payload.Role,
+		TokenHash:   hashToken(token),
+		InvitedById: session.ID,
+		ExpiresAt:   time.Now().Add(invitationTTL),
+	}
+	err = db.DefaultClient.Transaction(func(tx *gorm.DB) error {
+		// A new invitation replaces the pending ones for the same email.
+		err := tx.Where("workspace_id = ? AND email = ? AND accepted_at IS NULL", workspace.ID, payload.Email).
+			Delete(&models.WorkspaceInvitation{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(invitation).Error
+	})
+	if err != nil {
+		log.Error("Error creating invitation", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	err = mailer.Send(&mailer.Message{
+		To:      payload.Email,
+		Subject: fmt.Sprintf("You were invited to %s", workspace.Name),
+		Body: fmt.Sprintf(
+			"%s %s invited you to the workspace %s. Use this link to join it: %s/workspace-invitation?token=%s\n\nIt expires in %d days.",
+			session.Name, session.LastName, workspace.Name,
+			os.Getenv("FRONTEND_BASE_URL"), token, int(invitationTTL.Hours()/24),
+		),
+	})
+	if err != nil {
+		log.Error("Error sending invitation", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, &Invitation{
+		ID:          invitation.ID,
+		Email:       invitation.Email,
+		Role:        invitation.Role,
+		InvitedById: invitation.InvitedById,
+		ExpiresAt:   invitation.ExpiresAt,
+		CreationAt:  invitation.CreationAt,
+	})
+}
+
+func (h *WorkspacesRouter) revokeInvitation(c *gin.Context) {
+	workspace, ok := findManaged(c)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.
+		Where("id = ? AND workspace_id = ? AND accepted_at IS NULL", paramID(c, "invitationId"), workspace.ID).
+		Delete(&models.WorkspaceInvitation{})
+	if tx.Error != nil {
+		log.Error("Error revoking invitation", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		utils.Response(c, utils.StatusNotFound)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "deleted"})
+}
+
+type AcceptPayload struct {
+	Token string `json:"token"`
+}
+
+// acceptInvitation adds the user to the workspace. The invitation must have
+// been sent to the email of the account accepting it.
+func (h *WorkspacesRouter) acceptInvitation(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &AcceptPayload{}
+	if err := c.ShouldBind(payload); err != nil || payload.Token == "" {
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	invalid := gin.H{"message": "Invalid or expired invitation"}
+	invitation := &models.WorkspaceInvitation{}
+	tx := db.DefaultClient.
+		Joins("JOIN workspaces ON workspaces.id = workspace_invitations.workspace_id AND workspaces.deleted_at IS NULL").
+		Where("workspace_invitations.token_hash = ?", hashToken(payload.Token)).
+		Where("workspace_invitations.accepted_at IS NULL AND workspace_invitations.expires_at > ?", time.Now()).
+		Limit(1).
+		Find(invitation)
+	if tx.Error != nil {
+		log.Error("Error getting invitation", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	if invitation.ID == 0 {
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+	if !strings.EqualFold(invitation.Email, session.Email) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "The invitation was sent to another email"})
+		return
+	}
+
+	err := db.DefaultClient.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.WorkspaceMember{
+				WorkspaceId: invitation.WorkspaceId,
+				UserId:      session.ID,
+				Role:        invitation.Role,
+			}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(invitation).Update("accepted_at", time.Now()).Error
+	})
+	if err != nil {
+		log.Error("Error accepting invitation", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"workspace_id": invitation.WorkspaceId})
+}
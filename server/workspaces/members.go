@@ -0,0 +1,134 @@
+package workspaces
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+)
+
+type Member struct {
+	UserId     uint      `json:"user_id"`
+	Name       string    `json:"name"`
+	LastName   string    `json:"last_name"`
+	Email      string    `json:"email"`
+	PhotoURL   string    `json:"photo_url"`
+	Role       string    `json:"role"`
+	CreationAt time.Time `json:"creation_at"`
+}
+
+func (h *WorkspacesRouter) findMembers(c *gin.Context) {
+	workspace, ok := findMembership(c)
+	if !ok {
+		return
+	}
+
+	members := make([]Member, 0)
+	tx := db.DefaultClient.Table(models.WorkspaceMember{}.TableName()).
+		Select("workspace_members.user_id, users.name, users.last_name, users.email, users.photo_url, workspace_members.role, workspace_members.creation_at").
+		Joins("JOIN users ON users.id = workspace_members.user_id AND users.deleted_at IS NULL").
+		Where("workspace_members.workspace_id = ?", workspace.ID).
+		Order("workspace_members.creation_at").
+		Find(&members)
+	if tx.Error != nil {
+		log.Error("Error getting members", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, members)
+}
+
+// findMember loads a member of the workspace other than its owner, whose
+// membership can't be changed.
+func findMember(c *gin.Context, workspace *Workspace) (*models.WorkspaceMember, bool) {
+	member := &models.WorkspaceMember{}
+	tx := db.DefaultClient.
+		Where("workspace_id = ? AND user_id = ?", workspace.ID, paramID(c, "userId")).
+		Limit(1).
+		Find(member)
+	if tx.Error != nil {
+		log.Error("Error getting member", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if member.ID == 0 {
+		utils.Response(c, utils.StatusNotFound)
+		return nil, false
+	}
+	if member.Role == middlewares.WorkspaceRoleOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The owner of the workspace can't be changed"})
+		return nil, false
+	}
+	return member, true
+}
+
+type MemberPayload struct {
+	Role string `json:"role"`
+}
+
+func (h *WorkspacesRouter) updateMember(c *gin.Context) {
+	workspace, ok := findManaged(c)
+	if !ok {
+		return
+	}
+
+	payload := &MemberPayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+	if !middlewares.ValidWorkspaceRole(payload.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"role": "Must be one of " + strings.Join(workspaceRoles, ", ")})
+		return
+	}
+
+	member, ok := findMember(c, workspace)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Model(member).Update("role", payload.Role)
+	if tx.Error != nil {
+		log.Error("Error updating member", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "update success"})
+}
+
+// removeMember lets owners and admins remove members, and members leave the
+// workspace on their own.
+func (h *WorkspacesRouter) removeMember(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	workspace, ok := findMembership(c)
+	if !ok {
+		return
+	}
+	if paramID(c, "userId") != session.ID && !middlewares.CanManageWorkspace(workspace.Role) {
+		utils.Response(c, utils.NewForbidden("workspace:manage"))
+		return
+	}
+
+	member, ok := findMember(c, workspace)
+	if !ok {
+		return
+	}
+
+	tx := db.DefaultClient.Delete(member)
+	if tx.Error != nil {
+		log.Error("Error removing member", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "deleted"})
+}
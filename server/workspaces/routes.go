@@ -0,0 +1,295 @@
+package workspaces
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/logger"
+	"github.com/juliotorresmoreno/tana-api/middlewares"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"github.com/juliotorresmoreno/tana-api/utils"
+	"gorm.io/gorm"
+)
+
+var log = logger.SetupLogger()
+var tablename = models.Workspace{}.TableName()
+
+type WorkspacesRouter struct {
+}
+
+func SetupAPIRoutes(r *gin.RouterGroup) {
+	h := &WorkspacesRouter{}
+	r.GET("", h.find)
+	r.POST("", h.create)
+	r.POST("/switch", h.switchWorkspace)
+	r.POST("/invitations/accept", h.acceptInvitation)
+	r.GET("/:id", h.findOne)
+	r.PATCH("/:id", h.update)
+	r.DELETE("/:id", h.delete)
+
+	r.GET("/:id/members", h.findMembers)
+	r.PATCH("/:id/members/:userId", h.updateMember)
+	r.DELETE("/:id/members/:userId", h.removeMember)
+
+	r.GET("/:id/invitations", h.findInvitations)
+	r.POST("/:id/invitations", h.invite)
+	r.DELETE("/:id/invitations/:invitationId", h.revokeInvitation)
+}
+
+type Workspace struct {
+	ID         uint      `json:"id"`
+	Name       string    `json:"name"`
+	OwnerId    uint      `json:"owner_id"`
+	Role       string    `json:"role"`
+	Active     bool      `json:"active" gorm:"-"`
+	CreationAt time.Time `json:"creation_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type WorkspacePayload struct {
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+type WorkspaceValidationErrors struct {
+	Name string `json:"name,omitempty"`
+}
+
+// memberships selects the workspaces of the user along with its role in each.
+func memberships(userID uint) *gorm.DB {
+	return db.DefaultClient.Table(tablename).
+		Select("workspaces.id, workspaces.name, workspaces.owner_id, workspace_members.role, workspaces.creation_at, workspaces.updated_at").
+		Joins("JOIN workspace_members ON workspace_members.workspace_id = workspaces.id").
+		Where("workspace_members.user_id = ? AND workspaces.deleted_at IS NULL", userID)
+}
+
+// findMembership loads a workspace the user belongs to, responding with a
+// 404 otherwise so workspaces of others can't be discovered.
+func findMembership(c *gin.Context) (*Workspace, bool) {
+	session := middlewares.GetUser(c)
+
+	workspace := &Workspace{}
+	tx := memberships(session.ID).
+		Where("workspaces.id = ?", c.Param("id")).
+		Limit(1).
+		Find(workspace)
+	if tx.Error != nil {
+		log.Error("Error getting workspace", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return nil, false
+	}
+	if workspace.ID == 0 {
+		utils.Response(c, utils.StatusNotFound)
+		return nil, false
+	}
+	workspace.Active = workspace.ID == session.WorkspaceID
+	return workspace, true
+}
+
+// findManaged is findMembership for the actions only owners and admins of the
+// workspace can perform.
+func findManaged(c *gin.Context) (*Workspace, bool) {
+	workspace, ok := findMembership(c)
+	if !ok {
+		return nil, false
+	}
+	if !middlewares.CanManageWorkspace(workspace.Role) {
+		utils.Response(c, utils.NewForbidden("workspace:manage"))
+		return nil, false
+	}
+	return workspace, true
+}
+
+func validateWorkspace(payload *WorkspacePayload) (WorkspaceValidationErrors, bool) {
+	validate := validator.New()
+	if err := validate.Struct(payload); err != nil {
+		customErrors := WorkspaceValidationErrors{}
+		for _, err := range err.(validator.ValidationErrors) {
+			switch err.Tag() {
+			case "required":
+				customErrors.Name = "This field is required!"
+			default:
+				customErrors.Name = "Invalid field!"
+			}
+		}
+		return customErrors, false
+	}
+	return WorkspaceValidationErrors{}, true
+}
+
+func (h *WorkspacesRouter) find(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	workspaces := make([]Workspace, 0)
+	tx := memberships(session.ID).
+		Order("workspaces.name").
+		Find(&workspaces)
+	if tx.Error != nil {
+		log.Error("Error getting workspaces", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+	for i := range workspaces {
+		workspaces[i].Active = workspaces[i].ID == session.WorkspaceID
+	}
+
+	c.JSON(200, workspaces)
+}
+
+func (h *WorkspacesRouter) findOne(c *gin.Context) {
+	workspace, ok := findMembership(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, workspace)
+}
+
+func (h *WorkspacesRouter) create(c *gin.Context) {
+	session := middlewares.GetUser(c)
+
+	payload := &WorkspacePayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+	if customErrors, ok := validateWorkspace(payload); !ok {
+		log.Error("Error validating user input", customErrors)
+		c.JSON(http.StatusBadRequest, customErrors)
+		return
+	}
+
+	workspace := &models.Workspace{
+		Name:    payload.Name,
+		OwnerId: session.ID,
+	}
+	err := db.DefaultClient.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(workspace).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.WorkspaceMember{
+			WorkspaceId: workspace.ID,
+			UserId:      session.ID,
+			Role:        middlewares.WorkspaceRoleOwner,
+		}).Error
+	})
+	if err != nil {
+		log.Error("Error creating workspace", err)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, &Workspace{
+		ID:         workspace.ID,
+		Name:       workspace.Name,
+		OwnerId:    workspace.OwnerId,
+		Role:       middlewares.WorkspaceRoleOwner,
+		CreationAt: workspace.CreationAt,
+		UpdatedAt:  workspace.UpdatedAt,
+	})
+}
+
+func (h *WorkspacesRouter) update(c *gin.Context) {
+	workspace, ok := findManaged(c)
+	if !ok {
+		return
+	}
+
+	payload := &WorkspacePayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+	if customErrors, ok := validateWorkspace(payload); !ok {
+		log.Error("Error validating user input", customErrors)
+		c.JSON(http.StatusBadRequest, customErrors)
+		return
+	}
+
+	tx := db.DefaultClient.Model(&models.Workspace{}).
+		Where("id = ?", workspace.ID).
+		Update("name", payload.Name)
+	if tx.Error != nil {
+		log.Error("Error updating workspace", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "update success"})
+}
+
+// delete is reserved to the owner. The resources of the workspace are kept
+// but can't be reached anymore.
+func (h *WorkspacesRouter) delete(c *gin.Context) {
+	workspace, ok := findMembership(c)
+	if !ok {
+		return
+	}
+	if workspace.Role != middlewares.WorkspaceRoleOwner {
+		utils.Response(c, utils.NewForbidden("workspace:delete"))
+		return
+	}
+
+	tx := db.DefaultClient.Delete(&models.Workspace{}, workspace.ID)
+	if tx.Error != nil {
+		log.Error("Error deleting workspace", tx.Error)
+		utils.Response(c, utils.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "deleted"})
+}
+
+type SwitchPayload struct {
+	// WorkspaceID is the workspace to activate, zero or null for the
+	// personal space.
+	WorkspaceID uint `json:"workspace_id"`
+}
+
+func (h *WorkspacesRouter) switchWorkspace(c *gin.Context) {
+	session := middlewares.GetUser(c)
+	if session.Scopes != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Credentials are bound to the workspace they were created in",
+		})
+		return
+	}
+
+	payload := &SwitchPayload{}
+	if err := c.ShouldBind(payload); err != nil {
+		log.Error("Error binding payload", err)
+		utils.Response(c, utils.StatusBadRequest)
+		return
+	}
+
+	if payload.WorkspaceID != 0 {
+		role, err := utils.WorkspaceRole(payload.WorkspaceID, session.ID)
+		if err != nil {
+			log.Error("Error getting workspace", err)
+			utils.Response(c, utils.StatusInternalServerError)
+			return
+		}
+		if role == "" {
+			utils.Response(c, utils.StatusNotFound)
+			return
+		}
+	}
+
+	if err := utils.SwitchWorkspace(c, payload.WorkspaceID); err != nil {
+		log.Error("Error switching workspace", err)
+		utils.Response(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"workspace_id": payload.WorkspaceID})
+}
+
+func paramID(c *gin.Context, name string) uint {
+	id, _ := strconv.Atoi(c.Param(name))
+	return uint(id)
+}
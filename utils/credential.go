@@ -0,0 +1,417 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/models"
+)
+
+const (
+	ApiKeyHeader       = "X-Api-Key"
+	ApiTimestampHeader = "X-Api-Timestamp"
+	ApiNonceHeader     = "X-Api-Nonce"
+	ApiSignatureHeader = "X-Api-Signature"
+	// ApiContentHashHeader carries the hex encoded SHA-256 of the body, so
+	// the body can be signed without being buffered.
+	ApiContentHashHeader = "X-Content-SHA256"
+)
+
+// Signed requests older or newer than this are rejected, and nonces are
+// remembered for twice as long so they can't be replayed inside the window.
+var signatureMaxSkew = 5 * time.Minute
+
+const secretPrefixLength = 6
+
+// signedBodyLimit is the largest body buffered to check a signature, from
+// SIGNED_BODY_MAX_SIZE in bytes. Bigger bodies have to be sent along with
+// X-Content-SHA256.
+func signedBodyLimit() int64 {
+	return int64(IntFromEnv("SIGNED_BODY_MAX_SIZE", 1<<20))
+}
+
+var errBodyHashMismatch = errors.New("body doesn't match X-Content-SHA256")
+
+// HasCredential reports whether the request tries to authenticate with an
+// API key pair instead of a session token.
+func HasCredential(c *gin.Context) bool {
+	if c.Request.Header.Get(ApiKeyHeader) != "" {
+		return true
+	}
+	authorization := c.Request.Header.Get("authorization")
+	return len(authorization) > 6 && strings.ToLower(authorization[:6]) == "basic "
+}
+
+// ValidateCredential authenticates a request made with an API key pair,
+// either through HTTP Basic auth or through the X-Api-* signature headers,
+// and returns the user that owns the credential.
+func ValidateCredential(c *gin.Context) (*User, error) {
+	if apiKey, apiSecret, ok := c.Request.BasicAuth(); ok {
+		credential, err := findCredential(c, apiKey)
+		if err != nil {
+			return &User{}, err
+		}
+		ok, _ := ComparePassword(apiSecret, credential.SecretHash)
+		if !ok && credential.PreviousValid() {
+			ok, _ = ComparePassword(apiSecret, credential.PreviousSecretHash)
+		}
+		if !ok {
+			return &User{}, StatusUnauthorized
+		}
+		return useCredential(credential)
+	}
+
+	apiKey := c.Request.Header.Get(ApiKeyHeader)
+	timestamp := c.Request.Header.Get(ApiTimestampHeader)
+	nonce := c.Request.Header.Get(ApiNonceHeader)
+	signature := c.Request.Header.Get(ApiSignatureHeader)
+	if apiKey == "" || timestamp == "" || nonce == "" || signature == "" {
+		return &User{}, StatusUnauthorized
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &User{}, StatusUnauthorized
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return &User{}, StatusUnauthorized
+	}
+
+	credential, err := findCredential(c, apiKey)
+	if err != nil {
+		return &User{}, err
+	}
+
+	bodyHash, err := signedBodyHash(c)
+	if err != nil {
+		return &User{}, err
+	}
+
+	sealed := []string{credential.SigningKey}
+	if credential.PreviousValid() {
+		sealed = append(sealed, credential.PreviousSigningKey)
+	}
+	valid := false
+	for _, value := range sealed {
+		key, err := Decrypt(value)
+		if err != nil {
+			continue
+		}
+		expected := signWithKey(
+			key, c.Request.Method, c.Request.URL.RequestURI(),
+			timestamp, nonce, bodyHash,
+		)
+		if hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return &User{}, StatusUnauthorized
+	}
+
+	cmd := db.DefaultCache.SetNX(
+		context.Background(),
+		"nonce-"+credential.ApiKey+"-"+nonce,
+		timestamp, 2*signatureMaxSkew,
+	)
+	if cmd.Err() != nil {
+		return &User{}, StatusInternalServerError
+	}
+	if !cmd.Val() {
+		return &User{}, StatusUnauthorized
+	}
+
+	return useCredential(credential)
+}
+
+// SignRequest computes the signature a client must send in X-Api-Signature:
+// the hex encoded HMAC-SHA256 of the method, request URI, timestamp, nonce
+// and hex encoded SHA-256 of the body, joined by newlines. The HMAC key is the
+// hex encoded SHA-256 of the api secret. Bodies bigger than
+// SIGNED_BODY_MAX_SIZE must also send that body hash in X-Content-SHA256.
+func SignRequest(apiSecret, method, uri, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return signWithKey(SigningKey(apiSecret), method, uri, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+}
+
+// SigningKey derives the HMAC key used to sign requests from an api secret.
+func SigningKey(apiSecret string) string {
+	sum := sha256.Sum256([]byte(apiSecret))
+	return hex.EncodeToString(sum[:])
+}
+
+// SealCredentialSecret stores only the hash, visible prefix and encrypted
+// signing key of apiSecret on the credential, so neither the secret nor a
+// key able to sign requests can be read back from the database.
+func SealCredentialSecret(credential *models.Credential, apiSecret string) error {
+	hash, err := HashPassword(apiSecret)
+	if err != nil {
+		return err
+	}
+	signingKey, err := Encrypt(SigningKey(apiSecret))
+	if err != nil {
+		return err
+	}
+
+	prefix := apiSecret
+	if len(prefix) > secretPrefixLength {
+		prefix = prefix[:secretPrefixLength]
+	}
+
+	credential.ApiSecret = ""
+	credential.SecretHash = hash
+	credential.SecretPrefix = prefix
+	credential.SigningKey = signingKey
+	return nil
+}
+
+// RotateCredentialSecret seals apiSecret as the new secret of the credential
+// and keeps the current one valid for grace.
+func RotateCredentialSecret(credential *models.Credential, apiSecret string, grace time.Duration) error {
+	previousHash := credential.SecretHash
+	previousKey := credential.SigningKey
+	if err := SealCredentialSecret(credential, apiSecret); err != nil {
+		return err
+	}
+
+	previousExpiresAt := time.Now().Add(grace)
+	credential.PreviousSecretHash = previousHash
+	credential.PreviousSigningKey = previousKey
+	credential.PreviousExpiresAt = &previousExpiresAt
+	return nil
+}
+
+// MigrateCredentialSecrets seals credentials that were created while secrets
+// were still stored in plaintext, and encrypts signing keys stored in the
+// clear. It fails without CREDENTIAL_ENCRYPTION_KEY.
+func MigrateCredentialSecrets() error {
+	if _, err := encryptionCipher(); err != nil {
+		return err
+	}
+
+	conn := db.DefaultClient
+	credentials := make([]*models.Credential, 0)
+	tx := conn.Where("api_secret <> '' AND secret_hash = ''").Find(&credentials)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	for _, credential := range credentials {
+		if err := SealCredentialSecret(credential, credential.ApiSecret); err != nil {
+			return err
+		}
+		tx := conn.Model(credential).
+			Select("api_secret", "secret_hash", "secret_prefix", "signing_key").
+			Updates(credential)
+		if tx.Error != nil {
+			return tx.Error
+		}
+	}
+
+	credentials = make([]*models.Credential, 0)
+	tx = conn.Unscoped().
+		Where("(signing_key <> '' AND signing_key NOT LIKE ?) OR (previous_signing_key <> '' AND previous_signing_key NOT LIKE ?)",
+			encryptedPrefix+"%", encryptedPrefix+"%").
+		Find(&credentials)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, credential := range credentials {
+		for _, key := range []*string{&credential.SigningKey, &credential.PreviousSigningKey} {
+			if *key == "" || IsEncrypted(*key) {
+				continue
+			}
+			encrypted, err := Encrypt(*key)
+			if err != nil {
+				return err
+			}
+			*key = encrypted
+		}
+		tx := conn.Unscoped().Model(credential).
+			Select("signing_key", "previous_signing_key").
+			Updates(credential)
+		if tx.Error != nil {
+			return tx.Error
+		}
+	}
+
+	return nil
+}
+
+func signWithKey(key, method, uri, timestamp, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join([]string{
+		strings.ToUpper(method),
+		uri,
+		timestamp,
+		nonce,
+		bodyHash,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedBodyHash returns the hex encoded SHA-256 of the body the signature
+// covers. With X-Content-SHA256 the body keeps streaming and is checked as it
+// is read; without it the body is buffered, up to signedBodyLimit.
+func signedBodyHash(c *gin.Context) (string, error) {
+	if digest := strings.ToLower(c.Request.Header.Get(ApiContentHashHeader)); digest != "" {
+		c.Request.Body = &hashedBody{ReadCloser: c.Request.Body, hash: sha256.New(), expected: digest}
+		return digest, nil
+	}
+
+	limit := signedBodyLimit()
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+	if err != nil {
+		return "", StatusBadRequest
+	}
+	if int64(len(body)) > limit {
+		return "", StatusRequestEntityTooLarge
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashedBody fails the read that reaches the end of a body that doesn't
+// match the hash it was signed with, so handlers treating read errors as
+// failures never accept a tampered body.
+type hashedBody struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (b *hashedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.hash.Sum(nil)) != b.expected {
+		return n, errBodyHashMismatch
+	}
+	return n, err
+}
+
+func findCredential(c *gin.Context, apiKey string) (*models.Credential, error) {
+	if apiKey == "" {
+		return &models.Credential{}, StatusUnauthorized
+	}
+
+	conn := db.DefaultClient
+	credential := &models.Credential{}
+	tx := conn.Where("api_key = ? AND deleted_at IS NULL", apiKey).
+		Limit(1).
+		Find(credential)
+	if tx.Error != nil {
+		return &models.Credential{}, StatusInternalServerError
+	}
+	if credential.ID == 0 {
+		return &models.Credential{}, StatusUnauthorized
+	}
+	if credential.ExpiresAt != nil && time.Now().After(*credential.ExpiresAt) {
+		return &models.Credential{}, StatusUnauthorized
+	}
+	if !ipAllowed(c.ClientIP(), credential.AllowedIPs) {
+		return &models.Credential{}, StatusUnauthorized
+	}
+	return credential, nil
+}
+
+// ipAllowed reports whether ip matches any address or CIDR of the allowlist.
+// An empty allowlist allows every address.
+func ipAllowed(ip string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, allowed := range allowlist {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if allowedAddr := net.ParseIP(allowed); allowedAddr != nil && allowedAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidIPOrCIDR reports whether value is an IP address or a CIDR block.
+func ValidIPOrCIDR(value string) bool {
+	if _, _, err := net.ParseCIDR(value); err == nil {
+		return true
+	}
+	return net.ParseIP(value) != nil
+}
+
+func useCredential(credential *models.Credential) (*User, error) {
+	conn := db.DefaultClient
+	user := &models.User{}
+	tx := conn.Select(SessionFields).
+		Where("id = ? AND deleted_at IS NULL AND suspended_at IS NULL", credential.OwnerId).
+		Limit(1).
+		Find(user)
+	if tx.Error != nil {
+		return &User{}, StatusInternalServerError
+	}
+	if user.ID == 0 {
+		return &User{}, StatusUnauthorized
+	}
+
+	tx = conn.Model(&models.Credential{}).
+		Where("id = ?", credential.ID).
+		Update("last_used", time.Now())
+	if tx.Error != nil {
+		return &User{}, StatusInternalServerError
+	}
+
+	session := ParseSession("", user)
+	if credential.WorkspaceId != nil {
+		member, err := setWorkspace(session.User, *credential.WorkspaceId)
+		if err != nil {
+			return &User{}, StatusInternalServerError
+		}
+		if !member {
+			return &User{}, StatusUnauthorized
+		}
+	}
+	session.User.Scopes = credential.Scopes
+	if session.User.Scopes == nil {
+		session.User.Scopes = []string{}
+	}
+	return session.User, nil
+}
+
+// HasScope reports whether the user may perform scope. Session users have
+// every scope, credential users only the ones granted to the credential.
+func (u *User) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+
+	resource := strings.SplitN(scope, ":", 2)[0]
+	for _, granted := range u.Scopes {
+		if granted == "*" || granted == scope || granted == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newSignedContext(body, digest string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/uploads", strings.NewReader(body))
+	if digest != "" {
+		c.Request.Header.Set(ApiContentHashHeader, digest)
+	}
+	return c
+}
+
+func hexSHA256(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSignedBodyHashBuffersSmallBodies(t *testing.T) {
+	c := newSignedContext(`{"name":"a"}`, "")
+	bodyHash, err := signedBodyHash(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyHash != hexSHA256(`{"name":"a"}`) {
+		t.Errorf("hash = %v", bodyHash)
+	}
+	body, _ := io.ReadAll(c.Request.Body)
+	if string(body) != `{"name":"a"}` {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSignedBodyHashRejectsBigBodies(t *testing.T) {
+	t.Setenv("SIGNED_BODY_MAX_SIZE", "8")
+	if _, err := signedBodyHash(newSignedContext("123456789", "")); err != StatusRequestEntityTooLarge {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestSignedBodyHashStreamsWithDigest(t *testing.T) {
+	t.Setenv("SIGNED_BODY_MAX_SIZE", "8")
+	body := strings.Repeat("chunk", 100)
+
+	c := newSignedContext(body, hexSHA256(body))
+	bodyHash, err := signedBodyHash(c)
+	if err != nil || bodyHash != hexSHA256(body) {
+		t.Fatalf("hash = %v, err = %v", bodyHash, err)
+	}
+	if read, err := io.ReadAll(c.Request.Body); err != nil || string(read) != body {
+		t.Errorf("read %d bytes, err = %v", len(read), err)
+	}
+
+	c = newSignedContext(body+"!", hexSHA256(body))
+	if _, err := signedBodyHash(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(c.Request.Body); err != errBodyHashMismatch {
+		t.Errorf("err = %v, want a mismatch", err)
+	}
+}
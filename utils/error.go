@@ -13,7 +13,8 @@ type HttpResponse struct {
 }
 
 type HttpError struct {
-	Message string `json:"message"`
+	Message    string `json:"message"`
+	Permission string `json:"permission,omitempty"`
 }
 
 var StatusInternalServerError = &HttpResponse{
@@ -26,11 +27,39 @@ var StatusUnauthorized = &HttpResponse{
 	Obj:    HttpError{Message: "Unauthorized"},
 }
 
+var StatusForbidden = &HttpResponse{
+	Status: http.StatusForbidden,
+	Obj:    HttpError{Message: "Forbidden"},
+}
+
+// NewForbidden is the response for requests missing permission.
+func NewForbidden(permission string) *HttpResponse {
+	return &HttpResponse{
+		Status: http.StatusForbidden,
+		Obj:    HttpError{Message: "Forbidden", Permission: permission},
+	}
+}
+
+var StatusEmailNotVerified = &HttpResponse{
+	Status: http.StatusForbidden,
+	Obj:    HttpError{Message: "Email not verified"},
+}
+
+var StatusTooManyRequests = &HttpResponse{
+	Status: http.StatusTooManyRequests,
+	Obj:    HttpError{Message: "Too Many Requests"},
+}
+
 var StatusBadRequest = &HttpResponse{
 	Status: http.StatusBadRequest,
 	Obj:    HttpError{Message: "Bad Request"},
 }
 
+var StatusRequestEntityTooLarge = &HttpResponse{
+	Status: http.StatusRequestEntityTooLarge,
+	Obj:    HttpError{Message: "Request Entity Too Large"},
+}
+
 var StatusNotFound = &HttpResponse{
 	Status: http.StatusNotFound,
 	Obj:    HttpError{Message: "Not Found"},
@@ -71,6 +71,17 @@ func ComparePassword(password string, storedInfo string) (bool, error) {
 
 func GenerateRandomString(length int) (string, error) {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	return generateFromCharset(charset, length)
+}
+
+// GenerateCode returns a random code meant to be typed by people, so it
+// leaves out characters that are easy to confuse.
+func GenerateCode(length int) (string, error) {
+	const charset = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	return generateFromCharset(charset, length)
+}
+
+func generateFromCharset(charset string, length int) (string, error) {
 	var result string
 
 	for i := 0; i < length; i++ {
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"encoding/base64"
 	"io"
 	"strings"
 
@@ -43,6 +44,21 @@ func Copy(dest gin.ResponseWriter, src io.Reader) (written int64, err error) {
 	return written, nil
 }
 
+// DecodeBase64File decodes a data URL, like data:application/pdf;base64,...,
+// and returns its content along with the media type it declares.
+func DecodeBase64File(data string) ([]byte, string, error) {
+	encoded, err := ParseBase64File(data)
+	if err != nil {
+		return nil, "", err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", StatusBadRequest
+	}
+	declared := strings.TrimPrefix(strings.SplitN(data, ";", 2)[0], "data:")
+	return decoded, declared, nil
+}
+
 func ParseBase64File(data string) (string, error) {
 	parts := strings.Split(data, ";base64,")
 	if len(parts) != 2 {
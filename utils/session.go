@@ -2,6 +2,12 @@ package utils
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -9,7 +15,7 @@ import (
 	"github.com/juliotorresmoreno/tana-api/models"
 )
 
-var SessionFields = []string{"id", "name", "last_name", "email", "photo_url", "phone"}
+var SessionFields = []string{"id", "name", "last_name", "email", "photo_url", "phone", "rol", "verified"}
 
 type User struct {
 	ID       uint   `json:"id"`
@@ -18,6 +24,19 @@ type User struct {
 	Email    string `json:"email"`
 	PhotoURL string `json:"photo_url"`
 	Phone    string `json:"phone"`
+	Rol      string `json:"rol"`
+	Verified bool   `json:"verified"`
+
+	// ImpersonatorID is the admin acting as this user, if any.
+	ImpersonatorID uint `json:"impersonator_id,omitempty"`
+
+	// WorkspaceID is the active workspace, zero for the personal space, and
+	// WorkspaceRole the role of the user in it.
+	WorkspaceID   uint   `json:"workspace_id,omitempty"`
+	WorkspaceRole string `json:"workspace_role,omitempty"`
+
+	// Scopes is nil for session users, who aren't restricted.
+	Scopes []string `json:"-"`
 }
 
 type Session struct {
@@ -25,31 +44,126 @@ type Session struct {
 	User  *User  `json:"user"`
 }
 
+// SessionInfo describes a session without exposing its token.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Device    string    `json:"device"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+
+	ImpersonatorID uint `json:"impersonator_id,omitempty"`
+}
+
+// SessionIdleTimeout is how long a session survives without being used,
+// from SESSION_IDLE_TIMEOUT (default 24h).
+func SessionIdleTimeout() time.Duration {
+	return DurationFromEnv("SESSION_IDLE_TIMEOUT", 24*time.Hour)
+}
+
+// SessionMaxLifetime is how long a session survives no matter how often it
+// is used, from SESSION_MAX_LIFETIME (default 30 days).
+func SessionMaxLifetime() time.Duration {
+	return DurationFromEnv("SESSION_MAX_LIFETIME", 30*24*time.Hour)
+}
+
+// DurationFromEnv parses the duration in the environment variable name, like
+// "24h", and falls back when it is unset or invalid.
+func DurationFromEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// IntFromEnv parses the positive integer in the environment variable name
+// and falls back when it is unset or invalid.
+func IntFromEnv(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func sessionKey(token string) string {
+	return "session-" + token
+}
+
+func sessionIndexKey(userID uint) string {
+	return fmt.Sprintf("user-sessions-%v", userID)
+}
+
 func ValidateSession(c *gin.Context) (*User, error) {
 	token, err := GetToken(c)
 	if err != nil {
 		return &User{}, StatusUnauthorized
 	}
+
 	ctx := context.Background()
-	cmd := db.DefaultCache.Get(ctx, "session-"+token)
-	email := cmd.Val()
-	if email == "" {
+	values, err := db.DefaultCache.HGetAll(ctx, sessionKey(token)).Result()
+	if err != nil || values["user_id"] == "" {
+		return &User{}, StatusUnauthorized
+	}
+
+	expiresAt := sessionExpiresAt(values)
+	if time.Now().After(expiresAt) {
+		RevokeSession(token)
 		return &User{}, StatusUnauthorized
 	}
 
 	conn := db.DefaultClient
 	user := &models.User{}
-	tx := conn.Select(SessionFields).First(user, "email = ? AND deleted_at IS NULL", email)
+	tx := conn.Select(SessionFields).
+		Where("id = ? AND deleted_at IS NULL AND suspended_at IS NULL", values["user_id"]).
+		Limit(1).
+		Find(user)
 	if tx.Error != nil {
 		return &User{}, StatusInternalServerError
 	}
+	if user.ID == 0 {
+		RevokeSession(token)
+		return &User{}, StatusUnauthorized
+	}
 
-	db.DefaultCache.Set(ctx, "session-"+token, email, 24*time.Hour)
+	ttl := SessionIdleTimeout()
+	if remaining := time.Until(expiresAt); remaining < ttl {
+		ttl = remaining
+	}
+	db.DefaultCache.HSet(ctx, sessionKey(token),
+		"ip", c.ClientIP(),
+		"last_seen", time.Now().Unix(),
+	)
+	db.DefaultCache.Expire(ctx, sessionKey(token), ttl)
 	session := ParseSession(token, user)
+	impersonatorID, _ := strconv.Atoi(values["impersonator_id"])
+	session.User.ImpersonatorID = uint(impersonatorID)
+
+	workspaceID, _ := strconv.Atoi(values["workspace_id"])
+	member, err := setWorkspace(session.User, uint(workspaceID))
+	if err != nil {
+		return &User{}, StatusInternalServerError
+	}
+	if !member {
+		db.DefaultCache.HSet(ctx, sessionKey(token), "workspace_id", 0)
+	}
 
 	return session.User, nil
 }
 
+// sessionExpiresAt is the absolute expiration of a session: its expires_at,
+// or SessionMaxLifetime after created_at for sessions without one.
+func sessionExpiresAt(values map[string]string) time.Time {
+	if expiresAt, err := strconv.ParseInt(values["expires_at"], 10, 64); err == nil {
+		return time.Unix(expiresAt, 0)
+	}
+	createdAt, _ := strconv.ParseInt(values["created_at"], 10, 64)
+	return time.Unix(createdAt, 0).Add(SessionMaxLifetime())
+}
+
 func ParseSession(token string, user *models.User) *Session {
 	return &Session{
 		Token: token,
@@ -60,24 +174,212 @@ func ParseSession(token string, user *models.User) *Session {
 			Email:    user.Email,
 			PhotoURL: user.PhotoURL,
 			Phone:    user.Phone,
+			Rol:      user.Rol,
+			Verified: user.Verified,
 		},
 	}
 }
 
-func MakeSession(user *models.User) (*Session, error) {
+func MakeSession(c *gin.Context, user *models.User) (*Session, error) {
+	return makeSession(c, user, 0, SessionMaxLifetime())
+}
+
+// MakeImpersonationSession creates a session that lets the admin
+// impersonatorID act as user for lifetime. The session is marked with the
+// admin so it shows up as such in the session list and in the user payload.
+func MakeImpersonationSession(c *gin.Context, user *models.User, impersonatorID uint, lifetime time.Duration) (*Session, error) {
+	session, err := makeSession(c, user, impersonatorID, lifetime)
+	if err != nil {
+		return session, err
+	}
+	session.User.ImpersonatorID = impersonatorID
+	return session, nil
+}
+
+func makeSession(c *gin.Context, user *models.User, impersonatorID uint, lifetime time.Duration) (*Session, error) {
 	token, err := GenerateRandomString(128)
 	if err != nil {
 		return &Session{}, StatusInternalServerError
 	}
+	id, err := GenerateRandomString(16)
+	if err != nil {
+		return &Session{}, StatusInternalServerError
+	}
 
-	cmd := db.DefaultCache.Set(
-		context.Background(),
-		"session-"+token,
-		user.Email, 24*time.Hour,
+	ctx := context.Background()
+	now := time.Now()
+	userAgent := c.Request.UserAgent()
+	cmd := db.DefaultCache.HSet(ctx, sessionKey(token),
+		"id", id,
+		"user_id", user.ID,
+		"ip", c.ClientIP(),
+		"user_agent", userAgent,
+		"device", deviceFromUserAgent(userAgent),
+		"created_at", now.Unix(),
+		"last_seen", now.Unix(),
+		"expires_at", now.Add(lifetime).Unix(),
+		"impersonator_id", impersonatorID,
 	)
 	if cmd.Err() != nil {
 		return &Session{}, StatusInternalServerError
 	}
 
+	ttl := SessionIdleTimeout()
+	if lifetime < ttl {
+		ttl = lifetime
+	}
+	db.DefaultCache.Expire(ctx, sessionKey(token), ttl)
+
+	if err := db.DefaultCache.SAdd(ctx, sessionIndexKey(user.ID), token).Err(); err != nil {
+		return &Session{}, StatusInternalServerError
+	}
+
 	return ParseSession(token, user), nil
 }
+
+// ListSessions returns the live sessions of the user, most recently used
+// first. Expired sessions are dropped from the index along the way.
+func ListSessions(userID uint, currentToken string) ([]*SessionInfo, error) {
+	ctx := context.Background()
+	tokens, err := db.DefaultCache.SMembers(ctx, sessionIndexKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*SessionInfo, 0, len(tokens))
+	for _, token := range tokens {
+		values, err := db.DefaultCache.HGetAll(ctx, sessionKey(token)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if values["id"] == "" {
+			db.DefaultCache.SRem(ctx, sessionIndexKey(userID), token)
+			continue
+		}
+
+		createdAt, _ := strconv.ParseInt(values["created_at"], 10, 64)
+		lastSeen, _ := strconv.ParseInt(values["last_seen"], 10, 64)
+		impersonatorID, _ := strconv.Atoi(values["impersonator_id"])
+		sessions = append(sessions, &SessionInfo{
+			ID:        values["id"],
+			IP:        values["ip"],
+			UserAgent: values["user_agent"],
+			Device:    values["device"],
+			CreatedAt: time.Unix(createdAt, 0),
+			LastSeen:  time.Unix(lastSeen, 0),
+			Current:   token == currentToken,
+
+			ImpersonatorID: uint(impersonatorID),
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+// RevokeSession deletes the session identified by token.
+func RevokeSession(token string) error {
+	ctx := context.Background()
+	userID, err := db.DefaultCache.HGet(ctx, sessionKey(token), "user_id").Result()
+	if err == nil {
+		id, _ := strconv.Atoi(userID)
+		db.DefaultCache.SRem(ctx, sessionIndexKey(uint(id)), token)
+	}
+	return db.DefaultCache.Del(ctx, sessionKey(token)).Err()
+}
+
+// RevokeSessionByID deletes the session of the user with the public id
+// returned by ListSessions.
+func RevokeSessionByID(userID uint, id string) error {
+	ctx := context.Background()
+	tokens, err := db.DefaultCache.SMembers(ctx, sessionIndexKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		sessionID, _ := db.DefaultCache.HGet(ctx, sessionKey(token), "id").Result()
+		if sessionID != "" && sessionID == id {
+			return RevokeSession(token)
+		}
+	}
+	return StatusNotFound
+}
+
+// RevokeUserSessions deletes every session of the user.
+func RevokeUserSessions(userID uint) error {
+	ctx := context.Background()
+	index := sessionIndexKey(userID)
+	tokens, err := db.DefaultCache.SMembers(ctx, index).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{index}
+	for _, token := range tokens {
+		keys = append(keys, sessionKey(token))
+	}
+	return db.DefaultCache.Del(ctx, keys...).Err()
+}
+
+func SetSessionCookie(c *gin.Context, session *Session) {
+	cookie := &http.Cookie{
+		Name:     "token",
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  time.Now().Add(SessionMaxLifetime()),
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+func ClearSessionCookie(c *gin.Context) {
+	cookie := &http.Cookie{
+		Name:     "token",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+// deviceFromUserAgent gives a rough, human readable name for the device
+// behind a user agent.
+func deviceFromUserAgent(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+
+	platform := "Unknown device"
+	switch {
+	case strings.Contains(ua, "iphone"):
+		platform = "iPhone"
+	case strings.Contains(ua, "ipad"):
+		platform = "iPad"
+	case strings.Contains(ua, "android"):
+		platform = "Android"
+	case strings.Contains(ua, "windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "mac os"):
+		platform = "Mac"
+	case strings.Contains(ua, "linux"):
+		platform = "Linux"
+	}
+
+	switch {
+	case strings.Contains(ua, "edg/"):
+		return platform + " - Edge"
+	case strings.Contains(ua, "chrome/"):
+		return platform + " - Chrome"
+	case strings.Contains(ua, "firefox/"):
+		return platform + " - Firefox"
+	case strings.Contains(ua, "safari/"):
+		return platform + " - Safari"
+	}
+	return platform
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juliotorresmoreno/tana-api/db"
+	"github.com/juliotorresmoreno/tana-api/models"
+	"gorm.io/gorm"
+)
+
+// OwnedBy scopes a query to the resources of the active workspace of the
+// user or, outside of a workspace, to the personal resources of the user.
+func OwnedBy(user *User) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if user.WorkspaceID != 0 {
+			return tx.Where("workspace_id = ?", user.WorkspaceID)
+		}
+		return tx.Where("owner_id = ? AND workspace_id IS NULL", user.ID)
+	}
+}
+
+// Workspace is the workspace_id new resources of the user are created with.
+func (u *User) Workspace() *uint {
+	if u.WorkspaceID == 0 {
+		return nil
+	}
+	workspaceID := u.WorkspaceID
+	return &workspaceID
+}
+
+// WorkspaceRole returns the role of the user in the workspace, or an empty
+// string if the user isn't a member.
+func WorkspaceRole(workspaceID, userID uint) (string, error) {
+	member := &models.WorkspaceMember{}
+	tx := db.DefaultClient.
+		Joins("JOIN workspaces ON workspaces.id = workspace_members.workspace_id AND workspaces.deleted_at IS NULL").
+		Where("workspace_members.workspace_id = ? AND workspace_members.user_id = ?", workspaceID, userID).
+		Limit(1).
+		Find(member)
+	if tx.Error != nil {
+		return "", tx.Error
+	}
+	return member.Role, nil
+}
+
+// SwitchWorkspace makes workspaceID the active workspace of the current
+// session. Zero goes back to the personal space.
+func SwitchWorkspace(c *gin.Context, workspaceID uint) error {
+	token, err := GetToken(c)
+	if err != nil {
+		return StatusUnauthorized
+	}
+
+	ctx := context.Background()
+	exists, err := db.DefaultCache.Exists(ctx, sessionKey(token)).Result()
+	if err != nil {
+		return StatusInternalServerError
+	}
+	if exists == 0 {
+		return StatusUnauthorized
+	}
+	if err := db.DefaultCache.HSet(ctx, sessionKey(token), "workspace_id", workspaceID).Err(); err != nil {
+		return StatusInternalServerError
+	}
+	return nil
+}
+
+// setWorkspace activates workspaceID for user if it is still a member.
+func setWorkspace(user *User, workspaceID uint) (bool, error) {
+	if workspaceID == 0 {
+		return true, nil
+	}
+	role, err := WorkspaceRole(workspaceID, user.ID)
+	if err != nil {
+		return false, err
+	}
+	if role == "" {
+		return false, nil
+	}
+	user.WorkspaceID = workspaceID
+	user.WorkspaceRole = role
+	return true, nil
+}